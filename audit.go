@@ -0,0 +1,365 @@
+package guac
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AuditEventType identifies the kind of an AuditEvent.
+type AuditEventType string
+
+const (
+	// AuditConnectFailed is a connect request which didn't create a tunnel
+	AuditConnectFailed AuditEventType = "connect_failed"
+	// AuditAuthFailed is a connect request refused as unauthorized or forbidden, or a request to an HTTP tunnel
+	// with the wrong token
+	AuditAuthFailed AuditEventType = "auth_failed"
+	// AuditSessionStart is a new connection to guacd
+	AuditSessionStart AuditEventType = "session_start"
+	// AuditJoin is a session joining an existing connection by its ID, which starts with no protocol
+	AuditJoin AuditEventType = "join"
+	// AuditSessionEnd is the end of a session, with the reason it ended
+	AuditSessionEnd AuditEventType = "session_end"
+	// AuditKill is a session closed by the application, e.g. at an administrator's request. It precedes the
+	// session's AuditSessionEnd.
+	AuditKill AuditEventType = "kill"
+	// AuditClipboard is clipboard data sent in either direction
+	AuditClipboard AuditEventType = "clipboard"
+	// AuditFileUpload is a file sent by the client
+	AuditFileUpload AuditEventType = "file_upload"
+	// AuditFileDownload is a file sent to the client
+	AuditFileDownload AuditEventType = "file_download"
+)
+
+// Directions of data through a tunnel
+const (
+	directionToClient = "to_client"
+	directionToGuacd  = "to_guacd"
+)
+
+// AuditEvent records a security-relevant event of a session. Fields which don't apply to the event are empty.
+type AuditEvent struct {
+	Time time.Time      `json:"time"`
+	Type AuditEventType `json:"type"`
+
+	// Transport is "http" or "websocket"
+	Transport    string `json:"transport,omitempty"`
+	TunnelUUID   string `json:"tunnel_uuid,omitempty"`
+	ConnectionID string `json:"connection_id,omitempty"`
+	Protocol     string `json:"protocol,omitempty"`
+	// User is returned by the server's User callback for the request
+	User       string `json:"user,omitempty"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+
+	// Reason is the DisconnectReason which ended a session
+	Reason string `json:"reason,omitempty"`
+	// Status is the status of a failure, a refused transfer or the end of a session
+	Status  string `json:"status,omitempty"`
+	Message string `json:"message,omitempty"`
+
+	// Direction is "to_client" or "to_guacd" for clipboard data and files
+	Direction string `json:"direction,omitempty"`
+	Mimetype  string `json:"mimetype,omitempty"`
+	Filename  string `json:"filename,omitempty"`
+	// Bytes is the decoded size of clipboard data or a file, or the traffic of a whole session
+	Bytes int64 `json:"bytes,omitempty"`
+}
+
+// Auditor records audit events. It is called from the goroutines serving sessions, so it must be safe for
+// concurrent use and should not block for long. Errors are logged by the server.
+type Auditor interface {
+	Audit(event AuditEvent) error
+}
+
+// audit records the event, logging the error if that fails.
+func audit(auditor Auditor, logger *slog.Logger, event AuditEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if err := auditor.Audit(event); err != nil {
+		logger.Error("Unable to audit event", "type", string(event.Type), "error", err)
+	}
+}
+
+// auditConnectFailure records a connect request which failed with err, if there is an auditor.
+func auditConnectFailure(auditor Auditor, logger *slog.Logger, transport string, r *http.Request, user string, err *ErrGuac) {
+	if auditor == nil {
+		return
+	}
+	event := AuditEvent{
+		Type:       AuditConnectFailed,
+		Transport:  transport,
+		User:       user,
+		RemoteAddr: r.RemoteAddr,
+		Status:     err.Status.String(),
+		Message:    err.Error(),
+	}
+	if err.Status == ClientUnauthorized || err.Status == ClientForbidden {
+		event.Type = AuditAuthFailed
+	}
+	audit(auditor, logger, event)
+}
+
+// sessionAuditor audits the events of one session, including the clipboard data and files passing through
+// its tunnel. Its methods do nothing on a nil sessionAuditor, which is what servers without an auditor use.
+type sessionAuditor struct {
+	auditor Auditor
+	logger  *slog.Logger
+	// base holds the fields identifying the session
+	base AuditEvent
+
+	mu sync.Mutex
+	// the transfers in progress in each direction by stream index
+	toClient map[string]*AuditEvent
+	toGuacd  map[string]*AuditEvent
+}
+
+// newSessionAuditor returns the auditor of a session, or nil if there is no auditor.
+func newSessionAuditor(auditor Auditor, logger *slog.Logger, transport string, r *http.Request, user string, tunnel Tunnel) *sessionAuditor {
+	if auditor == nil {
+		return nil
+	}
+	return &sessionAuditor{
+		auditor: auditor,
+		logger:  logger,
+		base: AuditEvent{
+			Transport:    transport,
+			TunnelUUID:   tunnel.GetUUID(),
+			ConnectionID: tunnel.ConnectionID(),
+			Protocol:     protocolOf(tunnel),
+			User:         user,
+			RemoteAddr:   r.RemoteAddr,
+		},
+		toClient: make(map[string]*AuditEvent),
+		toGuacd:  make(map[string]*AuditEvent),
+	}
+}
+
+// event returns an event of the session
+func (a *sessionAuditor) event(eventType AuditEventType) AuditEvent {
+	event := a.base
+	event.Type = eventType
+	return event
+}
+
+// start records the start of the session, or the join if it joined an existing connection.
+func (a *sessionAuditor) start() {
+	if a == nil {
+		return
+	}
+	if a.base.Protocol == "" {
+		audit(a.auditor, a.logger, a.event(AuditJoin))
+		return
+	}
+	audit(a.auditor, a.logger, a.event(AuditSessionStart))
+}
+
+// end records the end of the session for the reason, and the kill which ended it if it was killed. Transfers
+// still in progress are recorded as incomplete first.
+func (a *sessionAuditor) end(tunnel Tunnel, reason CloseReason) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	var incomplete []AuditEvent
+	for _, streams := range []map[string]*AuditEvent{a.toClient, a.toGuacd} {
+		for index, transfer := range streams {
+			transfer.Message = "Session ended during transfer."
+			incomplete = append(incomplete, *transfer)
+			delete(streams, index)
+		}
+	}
+	a.mu.Unlock()
+	for _, event := range incomplete {
+		audit(a.auditor, a.logger, event)
+	}
+
+	event := a.event(AuditSessionEnd)
+	event.Reason = reason.Cause.String()
+	event.Status = reason.Status.String()
+	event.Message = reason.Message
+	if reason.Cause == DisconnectKilled {
+		kill := event
+		kill.Type = AuditKill
+		audit(a.auditor, a.logger, kill)
+	}
+	stats := statsOf(tunnel)
+	event.Bytes = stats.ToClient.Bytes + stats.ToGuacd.Bytes
+	audit(a.auditor, a.logger, event)
+}
+
+// authFailed records a request to the session's tunnel which presented the wrong credentials. The client is
+// told there is no such tunnel.
+func (a *sessionAuditor) authFailed(r *http.Request, user string, message string) {
+	if a == nil {
+		return
+	}
+	event := a.event(AuditAuthFailed)
+	event.User = user
+	event.RemoteAddr = r.RemoteAddr
+	event.Status = ResourceNotFound.String()
+	event.Message = message
+	audit(a.auditor, a.logger, event)
+}
+
+// clipboardBlocked records clipboard data from the client which was blocked before reaching guacd.
+func (a *sessionAuditor) clipboardBlocked(mimetype string, size int64, reason string) {
+	if a == nil {
+		return
+	}
+	event := a.event(AuditClipboard)
+	event.Direction = directionToGuacd
+	event.Mimetype = mimetype
+	event.Bytes = size
+	event.Status = ClientForbidden.String()
+	event.Message = reason
+	audit(a.auditor, a.logger, event)
+}
+
+// reader returns r, observing the transfers it reads from guacd.
+func (a *sessionAuditor) reader(r InstructionReader) InstructionReader {
+	if a == nil {
+		return r
+	}
+	return &auditingReader{InstructionReader: r, auditor: a}
+}
+
+// writer returns w, observing the transfers it writes to guacd.
+func (a *sessionAuditor) writer(w io.Writer) io.Writer {
+	if a == nil {
+		return w
+	}
+	return &auditingWriter{w: w, auditor: a}
+}
+
+// observe follows the clipboard and file streams in the instructions sent in one direction. A transfer is
+// recorded when its stream ends, or when the receiver refuses it with an error ack.
+func (a *sessionAuditor) observe(direction string, ins []byte) {
+	streams, peers := a.toClient, a.toGuacd
+	if direction == directionToGuacd {
+		streams, peers = a.toGuacd, a.toClient
+	}
+
+	opcode, args := nextElement(ins)
+	switch string(opcode) {
+	case "clipboard":
+		index, args := nextElement(args)
+		mimetype, _ := nextElement(args)
+		a.open(direction, streams, index, AuditEvent{Type: AuditClipboard, Mimetype: string(mimetype)})
+	case "file":
+		index, args := nextElement(args)
+		mimetype, args := nextElement(args)
+		filename, _ := nextElement(args)
+		a.open(direction, streams, index, AuditEvent{Type: fileTransferType(direction), Mimetype: string(mimetype), Filename: string(filename)})
+	case "put", "body":
+		_, args = nextElement(args)
+		index, args := nextElement(args)
+		mimetype, args := nextElement(args)
+		filename, _ := nextElement(args)
+		a.open(direction, streams, index, AuditEvent{Type: fileTransferType(direction), Mimetype: string(mimetype), Filename: string(filename)})
+	case "blob":
+		index, args := nextElement(args)
+		data, _ := nextElement(args)
+		a.mu.Lock()
+		if transfer, ok := streams[string(index)]; ok {
+			transfer.Bytes += decodedLen(data)
+		}
+		a.mu.Unlock()
+	case "end":
+		index, _ := nextElement(args)
+		a.close(streams, index, "", "")
+	case "ack":
+		// an ack refers to a stream sent the other way
+		index, args := nextElement(args)
+		message, args := nextElement(args)
+		code, _ := nextElement(args)
+		if status, err := strconv.Atoi(string(code)); err == nil && status != 0 {
+			a.close(peers, index, FromGuacamoleStatusCode(status).String(), string(message))
+		}
+	}
+}
+
+// open starts following a transfer on a stream sent in the direction.
+func (a *sessionAuditor) open(direction string, streams map[string]*AuditEvent, index []byte, transfer AuditEvent) {
+	event := a.event(transfer.Type)
+	event.Direction = direction
+	event.Mimetype, event.Filename = transfer.Mimetype, transfer.Filename
+	event.Time = time.Now()
+	a.mu.Lock()
+	streams[string(index)] = &event
+	a.mu.Unlock()
+}
+
+// close records the transfer on the stream, if there is one, with the status and message it was refused with.
+func (a *sessionAuditor) close(streams map[string]*AuditEvent, index []byte, status, message string) {
+	a.mu.Lock()
+	transfer, ok := streams[string(index)]
+	delete(streams, string(index))
+	a.mu.Unlock()
+	if !ok {
+		return
+	}
+	transfer.Status, transfer.Message = status, message
+	audit(a.auditor, a.logger, *transfer)
+}
+
+func fileTransferType(direction string) AuditEventType {
+	if direction == directionToGuacd {
+		return AuditFileUpload
+	}
+	return AuditFileDownload
+}
+
+// decodedLen returns the number of bytes encoded by base64 data
+func decodedLen(data []byte) int64 {
+	n := int64(len(data)) / 4 * 3
+	for i := len(data) - 1; i >= 0 && i >= len(data)-2 && data[i] == '='; i-- {
+		n--
+	}
+	return n
+}
+
+// auditingReader observes the instructions read from guacd
+type auditingReader struct {
+	InstructionReader
+	auditor *sessionAuditor
+}
+
+// ReadSome reads and observes the next instruction
+func (r *auditingReader) ReadSome() ([]byte, error) {
+	return copied(r.ReadSomeNoCopy())
+}
+
+// ReadSomeNoCopy reads and observes the next instruction without copying it
+func (r *auditingReader) ReadSomeNoCopy() ([]byte, error) {
+	ins, err := readSomeNoCopy(r.InstructionReader)
+	if len(ins) > 0 {
+		r.auditor.observe(directionToClient, ins)
+	}
+	return ins, err
+}
+
+// auditingWriter observes the instructions written to guacd, which may be split across writes
+type auditingWriter struct {
+	w        io.Writer
+	auditor  *sessionAuditor
+	splitter instructionSplitter
+}
+
+// Write observes the instructions p completes and writes p. They are observed first, as guacd may respond
+// before Write returns.
+func (w *auditingWriter) Write(p []byte) (int, error) {
+	err := w.splitter.split(p, func(ins []byte) error {
+		w.auditor.observe(directionToGuacd, ins)
+		return nil
+	})
+	if err != nil {
+		// guacd will reject the data
+		w.splitter.release()
+	}
+	return w.w.Write(p)
+}
@@ -0,0 +1,225 @@
+package guac
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// JSONLinesAuditor writes each audit event as a line of JSON.
+type JSONLinesAuditor struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONLinesAuditor returns an auditor writing to w.
+func NewJSONLinesAuditor(w io.Writer) *JSONLinesAuditor {
+	return &JSONLinesAuditor{w: w}
+}
+
+// OpenJSONLinesAuditor returns an auditor appending to the file at path, which is created readable only by
+// its owner if it doesn't exist. Close the auditor to close the file.
+func OpenJSONLinesAuditor(path string) (*JSONLinesAuditor, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return NewJSONLinesAuditor(file), nil
+}
+
+// Audit writes the event with a single write, so lines are never interleaved.
+func (a *JSONLinesAuditor) Audit(event AuditEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, err = a.w.Write(line)
+	return err
+}
+
+// Close closes the underlying writer if it is an io.Closer.
+func (a *JSONLinesAuditor) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if closer, ok := a.w.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Syslog severities of audit events
+const (
+	syslogWarning = 4
+	syslogNotice  = 5
+)
+
+// SyslogAuthPriv is the syslog facility for security messages, the default of SyslogAuditor.
+const SyslogAuthPriv = 10
+
+// syslogSDID is the SD-ID of the structured data holding the fields of audit events, under the enterprise
+// number RFC 5612 reserves for documentation.
+const syslogSDID = "guac@32473"
+
+// syslogPaths are where the local syslog daemon listens
+var syslogPaths = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// SyslogAuditor sends audit events to syslog in the RFC 5424 format over a local socket. The fields of an event
+// are structured data, and its message the message of the event.
+type SyslogAuditor struct {
+	// Facility is the syslog facility of the messages.
+	Facility int
+	// Hostname and AppName identify the sender, the host name and "guac" by default.
+	Hostname string
+	AppName  string
+
+	network, address string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// NewSyslogAuditor connects to the syslog daemon at the address, a "unixgram" or "unix" socket. If both are
+// empty the usual local sockets are tried.
+func NewSyslogAuditor(network, address string) (*SyslogAuditor, error) {
+	hostname, _ := os.Hostname()
+	a := &SyslogAuditor{
+		Facility: SyslogAuthPriv,
+		Hostname: hostname,
+		AppName:  "guac",
+		network:  network,
+		address:  address,
+	}
+	if err := a.connect(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *SyslogAuditor) connect() (err error) {
+	if a.address != "" {
+		a.conn, err = net.Dial(a.network, a.address)
+		return
+	}
+	for _, path := range syslogPaths {
+		for _, network := range []string{"unixgram", "unix"} {
+			if a.conn, err = net.Dial(network, path); err == nil {
+				a.network, a.address = network, path
+				return
+			}
+		}
+	}
+	return errors.New("unable to connect to the local syslog daemon")
+}
+
+// Audit sends the event, reconnecting once if the daemon went away.
+func (a *SyslogAuditor) Audit(event AuditEvent) error {
+	message := a.format(event)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.conn != nil {
+		if err := a.write(message); err == nil {
+			return nil
+		}
+		_ = a.conn.Close()
+		a.conn = nil
+	}
+	if err := a.connect(); err != nil {
+		return err
+	}
+	return a.write(message)
+}
+
+// write sends one message. Datagrams need no framing, streams use the octet counting of RFC 6587.
+func (a *SyslogAuditor) write(message string) error {
+	if a.network != "unixgram" {
+		message = strconv.Itoa(len(message)) + " " + message
+	}
+	_, err := io.WriteString(a.conn, message)
+	return err
+}
+
+// Close closes the connection to the syslog daemon.
+func (a *SyslogAuditor) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.conn == nil {
+		return nil
+	}
+	err := a.conn.Close()
+	a.conn = nil
+	return err
+}
+
+// format formats the event as an RFC 5424 message.
+func (a *SyslogAuditor) format(event AuditEvent) string {
+	severity := syslogNotice
+	switch event.Type {
+	case AuditConnectFailed, AuditAuthFailed, AuditKill:
+		severity = syslogWarning
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %d %s [%s", a.Facility*8+severity,
+		event.Time.UTC().Format("2006-01-02T15:04:05.000000Z"),
+		syslogHeaderField(a.Hostname, 255), syslogHeaderField(a.AppName, 48), os.Getpid(),
+		syslogHeaderField(string(event.Type), 32), syslogSDID)
+	for _, param := range []struct{ name, value string }{
+		{"transport", event.Transport},
+		{"tunnel_uuid", event.TunnelUUID},
+		{"connection_id", event.ConnectionID},
+		{"protocol", event.Protocol},
+		{"user", event.User},
+		{"remote_addr", event.RemoteAddr},
+		{"reason", event.Reason},
+		{"status", event.Status},
+		{"direction", event.Direction},
+		{"mimetype", event.Mimetype},
+		{"filename", event.Filename},
+	} {
+		if param.value != "" {
+			fmt.Fprintf(&b, ` %s="%s"`, param.name, sdEscaper.Replace(param.value))
+		}
+	}
+	if event.Bytes != 0 {
+		fmt.Fprintf(&b, ` bytes="%d"`, event.Bytes)
+	}
+	b.WriteByte(']')
+	if event.Message != "" {
+		// the BOM marks the message as UTF-8
+		b.WriteString(" \uFEFF")
+		b.WriteString(event.Message)
+	}
+	return b.String()
+}
+
+// sdEscaper escapes the characters RFC 5424 reserves in structured data parameter values
+var sdEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// syslogHeaderField returns the value as a header field of at most max printable ASCII characters, or the
+// nil value if it is empty.
+func syslogHeaderField(value string, max int) string {
+	field := strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return '_'
+		}
+		return r
+	}, value)
+	if len(field) > max {
+		field = field[:max]
+	}
+	if field == "" {
+		return "-"
+	}
+	return field
+}
@@ -0,0 +1,147 @@
+package guac
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONLinesAuditor(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	event := AuditEvent{
+		Time:       time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Type:       AuditFileDownload,
+		TunnelUUID: "1",
+		Filename:   "a.txt",
+		Bytes:      5,
+	}
+
+	// the file is appended to by each auditor which opens it
+	for i := 0; i < 2; i++ {
+		a, err := OpenJSONLinesAuditor(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = a.Audit(event); err != nil {
+			t.Fatal(err)
+		}
+		if err = a.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %q", data)
+	}
+	want := `{"time":"2024-01-02T03:04:05Z","type":"file_download","tunnel_uuid":"1","filename":"a.txt","bytes":5}`
+	if lines[0] != want {
+		t.Errorf("Unexpected line %s, want %s", lines[0], want)
+	}
+	var decoded AuditEvent
+	if err = json.Unmarshal([]byte(lines[1]), &decoded); err != nil || decoded != event {
+		t.Errorf("Unexpected event %+v %v", decoded, err)
+	}
+}
+
+var syslogEvent = AuditEvent{
+	Time:       time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	Type:       AuditAuthFailed,
+	Transport:  transportHTTP,
+	User:       `bob "the" [admin]`,
+	RemoteAddr: "192.0.2.1:1234",
+	Message:    "Access denied.",
+}
+
+// syslogPattern matches syslogEvent formatted with the defaults, the facility authpriv (10) and severity
+// warning (4)
+var syslogPattern = regexp.MustCompile(`^<84>1 2024-01-02T03:04:05\.000000Z \S+ guac \d+ auth_failed ` +
+	`\[guac@32473 transport="http" user="bob \\"the\\" \[admin\\]" remote_addr="192\.0\.2\.1:1234"\] ` +
+	"\uFEFFAccess denied\\.$")
+
+func TestSyslogAuditor_Datagram(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	a, err := NewSyslogAuditor("unixgram", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = a.Close() }()
+	if err = a.Audit(syslogEvent); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !syslogPattern.Match(buf[:n]) {
+		t.Errorf("Unexpected message %q", buf[:n])
+	}
+}
+
+func TestSyslogAuditor_Stream(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = listener.Close() }()
+
+	a, err := NewSyslogAuditor("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = a.Close() }()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the daemon restarts, so the auditor reconnects
+	_ = conn.Close()
+	received := make(chan string)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			received <- err.Error()
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		line, _ := bufio.NewReader(conn).ReadString(']')
+		received <- line
+	}()
+
+	// a write to the closed connection may appear to succeed, so keep auditing until one arrives
+	var line string
+	for line == "" {
+		if err = a.Audit(syslogEvent); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case line = <-received:
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	length, message, _ := strings.Cut(line, " ")
+	if !strings.HasPrefix(message, "<84>1 ") || length == "" {
+		t.Errorf("Unexpected framing %q", line)
+	}
+}
@@ -0,0 +1,214 @@
+package guac
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// auditRecorder is an Auditor which keeps the events.
+type auditRecorder struct {
+	mu     sync.Mutex
+	events []AuditEvent
+}
+
+func (a *auditRecorder) Audit(event AuditEvent) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.events = append(a.events, event)
+	return nil
+}
+
+// wait returns the events once there are n of them.
+func (a *auditRecorder) wait(t *testing.T, n int) []AuditEvent {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		a.mu.Lock()
+		events := append([]AuditEvent(nil), a.events...)
+		a.mu.Unlock()
+		if len(events) >= n {
+			return events
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d audit events, got %+v", n, events)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func checkAuditTypes(t *testing.T, events []AuditEvent, types ...AuditEventType) {
+	t.Helper()
+	if len(events) != len(types) {
+		t.Fatalf("Unexpected audit events %+v, want %v", events, types)
+	}
+	for i, event := range events {
+		if event.Type != types[i] {
+			t.Errorf("Unexpected audit event %d %+v, want %s", i, event, types[i])
+		}
+		if event.Time.IsZero() {
+			t.Errorf("Audit event %d has no time", i)
+		}
+	}
+}
+
+func TestServer_Audit(t *testing.T) {
+	guacd, client := net.Pipe()
+	s := NewServer(func(r *http.Request) (Tunnel, error) {
+		stream := NewStream(client, time.Minute)
+		stream.Protocol = "ssh"
+		return NewSimpleTunnel(stream), nil
+	})
+	defer s.tunnels.Shutdown()
+	auditor := &auditRecorder{}
+	s.Auditor = auditor
+	s.User = func(r *http.Request) string { return "alice" }
+
+	rec := serve(s, http.MethodPost, "connect", "", "")
+	uuid, token := rec.Body.String(), rec.Header().Get(TunnelTokenHeader)
+
+	// the client copies "hi" to the remote clipboard
+	go func() { _, _ = io.Copy(io.Discard, guacd) }()
+	serve(s, http.MethodPost, "write:"+uuid, token, "9.clipboard,1.0,10.text/plain;4.blob,1.0,4.aGk=;3.end,1.0;")
+
+	// a request with another tunnel's token is refused
+	serve(s, http.MethodPost, "write:"+uuid, strings.Repeat("0", 64), "3.nop;")
+
+	// the remote sends a file, then goes away
+	go func() {
+		_, _ = guacd.Write([]byte("4.file,1.1,10.text/plain,5.a.txt;4.blob,1.1,8.aGVsbG8=;3.end,1.1;"))
+		_ = guacd.Close()
+	}()
+	serve(s, http.MethodGet, "read:"+uuid+":0", token, "")
+
+	events := auditor.wait(t, 5)
+	checkAuditTypes(t, events, AuditSessionStart, AuditClipboard, AuditAuthFailed, AuditFileDownload, AuditSessionEnd)
+	for _, event := range events {
+		if event.TunnelUUID != uuid || event.User != "alice" || event.Transport != transportHTTP {
+			t.Errorf("Audit event missing session fields: %+v", event)
+		}
+	}
+	if got := events[1]; got.Direction != directionToGuacd || got.Mimetype != "text/plain" || got.Bytes != 2 {
+		t.Errorf("Unexpected clipboard event %+v", got)
+	}
+	if got := events[3]; got.Direction != directionToClient || got.Filename != "a.txt" || got.Bytes != 5 || got.Status != "" {
+		t.Errorf("Unexpected download event %+v", got)
+	}
+	if got := events[4]; got.Reason != "closed" || got.Bytes == 0 {
+		t.Errorf("Unexpected session end event %+v", got)
+	}
+}
+
+func TestServer_Audit_ConnectError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want AuditEventType
+	}{
+		{ErrUnauthorized.NewError("Access denied."), AuditAuthFailed},
+		{ErrUpstreamUnavailable.NewError("Unable to connect to guacd."), AuditConnectFailed},
+	}
+	for _, test := range tests {
+		s := NewServer(func(r *http.Request) (Tunnel, error) {
+			return nil, test.err
+		})
+		auditor := &auditRecorder{}
+		s.Auditor = auditor
+		serve(s, http.MethodPost, "connect", "", "")
+		s.tunnels.Shutdown()
+
+		events := auditor.wait(t, 1)
+		checkAuditTypes(t, events, test.want)
+		if got := events[0]; got.Message != test.err.Error() || got.RemoteAddr == "" {
+			t.Errorf("Unexpected connect failure event %+v", got)
+		}
+	}
+}
+
+func TestWebsocketServer_Audit(t *testing.T) {
+	guacd, client := net.Pipe()
+	tunnels := make(chan Tunnel, 1)
+	server := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		tunnel := NewSimpleTunnel(NewStream(client, time.Minute))
+		tunnel.stream.Protocol = "rdp"
+		tunnels <- tunnel
+		return tunnel, nil
+	})
+	auditor := &auditRecorder{}
+	server.Auditor = auditor
+
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ws.Close() }()
+	if _, _, err = ws.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+	tunnel := <-tunnels
+
+	// the client starts an upload, which guacd refuses
+	received := make(chan struct{})
+	go func() {
+		buf := make([]byte, 64)
+		_, _ = guacd.Read(buf)
+		close(received)
+	}()
+	if err = ws.WriteMessage(websocket.TextMessage, []byte("4.file,1.0,24.application/octet-stream,5.b.bin;")); err != nil {
+		t.Fatal(err)
+	}
+	<-received
+	if _, err = guacd.Write([]byte("3.ack,1.0,7.Denied.,3.771;")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = ws.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = tunnel.(TunnelCloser).CloseWithReason(CloseReason{Cause: DisconnectKilled, Status: SessionClosed, Message: "Killed by admin."})
+
+	events := auditor.wait(t, 4)
+	checkAuditTypes(t, events, AuditSessionStart, AuditFileUpload, AuditKill, AuditSessionEnd)
+	if got := events[0]; got.Protocol != "rdp" || got.Transport != transportWebsocket {
+		t.Errorf("Unexpected session start event %+v", got)
+	}
+	if got := events[1]; got.Filename != "b.bin" || got.Status != ClientForbidden.String() || got.Message != "Denied." {
+		t.Errorf("Unexpected upload event %+v", got)
+	}
+	if got := events[3]; got.Reason != "killed" || got.Status != SessionClosed.String() || got.Message != "Killed by admin." {
+		t.Errorf("Unexpected session end event %+v", got)
+	}
+}
+
+func TestSessionAuditor_Join(t *testing.T) {
+	auditor := &auditRecorder{}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	a := newSessionAuditor(auditor, slog.Default(), transportWebsocket, r, "", &fakeTunnel{})
+
+	// transfers still in progress when the session ends are recorded too
+	a.start()
+	a.observe(directionToClient, []byte("9.clipboard,1.0,10.text/plain;"))
+	a.end(&fakeTunnel{}, CloseReason{})
+
+	events := auditor.wait(t, 3)
+	checkAuditTypes(t, events, AuditJoin, AuditClipboard, AuditSessionEnd)
+	if events[1].Message == "" {
+		t.Error("Expected the incomplete transfer to say so")
+	}
+}
+
+func TestDecodedLen(t *testing.T) {
+	for data, want := range map[string]int64{"": 0, "aGk=": 2, "aGVsbG8=": 5, "aGVsbG8h": 6, "aA==": 1} {
+		if got := decodedLen([]byte(data)); got != want {
+			t.Errorf("decodedLen(%q) = %d, want %d", data, got, want)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package guac
+
+import (
+	"bytes"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultBatchSize caps frame-aligned batches when OutputBatching.MaxSize is zero
+	DefaultBatchSize = MaxGuacMessage * 8
+	// DefaultBatchDelay caps how long frame-aligned output is held when OutputBatching.MaxDelay is zero
+	DefaultBatchDelay = 10 * time.Millisecond
+)
+
+// syncOpcodeIns prefixes sync instructions, which guacd sends at the end of each frame
+var syncOpcodeIns = []byte("4.sync,")
+
+// OutputBatching configures how guacd output is grouped into WebSocket messages or HTTP chunks.
+//
+// By default output is sent whenever nothing more is buffered from guacd or MaxGuacMessage bytes accumulate,
+// which often splits frames across many small messages. With FrameAligned set, output is held until guacd
+// ends a frame with a sync instruction, MaxSize bytes accumulate or MaxDelay passes since the first held
+// instruction, whichever comes first.
+type OutputBatching struct {
+	// FrameAligned aligns batches to frames.
+	FrameAligned bool
+	// MaxSize is the size at which a frame-aligned batch is sent, DefaultBatchSize if zero.
+	MaxSize int
+	// MaxDelay is the longest a frame-aligned batch is held, DefaultBatchDelay if zero.
+	MaxDelay time.Duration
+}
+
+// batcher accumulates complete instructions and passes them to send in batches. Batches held for MaxDelay are
+// sent from a timer, so send is always called with the batcher's lock held.
+type batcher struct {
+	config OutputBatching
+	send   func([]byte) error
+
+	mu    sync.Mutex
+	bufp  *[]byte
+	timer *time.Timer
+	gen   int
+	err   error
+}
+
+func newBatcher(config OutputBatching, send func([]byte) error) *batcher {
+	if config.MaxSize <= 0 {
+		if config.FrameAligned {
+			config.MaxSize = DefaultBatchSize
+		} else {
+			config.MaxSize = MaxGuacMessage
+		}
+	}
+	if config.MaxDelay <= 0 {
+		config.MaxDelay = DefaultBatchDelay
+	}
+	return &batcher{
+		config: config,
+		send:   send,
+	}
+}
+
+// write adds the instruction to the batch, sending the batch if it is complete. more reports whether guacd
+// has more data buffered. An error from an earlier timed send is returned by the next write.
+func (b *batcher) write(ins []byte, more bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.err != nil {
+		return b.err
+	}
+
+	// the buffer is only held while a batch is being built
+	if b.bufp == nil {
+		b.bufp = getBuffer()
+	}
+	*b.bufp = append(*b.bufp, ins...)
+
+	if len(*b.bufp) >= b.config.MaxSize {
+		return b.flushLocked()
+	}
+	if !b.config.FrameAligned {
+		if !more {
+			return b.flushLocked()
+		}
+		return nil
+	}
+	if bytes.HasPrefix(ins, syncOpcodeIns) {
+		return b.flushLocked()
+	}
+	if b.timer == nil {
+		b.gen++
+		gen := b.gen
+		b.timer = time.AfterFunc(b.config.MaxDelay, func() { b.timeout(gen) })
+	}
+	return nil
+}
+
+// flush sends whatever is batched.
+func (b *batcher) flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return b.err
+	}
+	return b.flushLocked()
+}
+
+// stop cancels any pending timed send without sending the batch.
+func (b *batcher) stop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.stopTimerLocked()
+	b.releaseLocked()
+}
+
+func (b *batcher) timeout(gen int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// the timer may have fired while a flush was stopping it
+	if b.timer == nil || b.gen != gen || b.err != nil {
+		return
+	}
+	b.timer = nil
+	b.err = b.flushLocked()
+}
+
+func (b *batcher) flushLocked() error {
+	b.stopTimerLocked()
+	if b.bufp == nil {
+		return nil
+	}
+	err := b.send(*b.bufp)
+	b.releaseLocked()
+	if err != nil {
+		b.err = err
+	}
+	return err
+}
+
+func (b *batcher) releaseLocked() {
+	if b.bufp != nil {
+		putBuffer(b.bufp)
+		b.bufp = nil
+	}
+}
+
+func (b *batcher) stopTimerLocked() {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+}
@@ -0,0 +1,211 @@
+package guac
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// guacdConn replays a session the way guacd writes it: its socket buffer is flushed when full and at the end
+// of each frame, so each Read returns at most guacdBufferSize bytes and stops after a sync.
+type guacdConn struct {
+	fakeConn
+	data []byte
+}
+
+// guacdBufferSize is the size of guacd's socket output buffer
+const guacdBufferSize = 8192
+
+func (c *guacdConn) Read(b []byte) (int, error) {
+	if len(c.data) == 0 {
+		return 0, io.EOF
+	}
+	n := len(c.data)
+	if n > guacdBufferSize {
+		n = guacdBufferSize
+	}
+	if i := bytes.Index(c.data[:n], syncOpcodeIns); i >= 0 {
+		n = i + bytes.IndexByte(c.data[i:], ';') + 1
+	}
+	n = copy(b, c.data[:n])
+	c.data = c.data[n:]
+	return n, nil
+}
+
+func readSessionFixture(tb testing.TB) []byte {
+	data, err := os.ReadFile("testdata/session.guac")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return data
+}
+
+func TestGuacdToWs_FrameAligned(t *testing.T) {
+	session := readSessionFixture(t)
+	msgWriter := &fakeMessageWriter{}
+	stream := NewStream(&guacdConn{data: session}, time.Minute)
+
+	guacdToWs(msgWriter, stream, OutputBatching{FrameAligned: true, MaxDelay: time.Minute}, slog.Default())
+
+	if got := bytes.Join(msgWriter.Messages, nil); !bytes.Equal(got, session) {
+		t.Fatal("Messages don't add up to the session")
+	}
+	// every frame is sent whole, then the nop which trails the last frame
+	frames := bytes.Count(session, syncOpcodeIns)
+	if len(msgWriter.Messages) != frames+1 {
+		t.Errorf("Expected %d messages, got %d", frames+1, len(msgWriter.Messages))
+	}
+	for i, msg := range msgWriter.Messages[:frames] {
+		if last := bytes.LastIndex(msg, syncOpcodeIns); last < 0 || bytes.IndexByte(msg[last:], ';') != len(msg[last:])-1 {
+			t.Fatalf("Message %d doesn't end with a sync: ...%q", i, msg[len(msg)-20:])
+		}
+	}
+}
+
+func TestBatcher_MaxSize(t *testing.T) {
+	var sent []string
+	b := newBatcher(OutputBatching{FrameAligned: true, MaxSize: 16, MaxDelay: time.Minute}, func(data []byte) error {
+		sent = append(sent, string(data))
+		return nil
+	})
+	defer b.stop()
+
+	for _, ins := range []string{"3.nop;", "3.nop;", "3.nop;", "4.sync,1.0;"} {
+		if err := b.write([]byte(ins), true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(sent) != 2 || sent[0] != "3.nop;3.nop;3.nop;" || sent[1] != "4.sync,1.0;" {
+		t.Errorf("Unexpected batches %q", sent)
+	}
+}
+
+func TestBatcher_MaxDelay(t *testing.T) {
+	var mu sync.Mutex
+	sent := make(chan string, 1)
+	b := newBatcher(OutputBatching{FrameAligned: true, MaxDelay: 10 * time.Millisecond}, func(data []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		sent <- string(data)
+		return nil
+	})
+	defer b.stop()
+
+	start := time.Now()
+	if err := b.write([]byte("3.ack,1.1,2.OK,1.0;"), false); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-sent:
+		if got != "3.ack,1.1,2.OK,1.0;" {
+			t.Errorf("Unexpected batch %q", got)
+		}
+		if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+			t.Error("Batch sent before MaxDelay, after", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Batch not sent after MaxDelay")
+	}
+}
+
+func TestServer_WriteSome_FrameAligned(t *testing.T) {
+	s := NewServer(nil)
+	defer s.tunnels.Shutdown()
+	s.Batching = OutputBatching{FrameAligned: true, MaxDelay: time.Minute}
+
+	const frames = "4.rect,1.0,1.0,1.0,2.64,2.16;4.sync,1.1;5.cfill,2.14,1.0,1.0;4.sync,1.2;"
+	stream := NewStream(&chunkedConn{data: []byte(frames), size: 7}, time.Minute)
+	rec := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+
+	_ = s.writeSome(rec, stream, &fakeTunnel{})
+
+	want := []string{"4.rect,1.0,1.0,1.0,2.64,2.16;4.sync,1.1;", "5.cfill,2.14,1.0,1.0;4.sync,1.2;"}
+	if strings.Join(rec.chunks, "|") != strings.Join(want, "|") {
+		t.Errorf("Unexpected chunks %q", rec.chunks)
+	}
+}
+
+// flushRecorder records what was written between flushes.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	pending bytes.Buffer
+	chunks  []string
+}
+
+func (f *flushRecorder) Write(b []byte) (int, error) {
+	f.pending.Write(b)
+	return f.ResponseRecorder.Write(b)
+}
+
+func (f *flushRecorder) Flush() {
+	if f.pending.Len() > 0 {
+		f.chunks = append(f.chunks, f.pending.String())
+		f.pending.Reset()
+	}
+	f.ResponseRecorder.Flush()
+}
+
+// countingMessageWriter counts messages without keeping them.
+type countingMessageWriter struct {
+	messages int
+}
+
+func (c *countingMessageWriter) WriteMessage(n int, buf []byte) error {
+	c.messages++
+	return nil
+}
+
+func benchmarkGuacdToWs(b *testing.B, batching OutputBatching) {
+	session := readSessionFixture(b)
+	b.SetBytes(int64(len(session)))
+	b.ReportAllocs()
+
+	messages := 0
+	for i := 0; i < b.N; i++ {
+		w := &countingMessageWriter{}
+		stream := NewStream(&guacdConn{data: session}, time.Minute)
+		guacdToWs(w, stream, batching, slog.Default())
+		messages += w.messages
+	}
+	b.ReportMetric(float64(messages)/float64(b.N), "msgs/op")
+}
+
+func BenchmarkGuacdToWs_Default(b *testing.B) {
+	benchmarkGuacdToWs(b, OutputBatching{})
+}
+
+func BenchmarkGuacdToWs_FrameAligned(b *testing.B) {
+	benchmarkGuacdToWs(b, OutputBatching{FrameAligned: true})
+}
+
+func benchmarkServerWriteSome(b *testing.B, batching OutputBatching) {
+	session := readSessionFixture(b)
+	s := NewServer(nil)
+	defer s.tunnels.Shutdown()
+	s.Batching = batching
+	b.SetBytes(int64(len(session)))
+	b.ReportAllocs()
+
+	chunks := 0
+	for i := 0; i < b.N; i++ {
+		rec := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+		stream := NewStream(&guacdConn{data: session}, time.Minute)
+		_ = s.writeSome(rec, stream, &fakeTunnel{})
+		chunks += len(rec.chunks)
+	}
+	b.ReportMetric(float64(chunks)/float64(b.N), "chunks/op")
+}
+
+func BenchmarkServer_WriteSome_Default(b *testing.B) {
+	benchmarkServerWriteSome(b, OutputBatching{})
+}
+
+func BenchmarkServer_WriteSome_FrameAligned(b *testing.B) {
+	benchmarkServerWriteSome(b, OutputBatching{FrameAligned: true})
+}
@@ -0,0 +1,38 @@
+package guac
+
+import "sync"
+
+const (
+	// pooledBufferSize is the capacity of new pooled buffers, enough for a typical batch of guacd output
+	pooledBufferSize = MaxGuacMessage * 2
+	// maxPooledBuffer is the largest buffer kept for reuse, so one huge instruction doesn't pin memory
+	maxPooledBuffer = 64 * 1024
+)
+
+// bufferPool holds the byte buffers shared by every Stream, batch, send queue and instruction encoding, so
+// memory follows the amount of data in flight rather than the number of sessions.
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 0, pooledBufferSize)
+		return &buf
+	},
+}
+
+// getBuffer returns an empty buffer from the pool.
+func getBuffer() *[]byte {
+	bufp := bufferPool.Get().(*[]byte)
+	*bufp = (*bufp)[:0]
+	return bufp
+}
+
+// putBuffer returns a buffer to the pool. The buffer must not be used afterwards.
+func putBuffer(bufp *[]byte) {
+	if cap(*bufp) <= maxPooledBuffer {
+		bufferPool.Put(bufp)
+	}
+}
+
+// websocketBufferPool is shared by the write buffers of every websocket connection, which only hold a buffer
+// while a message is being written. gorilla/websocket keeps its own type in the pool so it can't share
+// bufferPool.
+var websocketBufferPool = &sync.Pool{}
@@ -0,0 +1,243 @@
+package guac
+
+import (
+	"bytes"
+	"encoding/base64"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DefaultClipboardMaxSize is the largest clipboard data passed on under a ClipboardPolicy without a MaxSize,
+// the most guacd keeps.
+const DefaultClipboardMaxSize = 256 * 1024
+
+// ClipboardAction is what a ClipboardRule does with text matching its pattern.
+type ClipboardAction int
+
+const (
+	// ClipboardRedact replaces the matching text.
+	ClipboardRedact ClipboardAction = iota
+	// ClipboardBlock blocks the whole of the clipboard data.
+	ClipboardBlock
+)
+
+// ClipboardRule inspects clipboard text, for example for card numbers or secrets:
+//
+//	guac.ClipboardRule{Pattern: regexp.MustCompile(`\b(?:\d[ -]?){13,16}\b`), Action: guac.ClipboardRedact}
+type ClipboardRule struct {
+	Pattern *regexp.Regexp
+	Action  ClipboardAction
+	// Replacement replaces the text matched by a redact rule, "[REDACTED]" if empty. It may refer to
+	// submatches as in regexp.Regexp.ReplaceAll.
+	Replacement string
+}
+
+// ClipboardPolicy restricts the clipboard data passing through a tunnel, in addition to any restrictions of
+// guacd such as disable-copy. Each clipboard stream is held until it ends so the whole of the data can be
+// inspected, then passed on, possibly redacted, or blocked. The sender of blocked data is sent an ack with
+// ClientForbidden.
+type ClipboardPolicy struct {
+	// DisableCopy blocks clipboard data from the remote desktop to the client.
+	DisableCopy bool
+	// DisablePaste blocks clipboard data from the client to the remote desktop.
+	DisablePaste bool
+	// MaxSize blocks clipboard data larger than this many bytes, DefaultClipboardMaxSize if zero.
+	MaxSize int
+	// Mimetypes lists the types of data allowed, any if empty. "text/*" allows every text type.
+	Mimetypes []string
+	// Rules are applied in order to the data of text types.
+	Rules []ClipboardRule
+}
+
+// allows returns true if the policy allows data of the mimetype.
+func (p *ClipboardPolicy) allows(mimetype string) bool {
+	return mimetypeAllowed(p.Mimetypes, mimetype)
+}
+
+// inspect applies the rules to the data, returning it redacted, or the reason it is blocked.
+func (p *ClipboardPolicy) inspect(mimetype string, data []byte) ([]byte, string) {
+	if !strings.HasPrefix(mimetype, "text/") {
+		return data, ""
+	}
+	for _, rule := range p.Rules {
+		if rule.Pattern == nil || !rule.Pattern.Match(data) {
+			continue
+		}
+		if rule.Action == ClipboardBlock {
+			return nil, "Clipboard data matches a blocked pattern."
+		}
+		replacement := rule.Replacement
+		if replacement == "" {
+			replacement = "[REDACTED]"
+		}
+		data = rule.Pattern.ReplaceAll(data, []byte(replacement))
+	}
+	return data, ""
+}
+
+// clipboardFilter enforces a ClipboardPolicy on the clipboard streams of a session.
+type clipboardFilter struct {
+	policy  *ClipboardPolicy
+	logger  *slog.Logger
+	auditor *sessionAuditor
+
+	// the clipboard streams being held in each direction, each used only by its direction's goroutine
+	toClient clipboardStreams
+	toGuacd  clipboardStreams
+}
+
+type clipboardStream struct {
+	mimetype string
+	data     []byte
+	// blocked is why the stream is blocked, whose remaining instructions are dropped
+	blocked string
+}
+
+// clipboardStreams reassembles the clipboard streams in one direction of a session, by index.
+type clipboardStreams map[string]*clipboardStream
+
+// clipboardEvent is what an instruction did to the clipboard streams
+type clipboardEvent int
+
+const (
+	// clipboardNone is an instruction of no clipboard stream
+	clipboardNone clipboardEvent = iota
+	// clipboardBegin began a stream
+	clipboardBegin
+	// clipboardBlob carried data of a stream, unless the stream was already blocked
+	clipboardBlob
+	// clipboardBlocked blocked a stream, as its data was invalid or too large
+	clipboardBlocked
+	// clipboardEnd ended a stream
+	clipboardEnd
+)
+
+// track follows the clipboard streams through an instruction, returning the index and stream it belongs to
+// and what it did. Data beyond maxSize blocks a stream, keeping its data for the blocked stream to be reported.
+func (s clipboardStreams) track(opcode, args []byte, maxSize int) ([]byte, *clipboardStream, clipboardEvent) {
+	switch string(opcode) {
+	case "clipboard":
+		index, args := nextElement(args)
+		mimetype, _ := nextElement(args)
+		stream := &clipboardStream{mimetype: string(mimetype)}
+		s[string(index)] = stream
+		return index, stream, clipboardBegin
+
+	case "blob":
+		if len(s) == 0 {
+			return nil, nil, clipboardNone
+		}
+		index, args := nextElement(args)
+		stream, ok := s[string(index)]
+		if !ok {
+			return nil, nil, clipboardNone
+		}
+		if stream.blocked != "" {
+			return index, stream, clipboardBlob
+		}
+		encoded, _ := nextElement(args)
+		data := make([]byte, base64.StdEncoding.DecodedLen(len(encoded)))
+		n, err := base64.StdEncoding.Decode(data, encoded)
+		if err != nil {
+			stream.blocked = "Invalid clipboard data."
+			return index, stream, clipboardBlocked
+		}
+		stream.data = append(stream.data, data[:n]...)
+		if len(stream.data) > maxSize {
+			stream.blocked = "Clipboard data is too large."
+			return index, stream, clipboardBlocked
+		}
+		return index, stream, clipboardBlob
+
+	case "end":
+		if len(s) == 0 {
+			return nil, nil, clipboardNone
+		}
+		index, _ := nextElement(args)
+		stream, ok := s[string(index)]
+		if !ok {
+			return nil, nil, clipboardNone
+		}
+		delete(s, string(index))
+		return index, stream, clipboardEnd
+	}
+	return nil, nil, clipboardNone
+}
+
+// newClipboardFilter returns the filter enforcing the policy, or nil if there is no policy.
+func newClipboardFilter(policy *ClipboardPolicy, logger *slog.Logger, auditor *sessionAuditor) instructionFilter {
+	if policy == nil {
+		return nil
+	}
+	return &clipboardFilter{
+		policy:   policy,
+		logger:   logger,
+		auditor:  auditor,
+		toClient: make(clipboardStreams),
+		toGuacd:  make(clipboardStreams),
+	}
+}
+
+func (f *clipboardFilter) filter(direction string, ins []byte, out filterOutput) (bool, error) {
+	streams := f.toClient
+	if direction == directionToGuacd {
+		streams = f.toGuacd
+	}
+
+	opcode, args := nextElement(ins)
+	index, stream, event := streams.track(opcode, args, f.maxSize())
+	switch event {
+	case clipboardBegin:
+		switch {
+		case direction == directionToClient && f.policy.DisableCopy:
+			return false, f.block(direction, index, stream, out, "Copying from the remote desktop is disabled.")
+		case direction == directionToGuacd && f.policy.DisablePaste:
+			return false, f.block(direction, index, stream, out, "Pasting to the remote desktop is disabled.")
+		case !f.policy.allows(stream.mimetype):
+			return false, f.block(direction, index, stream, out, "Clipboard data of this type is not allowed.")
+		}
+		return false, nil
+
+	case clipboardBlob:
+		return false, nil
+
+	case clipboardBlocked:
+		return false, f.block(direction, index, stream, out, stream.blocked)
+
+	case clipboardEnd:
+		if stream.blocked != "" {
+			return false, nil
+		}
+		data, blocked := f.policy.inspect(stream.mimetype, stream.data)
+		if blocked != "" {
+			return false, f.block(direction, index, stream, out, blocked)
+		}
+		if !bytes.Equal(data, stream.data) {
+			f.logger.Info("Clipboard data redacted", "direction", direction, "mimetype", stream.mimetype)
+		}
+		return false, forwardStream(out, NewInstruction("clipboard", string(index), stream.mimetype), index, data)
+	}
+	return true, nil
+}
+
+func (f *clipboardFilter) maxSize() int {
+	if f.policy.MaxSize > 0 {
+		return f.policy.MaxSize
+	}
+	return DefaultClipboardMaxSize
+}
+
+// block drops the rest of the stream and tells its sender it is forbidden.
+func (f *clipboardFilter) block(direction string, index []byte, stream *clipboardStream, out filterOutput, reason string) error {
+	f.logger.Info("Clipboard data blocked", "direction", direction, "mimetype", stream.mimetype, "reason", reason)
+	if direction == directionToGuacd {
+		// guacd never sees the stream, so the auditor can't
+		f.auditor.clipboardBlocked(stream.mimetype, int64(len(stream.data)), reason)
+	}
+	stream.blocked = reason
+	stream.data = nil
+	code := strconv.Itoa(ClientForbidden.GetGuacamoleStatusCode())
+	return out.reply(NewInstruction("ack", string(index), reason, code).Byte())
+}
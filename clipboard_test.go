@@ -0,0 +1,254 @@
+package guac
+
+import (
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// guacdRecorder keeps what the tunnel writes to the guacd end of a pipe.
+type guacdRecorder struct {
+	mu       sync.Mutex
+	received strings.Builder
+}
+
+func recordGuacd(guacd net.Conn) *guacdRecorder {
+	r := &guacdRecorder{}
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := guacd.Read(buf)
+			r.mu.Lock()
+			r.received.Write(buf[:n])
+			r.mu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return r
+}
+
+// wait returns everything received once it contains want.
+func (r *guacdRecorder) wait(t *testing.T, want string) string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r.mu.Lock()
+		got := r.received.String()
+		r.mu.Unlock()
+		if strings.Contains(got, want) {
+			return got
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected guacd to receive %q, got %q", want, got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// clipboardInstructions returns a clipboard stream of the text.
+func clipboardInstructions(index, mimetype, text string) string {
+	return NewInstruction("clipboard", index, mimetype).String() +
+		NewInstruction("blob", index, base64Of(text)).String() +
+		NewInstruction("end", index).String()
+}
+
+func base64Of(text string) string {
+	return base64.StdEncoding.EncodeToString([]byte(text))
+}
+
+func forbiddenAck(index, message string) string {
+	return NewInstruction("ack", index, message, "771").String()
+}
+
+var testClipboardRules = []ClipboardRule{
+	{Pattern: regexp.MustCompile(`(?i)password`), Action: ClipboardBlock},
+	{Pattern: regexp.MustCompile(`\d{4}-\d{4}-\d{4}-\d{4}`), Action: ClipboardRedact},
+}
+
+func TestClipboardPolicy_Allows(t *testing.T) {
+	p := &ClipboardPolicy{Mimetypes: []string{"text/*", "image/png"}}
+	for mimetype, want := range map[string]bool{
+		"text/plain":               true,
+		"text/html; charset=utf-8": true,
+		"image/png":                true,
+		"image/jpeg":               false,
+		"application/octet-stream": false,
+		"textual/plain":            false,
+	} {
+		if got := p.allows(mimetype); got != want {
+			t.Errorf("allows(%q) = %v, want %v", mimetype, got, want)
+		}
+	}
+	if !(&ClipboardPolicy{}).allows("image/jpeg") {
+		t.Error("Expected a policy without mimetypes to allow any")
+	}
+}
+
+func TestClipboardPolicy_Inspect(t *testing.T) {
+	p := &ClipboardPolicy{Rules: append(testClipboardRules,
+		ClipboardRule{Pattern: regexp.MustCompile(`key=(\w+)`), Replacement: "key=***"},
+	)}
+	tests := []struct {
+		mimetype, data, want, blocked string
+	}{
+		{"text/plain", "hello", "hello", ""},
+		{"text/plain", "card 1234-5678-9012-3456, key=abc", "card [REDACTED], key=***", ""},
+		{"text/plain", "my Password is 1234-5678-9012-3456", "", "Clipboard data matches a blocked pattern."},
+		{"image/png", "password", "password", ""},
+	}
+	for _, test := range tests {
+		got, blocked := p.inspect(test.mimetype, []byte(test.data))
+		if string(got) != test.want || blocked != test.blocked {
+			t.Errorf("inspect(%q) = %q, %q, want %q, %q", test.data, got, blocked, test.want, test.blocked)
+		}
+	}
+}
+
+func TestClipboardStreams_Track(t *testing.T) {
+	streams := make(clipboardStreams)
+	track := func(ins string) (string, *clipboardStream, clipboardEvent) {
+		opcode, args := nextElement([]byte(ins))
+		index, stream, event := streams.track(opcode, args, 8)
+		return string(index), stream, event
+	}
+
+	if _, _, event := track(NewInstruction("blob", "1", base64Of("early")).String()); event != clipboardNone {
+		t.Error("Expected a blob of no stream to be ignored, got", event)
+	}
+	if index, _, event := track(NewInstruction("clipboard", "1", "text/plain").String()); index != "1" || event != clipboardBegin {
+		t.Error("Unexpected begin", index, event)
+	}
+	track(NewInstruction("clipboard", "2", "text/plain").String())
+	if _, _, event := track(NewInstruction("blob", "1", base64Of("abc")).String()); event != clipboardBlob {
+		t.Error("Unexpected blob", event)
+	}
+	if _, _, event := track(NewInstruction("blob", "2", "!!!!").String()); event != clipboardBlocked {
+		t.Error("Expected invalid data to block the stream, got", event)
+	}
+	if _, _, event := track(NewInstruction("blob", "1", base64Of("defghi")).String()); event != clipboardBlocked {
+		t.Error("Expected data beyond the maximum size to block the stream, got", event)
+	}
+	if _, stream, event := track(NewInstruction("blob", "1", base64Of("j")).String()); event != clipboardBlob ||
+		stream.blocked != "Clipboard data is too large." {
+		t.Error("Expected the stream to stay blocked", event, stream.blocked)
+	}
+
+	_, stream, event := track(NewInstruction("end", "2").String())
+	if event != clipboardEnd || stream.blocked != "Invalid clipboard data." {
+		t.Error("Unexpected end", event, stream.blocked)
+	}
+	if _, ok := streams["2"]; ok {
+		t.Error("Expected the ended stream to be forgotten")
+	}
+}
+
+func TestServer_ClipboardPolicy(t *testing.T) {
+	s, guacd := newPipeServer(t)
+	s.ClipboardPolicy = func(r *http.Request) *ClipboardPolicy {
+		return &ClipboardPolicy{DisableCopy: true, Rules: testClipboardRules}
+	}
+	auditor := &auditRecorder{}
+	s.Auditor = auditor
+	received := recordGuacd(guacd)
+
+	rec := serve(s, http.MethodPost, "connect", "", "")
+	uuid, token := rec.Body.String(), rec.Header().Get(TunnelTokenHeader)
+
+	// a paste containing a password is refused, one containing a card number is redacted
+	serve(s, http.MethodPost, "write:"+uuid, token,
+		clipboardInstructions("0", "text/plain", "password: hunter2")+
+			clipboardInstructions("1", "text/plain", "card 1234-5678-9012-3456")+
+			"3.nop;")
+	want := clipboardInstructions("1", "text/plain", "card [REDACTED]") + "3.nop;"
+	if got := received.wait(t, "3.nop;"); got != want {
+		t.Errorf("Unexpected instructions written to guacd %q, want %q", got, want)
+	}
+
+	// copying is disabled, so guacd is told its clipboard stream was refused
+	read := make(chan string)
+	go func() { read <- serve(s, http.MethodGet, "read:"+uuid+":0", token, "").Body.String() }()
+	if _, err := guacd.Write([]byte(clipboardInstructions("2", "text/plain", "copied") + "4.sync,1.0;")); err != nil {
+		t.Fatal(err)
+	}
+	received.wait(t, forbiddenAck("2", "Copying from the remote desktop is disabled."))
+	_ = guacd.Close()
+
+	// the client is told about its refused paste ahead of what guacd sends next
+	body := <-read
+	if want := forbiddenAck("0", "Clipboard data matches a blocked pattern.") + "4.sync,1.0;"; !strings.HasPrefix(body, want) {
+		t.Errorf("Unexpected instructions read %q, want prefix %q", body, want)
+	}
+
+	events := auditor.wait(t, 4)
+	checkAuditTypes(t, events[:4], AuditJoin, AuditClipboard, AuditClipboard, AuditClipboard)
+	if got := events[1]; got.Direction != directionToGuacd || got.Status != ClientForbidden.String() || got.Bytes != 17 {
+		t.Errorf("Unexpected blocked paste event %+v", got)
+	}
+	if got := events[2]; got.Direction != directionToGuacd || got.Status != "" || got.Bytes != 15 {
+		t.Errorf("Unexpected redacted paste event %+v", got)
+	}
+	if got := events[3]; got.Direction != directionToClient || got.Status != ClientForbidden.String() {
+		t.Errorf("Unexpected blocked copy event %+v", got)
+	}
+}
+
+func TestWebsocketServer_ClipboardPolicy(t *testing.T) {
+	guacd, client := net.Pipe()
+	server := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		return NewSimpleTunnel(NewStream(client, time.Minute)), nil
+	})
+	server.ClipboardPolicy = func(r *http.Request) *ClipboardPolicy {
+		return &ClipboardPolicy{MaxSize: 8, Mimetypes: []string{"text/plain"}}
+	}
+	received := recordGuacd(guacd)
+
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ws.Close() }()
+	if _, _, err = ws.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+
+	// an image and too much text are refused, a little text passes
+	paste := clipboardInstructions("0", "image/png", "png") +
+		clipboardInstructions("1", "text/plain", "far too long") +
+		clipboardInstructions("2", "text/plain", "short") + "3.nop;"
+	if err = ws.WriteMessage(websocket.TextMessage, []byte(paste)); err != nil {
+		t.Fatal(err)
+	}
+	want := clipboardInstructions("2", "text/plain", "short") + "3.nop;"
+	if got := received.wait(t, "3.nop;"); got != want {
+		t.Errorf("Unexpected instructions written to guacd %q, want %q", got, want)
+	}
+
+	if _, err = guacd.Write([]byte("4.sync,1.0;")); err != nil {
+		t.Fatal(err)
+	}
+	var got string
+	want = forbiddenAck("0", "Clipboard data of this type is not allowed.") +
+		forbiddenAck("1", "Clipboard data is too large.") + "4.sync,1.0;"
+	for len(got) < len(want) {
+		_, message, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got += string(message)
+	}
+	if got != want {
+		t.Errorf("Unexpected instructions read %q, want %q", got, want)
+	}
+}
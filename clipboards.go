@@ -0,0 +1,220 @@
+package guac
+
+import (
+	"encoding/base64"
+	"log/slog"
+	"strconv"
+	"sync"
+)
+
+// maxStreams is the number of streams guacd allows each user to have open, numbered from 0
+const maxStreams = 64
+
+// clientStreamOpcodes begin the streams a client sends to guacd, mapped to the position of the stream index
+// among their arguments
+var clientStreamOpcodes = map[string]int{
+	"argv":      0,
+	"audio":     0,
+	"clipboard": 0,
+	"file":      0,
+	"pipe":      0,
+	"put":       1,
+}
+
+// Clipboards gives programs access to the clipboards of live sessions, e.g. to paste a one-time password into
+// the remote desktop, or to read what was last copied there. Set it as the Clipboards of a Server or
+// WebsocketServer to track their tunnels.
+type Clipboards struct {
+	tunnels tunnelRegistry[*Clipboard]
+}
+
+// NewClipboards constructor
+func NewClipboards() *Clipboards {
+	return &Clipboards{}
+}
+
+// Get returns the clipboard of the live tunnel with the UUID.
+func (c *Clipboards) Get(tunnelUUID string) (*Clipboard, bool) {
+	return c.tunnels.get(tunnelUUID)
+}
+
+// register adds a tunnel's clipboard to the filter of the tunnel, creating the filter if the tunnel has none,
+// and tracks it until the session ends.
+func (c *Clipboards) register(tunnelUUID string, filter *tunnelFilter, logger *slog.Logger) *tunnelFilter {
+	if c == nil {
+		return filter
+	}
+	return c.tunnels.add(tunnelUUID, filter, func(session *tunnelFilter) *Clipboard {
+		return &Clipboard{
+			clipboards:    c,
+			session:       session,
+			logger:        logger,
+			tunnelUUID:    tunnelUUID,
+			receiving:     make(clipboardStreams),
+			clientStreams: make(map[string]bool),
+			injected:      make(map[string]chan streamEvent),
+		}
+	})
+}
+
+// Clipboard is the clipboard of a live session. It keeps the last clipboard data guacd sent the client, and
+// sends guacd clipboard data on streams of its own alongside the client's, which the client never sees.
+type Clipboard struct {
+	clipboards *Clipboards
+	// session is the filter of the tunnel, which sends to guacd
+	session    *tunnelFilter
+	logger     *slog.Logger
+	tunnelUUID string
+
+	mu sync.Mutex
+	// the last clipboard data from guacd
+	mimetype string
+	data     []byte
+	// the clipboard streams being received from guacd by index
+	receiving clipboardStreams
+	// the indexes of the streams the client has open
+	clientStreams map[string]bool
+	// the streams sent by Set by index, whose acks the client mustn't see, with where to send guacd's refusals
+	// while Set is sending them
+	injected map[string]chan streamEvent
+	ended    bool
+}
+
+// Get returns the last clipboard data the remote desktop sent, if it has sent any which a ClipboardPolicy
+// allowed the client to see. Data larger than DefaultClipboardMaxSize isn't kept.
+func (c *Clipboard) Get() (mimetype string, data []byte, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.data == nil {
+		return "", nil, false
+	}
+	return c.mimetype, append([]byte(nil), c.data...), true
+}
+
+// Set sends the data to the remote desktop's clipboard, as if the client had pasted it. The stream carrying it
+// uses the highest index the client isn't using, as the JavaScript client uses the lowest. Set returns an
+// error if guacd refuses the data before it is sent; as guacd only acks clipboard data to refuse it, a later
+// refusal is logged. The data isn't subject to any ClipboardPolicy.
+func (c *Clipboard) Set(mimetype string, data []byte) error {
+	index, refused, err := c.allocate()
+	if err != nil {
+		return err
+	}
+	defer c.release(index)
+
+	send := func(ins *Instruction) error {
+		select {
+		case event := <-refused:
+			return errKindFromStatus(event.status).NewError(event.message)
+		default:
+		}
+		return c.session.sendToGuacd(ins.Byte())
+	}
+	if err = send(NewInstruction("clipboard", index, mimetype)); err != nil {
+		return err
+	}
+	for len(data) > 0 {
+		n := len(data)
+		if n > blobSize {
+			n = blobSize
+		}
+		if err = send(NewInstruction("blob", index, base64.StdEncoding.EncodeToString(data[:n]))); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return send(NewInstruction("end", index))
+}
+
+// allocate reserves the highest stream index the client isn't using.
+func (c *Clipboard) allocate() (string, chan streamEvent, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ended {
+		return "", nil, ErrSessionClosed.NewError("Session has ended.")
+	}
+	for i := maxStreams - 1; i >= 0; i-- {
+		index := strconv.Itoa(i)
+		if c.injected[index] != nil || c.clientStreams[index] {
+			continue
+		}
+		refused := make(chan streamEvent, 1)
+		c.injected[index] = refused
+		return index, refused, nil
+	}
+	return "", nil, ErrClientTooMany.NewError("No stream is free.")
+}
+
+// release frees the index for another Set, still keeping the client from seeing guacd refuse it later.
+func (c *Clipboard) release(index string) {
+	c.mu.Lock()
+	c.injected[index] = nil
+	c.mu.Unlock()
+}
+
+func (c *Clipboard) filter(direction string, ins []byte, _ filterOutput) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	opcode, args := nextElement(ins)
+	if direction == directionToGuacd {
+		if position, ok := clientStreamOpcodes[string(opcode)]; ok {
+			for ; position > 0; position-- {
+				_, args = nextElement(args)
+			}
+			index, _ := nextElement(args)
+			c.clientStreams[string(index)] = true
+			// guacd's acks for the index are the client's from now on
+			delete(c.injected, string(index))
+		} else if string(opcode) == "end" {
+			index, _ := nextElement(args)
+			delete(c.clientStreams, string(index))
+		}
+		return true, nil
+	}
+
+	if string(opcode) == "ack" {
+		index, args := nextElement(args)
+		message, status := parseAck(args)
+		if refused, ok := c.injected[string(index)]; ok {
+			if status != Success {
+				c.logger.Warn("Clipboard data refused", "status", status.String(), "message", message)
+				select {
+				case refused <- streamEvent{status: status, message: message}:
+				default:
+				}
+			}
+			return false, nil
+		}
+		if status != Success {
+			// guacd has closed the client's stream
+			delete(c.clientStreams, string(index))
+		}
+		return true, nil
+	}
+
+	_, stream, event := c.receiving.track(opcode, args, DefaultClipboardMaxSize)
+	switch event {
+	case clipboardBlocked:
+		stream.data = nil
+	case clipboardEnd:
+		if stream.blocked != "" {
+			c.logger.Debug("Clipboard data not kept", "reason", stream.blocked)
+			return true, nil
+		}
+		c.mimetype = stream.mimetype
+		c.data = stream.data
+		if c.data == nil {
+			c.data = []byte{}
+		}
+	}
+	return true, nil
+}
+
+// end stops tracking the clipboard.
+func (c *Clipboard) end() {
+	c.clipboards.tunnels.remove(c.tunnelUUID, c)
+	c.mu.Lock()
+	c.ended = true
+	c.mu.Unlock()
+}
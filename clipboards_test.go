@@ -0,0 +1,159 @@
+package guac
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestServer_Clipboards(t *testing.T) {
+	s, guacd := newPipeServer(t)
+	clipboards := NewClipboards()
+	s.Clipboards = clipboards
+	received := recordGuacd(guacd)
+
+	rec := serve(s, http.MethodPost, "connect", "", "")
+	uuid, token := rec.Body.String(), rec.Header().Get(TunnelTokenHeader)
+	clipboard, ok := clipboards.Get(uuid)
+	if !ok {
+		t.Fatal("Expected the tunnel's clipboard")
+	}
+	if _, _, ok = clipboard.Get(); ok {
+		t.Error("Expected no clipboard data before guacd sends any")
+	}
+
+	// the client is pasting on the highest index, so the clipboard pastes on the next
+	pasting := NewInstruction("clipboard", "63", "text/plain").String()
+	serve(s, http.MethodPost, "write:"+uuid, token, pasting)
+	received.wait(t, pasting)
+	if err := clipboard.Set("text/plain", []byte("otp 123456")); err != nil {
+		t.Fatal(err)
+	}
+	received.wait(t, pasting+clipboardInstructions("62", "text/plain", "otp 123456"))
+
+	// guacd refusing the clipboard's stream is kept from the client, which sees the rest
+	read := make(chan string)
+	go func() { read <- serve(s, http.MethodGet, "read:"+uuid+":0", token, "").Body.String() }()
+	clientAck := NewInstruction("ack", "63", "OK", "0").String()
+	copied := clipboardInstructions("1", "text/plain", "copied")
+	if _, err := guacd.Write([]byte(forbiddenAck("62", "Unsupported.") + clientAck + copied + "4.sync,1.0;")); err != nil {
+		t.Fatal(err)
+	}
+	// which the tunnel has passed on once it reads more
+	if _, err := guacd.Write([]byte("4.sync,1.1;")); err != nil {
+		t.Fatal(err)
+	}
+	_ = guacd.Close()
+	if body, want := <-read, clientAck+copied+"4.sync,1.0;4.sync,1.1;"; !strings.HasPrefix(body, want) {
+		t.Errorf("Unexpected instructions read %q, want prefix %q", body, want)
+	}
+	if mimetype, data, ok := clipboard.Get(); !ok || mimetype != "text/plain" || string(data) != "copied" {
+		t.Errorf("Unexpected clipboard %q %q %v", mimetype, data, ok)
+	}
+
+	// the clipboard is gone with its session
+	if _, ok = clipboards.Get(uuid); ok {
+		t.Error("Expected no clipboard once the session ended")
+	}
+	if err := clipboard.Set("text/plain", []byte("late")); !errors.Is(err, ErrSessionClosed) {
+		t.Error("Expected the session to be closed, got", err)
+	}
+}
+
+func TestWebsocketServer_Clipboards(t *testing.T) {
+	guacd, client := net.Pipe()
+	clipboards := NewClipboards()
+	tunnels := make(chan Tunnel, 1)
+	server := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		tunnel := NewSimpleTunnel(NewStream(client, time.Minute))
+		tunnels <- tunnel
+		return tunnel, nil
+	})
+	server.Clipboards = clipboards
+	server.ClipboardPolicy = func(r *http.Request) *ClipboardPolicy {
+		return &ClipboardPolicy{Rules: testClipboardRules}
+	}
+	received := recordGuacd(guacd)
+
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ws.Close() }()
+	if _, _, err = ws.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+	clipboard, ok := clipboards.Get((<-tunnels).GetUUID())
+	if !ok {
+		t.Fatal("Expected the tunnel's clipboard")
+	}
+
+	// data larger than a blob is sent in several, alongside what the client sends
+	data := bytes.Repeat([]byte("0123456789"), 700)
+	if err = clipboard.Set("text/plain", data); err != nil {
+		t.Fatal(err)
+	}
+	if err = ws.WriteMessage(websocket.TextMessage, []byte("3.nop;")); err != nil {
+		t.Fatal(err)
+	}
+	want := NewInstruction("clipboard", "63", "text/plain").String() +
+		NewInstruction("blob", "63", base64Of(string(data[:blobSize]))).String() +
+		NewInstruction("blob", "63", base64Of(string(data[blobSize:]))).String() +
+		NewInstruction("end", "63").String()
+	if got := received.wait(t, "3.nop;"); got != want+"3.nop;" {
+		t.Errorf("Unexpected instructions written to guacd %q, want %q", got, want+"3.nop;")
+	}
+
+	// what guacd copies is kept as the client sees it
+	copied := clipboardInstructions("1", "text/plain", "card 1234-5678-9012-3456")
+	if _, err = guacd.Write([]byte(copied + "4.sync,1.0;")); err != nil {
+		t.Fatal(err)
+	}
+	readWebsocket(t, ws, len("4.sync,1.0;"))
+	if mimetype, got, ok := clipboard.Get(); !ok || mimetype != "text/plain" || string(got) != "card [REDACTED]" {
+		t.Errorf("Unexpected clipboard %q %q %v", mimetype, got, ok)
+	}
+}
+
+func TestClipboard_SetRefused(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	filter := NewClipboards().register("tunnel", nil, logger)
+	clipboard := filter.filters[0].(*Clipboard)
+
+	// guacd refuses the stream as soon as it begins
+	var sent []string
+	filter.setInject(func(ins []byte) error {
+		sent = append(sent, string(ins))
+		if len(sent) == 1 {
+			pass, err := filter.apply(directionToClient, []byte(forbiddenAck("63", "Unsupported.")), nil)
+			if pass || err != nil {
+				t.Errorf("Expected the refusal to be consumed, got %v %v", pass, err)
+			}
+		}
+		return nil
+	})
+	err := clipboard.Set("text/plain", []byte("refused"))
+	if !errors.Is(err, ErrSecurity) {
+		t.Error("Expected the refusal, got", err)
+	}
+	if len(sent) != 1 {
+		t.Errorf("Unexpected instructions sent after the refusal %q", sent)
+	}
+
+	// which frees the index for the next
+	filter.setInject(func(ins []byte) error { return nil })
+	if err = clipboard.Set("text/plain", []byte("accepted")); err != nil {
+		t.Error(err)
+	}
+}
@@ -4,13 +4,12 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"io"
-	"net"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
 	"strconv"
 
-	"github.com/sirupsen/logrus"
 	"github.com/wwt/guac"
 )
 
@@ -21,7 +20,13 @@ var (
 )
 
 func main() {
-	logrus.SetLevel(logrus.DebugLevel)
+	logLevel := slog.LevelDebug
+	if os.Getenv("LOG_LEVEL") != "" {
+		if err := logLevel.UnmarshalText([]byte(os.Getenv("LOG_LEVEL"))); err != nil {
+			fatal("Invalid LOG_LEVEL", "error", err)
+		}
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})))
 
 	if os.Getenv("CERT_PATH") != "" {
 		certPath = os.Getenv("CERT_PATH")
@@ -32,11 +37,11 @@ func main() {
 	}
 
 	if certPath != "" && certKeyPath == "" {
-		logrus.Fatal("You must set the CERT_KEY_PATH environment variable to specify the full path to the certificate keyfile")
+		fatal("You must set the CERT_KEY_PATH environment variable to specify the full path to the certificate keyfile")
 	}
 
 	if certPath == "" && certKeyPath != "" {
-		logrus.Fatal("You must set the CERT_PATH environment variable to specify the full path to the certificate file")
+		fatal("You must set the CERT_PATH environment variable to specify the full path to the certificate file")
 	}
 
 	if os.Getenv("GUACD_ADDRESS") != "" {
@@ -46,14 +51,51 @@ func main() {
 	servlet := guac.NewServer(DemoDoConnect)
 	wsServer := guac.NewWebsocketServer(DemoDoConnect)
 
+	var auditors guac.MultiAuditor
+	if os.Getenv("AUDIT_LOG") != "" {
+		auditor, err := guac.OpenJSONLinesAuditor(os.Getenv("AUDIT_LOG"))
+		if err != nil {
+			fatal("Unable to open AUDIT_LOG", "error", err)
+		}
+		defer auditor.Close()
+		auditors = append(auditors, auditor)
+	}
+	if os.Getenv("WEBHOOK_URL") != "" {
+		dispatcher := guac.NewWebhookDispatcher(guac.Webhook{
+			URL:    os.Getenv("WEBHOOK_URL"),
+			Secret: []byte(os.Getenv("WEBHOOK_SECRET")),
+		})
+		defer dispatcher.Close()
+		auditors = append(auditors, dispatcher)
+	}
+	if len(auditors) > 0 {
+		servlet.Auditor = auditors
+		wsServer.Auditor = auditors
+	}
+
+	if os.Getenv("DOWNLOAD_DIR") != "" {
+		policy := &guac.DownloadPolicy{Storage: guac.DirectoryDownloadStorage{Dir: os.Getenv("DOWNLOAD_DIR")}}
+		downloadPolicy := func(*http.Request) *guac.DownloadPolicy { return policy }
+		servlet.DownloadPolicy = downloadPolicy
+		wsServer.DownloadPolicy = downloadPolicy
+	}
+
+	streams := guac.NewStreamServer()
+	servlet.Streams = streams
+	wsServer.Streams = streams
+
 	sessions := guac.NewMemorySessionStore()
 	wsServer.OnConnect = sessions.Add
 	wsServer.OnDisconnect = sessions.Delete
+	servlet.OnConnect = sessions.Add
+	servlet.OnDisconnect = sessions.Delete
 
 	mux := http.NewServeMux()
 	mux.Handle("/tunnel", servlet)
 	mux.Handle("/tunnel/", servlet)
 	mux.Handle("/websocket-tunnel", wsServer)
+	mux.Handle("/tunnels/", streams)
+	mux.Handle("/metrics", guac.MetricsHandler())
 	mux.HandleFunc("/sessions/", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
@@ -76,7 +118,7 @@ func main() {
 		}
 
 		if err := json.NewEncoder(w).Encode(connIds); err != nil {
-			logrus.Error(err)
+			slog.Error("Failed to encode sessions", "error", err)
 		}
 	})
 
@@ -84,7 +126,7 @@ func main() {
 	if certPath != "" {
 		cert, err := tls.LoadX509KeyPair(certPath, certKeyPath)
 		if err != nil {
-			logrus.Fatalf("Unable to load certificate keypair: %s\n", err)
+			fatal("Unable to load certificate keypair", "error", err)
 		}
 
 		tlsCfg.MinVersion = tls.VersionTLS13
@@ -106,18 +148,18 @@ func main() {
 	}
 
 	if certPath != "" {
-		logrus.Println("Serving on https://0.0.0.0:4567")
+		slog.Info("Serving on https://0.0.0.0:4567")
 
 		err := s.ListenAndServeTLS("", "")
 		if err != nil {
-			logrus.Fatal(err)
+			fatal("Server failed", "error", err)
 		}
 	} else {
-		logrus.Println("Serving on http://0.0.0.0:4567")
+		slog.Info("Serving on http://0.0.0.0:4567")
 
 		err := s.ListenAndServe()
 		if err != nil {
-			logrus.Fatal(err)
+			fatal("Server failed", "error", err)
 		}
 	}
 }
@@ -131,17 +173,16 @@ func DemoDoConnect(request *http.Request) (guac.Tunnel, error) {
 		// http tunnel uses the body to pass parameters
 		data, err := io.ReadAll(request.Body)
 		if err != nil {
-			logrus.Error("Failed to read body ", err)
+			slog.Error("Failed to read body", "error", err)
 			return nil, err
 		}
 		_ = request.Body.Close()
 		queryString := string(data)
 		query, err = url.ParseQuery(queryString)
 		if err != nil {
-			logrus.Error("Failed to parse body query ", err)
+			slog.Error("Failed to parse body query", "error", err)
 			return nil, err
 		}
-		logrus.Debugln("body:", queryString, query)
 	} else {
 		query = request.URL.Query()
 	}
@@ -156,46 +197,41 @@ func DemoDoConnect(request *http.Request) (guac.Tunnel, error) {
 	if query.Get("width") != "" {
 		config.OptimalScreenHeight, err = strconv.Atoi(query.Get("width"))
 		if err != nil || config.OptimalScreenHeight == 0 {
-			logrus.Error("Invalid height")
+			slog.Error("Invalid height")
 			config.OptimalScreenHeight = 600
 		}
 	}
 	if query.Get("height") != "" {
 		config.OptimalScreenWidth, err = strconv.Atoi(query.Get("height"))
 		if err != nil || config.OptimalScreenWidth == 0 {
-			logrus.Error("Invalid width")
+			slog.Error("Invalid width")
 			config.OptimalScreenWidth = 800
 		}
 	}
 	config.AudioMimetypes = []string{"audio/L16", "rate=44100", "channels=2"}
 
-	logrus.Debug("Connecting to guacd")
-	addr, err := net.ResolveTCPAddr("tcp", guacdAddr)
+	slog.Debug("Connecting to guacd")
+	stream, err := guac.Dial(request.Context(), guacdAddr, guac.SocketTimeout)
 	if err != nil {
-		logrus.Errorln("error resolving guacd address", err)
+		slog.Error("Error while connecting to guacd", "error", err)
 		return nil, err
 	}
 
-	conn, err := net.DialTCP("tcp", nil, addr)
-	if err != nil {
-		logrus.Errorln("error while connecting to guacd", err)
-		return nil, err
-	}
-
-	stream := guac.NewStream(conn, guac.SocketTimeout)
-
-	logrus.Debug("Connected to guacd")
+	slog.Debug("Connected to guacd")
 	if request.URL.Query().Get("uuid") != "" {
 		config.ConnectionID = request.URL.Query().Get("uuid")
 	}
 
-	sanitisedCfg := config
-	sanitisedCfg.Parameters["password"] = "********"
-	logrus.Debugf("Starting handshake with %#v", sanitisedCfg)
-	err = stream.Handshake(config)
+	err = stream.HandshakeContext(request.Context(), config)
 	if err != nil {
 		return nil, err
 	}
-	logrus.Debug("Socket configured")
+	slog.Debug("Socket configured")
 	return guac.NewSimpleTunnel(stream), nil
 }
+
+// fatal logs the error and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
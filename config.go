@@ -1,5 +1,11 @@
 package guac
 
+import (
+	"log/slog"
+	"sort"
+	"strings"
+)
+
 // Config is the data sent to guacd to configure the session during the handshake.
 type Config struct {
 	// ConnectionID is used to reconnect to an existing session, otherwise leave blank for a new session.
@@ -35,3 +41,50 @@ func NewGuacamoleConfiguration() *Config {
 		ImageMimetypes:      make([]string, 0, 1),
 	}
 }
+
+// SensitiveParameters are the connection parameters whose values are redacted when a Config is logged.
+// Parameters whose names contain "password", "passphrase", "secret" or "token", or end in "-key" such as
+// "sftp-private-key" and "client-key", are always redacted.
+var SensitiveParameters = []string{"private-key"}
+
+// redacted replaces the values of sensitive parameters in logs
+const redacted = "********"
+
+func isSensitiveParameter(name string) bool {
+	name = strings.ToLower(name)
+	for _, part := range []string{"password", "passphrase", "secret", "token", "private-key"} {
+		if strings.Contains(name, part) {
+			return true
+		}
+	}
+	if strings.HasSuffix(name, "-key") {
+		return true
+	}
+	for _, sensitive := range SensitiveParameters {
+		if name == sensitive {
+			return true
+		}
+	}
+	return false
+}
+
+// LogValue logs the Config with the values of sensitive parameters redacted.
+func (c *Config) LogValue() slog.Value {
+	parameters := make([]slog.Attr, 0, len(c.Parameters))
+	for name, value := range c.Parameters {
+		if isSensitiveParameter(name) {
+			value = redacted
+		}
+		parameters = append(parameters, slog.String(name, value))
+	}
+	sort.Slice(parameters, func(i, j int) bool { return parameters[i].Key < parameters[j].Key })
+
+	return slog.GroupValue(
+		slog.String("connection_id", c.ConnectionID),
+		slog.String("protocol", c.Protocol),
+		slog.Attr{Key: "parameters", Value: slog.GroupValue(parameters...)},
+		slog.Int("width", c.OptimalScreenWidth),
+		slog.Int("height", c.OptimalScreenHeight),
+		slog.Int("dpi", c.OptimalResolution),
+	)
+}
@@ -3,6 +3,7 @@ package guac
 import (
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // CountedLock counts how many goroutines are waiting on the lock
@@ -14,7 +15,9 @@ type CountedLock struct {
 // Lock locks the mutex
 func (r *CountedLock) Lock() {
 	atomic.AddInt32(&r.numLocks, 1)
+	start := time.Now()
 	r.core.Lock()
+	metrics.lockWait.Observe(time.Since(start).Seconds())
 }
 
 // Unlock unlocks the mutex
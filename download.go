@@ -0,0 +1,329 @@
+package guac
+
+import (
+	"encoding/base64"
+	"io"
+	"log/slog"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DownloadStorage keeps a copy of each file downloaded through a tunnel, e.g. for audit.
+type DownloadStorage interface {
+	// Store returns a writer for the copy of the download, or nil to keep none. The writer is closed once the
+	// client has the whole file. If it never does, e.g. as the client refused it or the session ended first, the
+	// writer's CloseWithError method is called instead, if it has one.
+	Store(download Download) (io.WriteCloser, error)
+}
+
+// Download describes a file sent to the client by guacd.
+type Download struct {
+	TunnelUUID   string
+	ConnectionID string
+	// User is returned by the server's User callback for the connect request
+	User string
+	// Stream is the index of the stream carrying the file
+	Stream   string
+	Mimetype string
+	// Filename is the name of the file, or its path for files of a filesystem object such as an SFTP share
+	Filename string
+}
+
+// downloadOf returns the fields of the downloads of a session
+func downloadOf(tunnel Tunnel, user string) Download {
+	return Download{TunnelUUID: tunnel.GetUUID(), ConnectionID: tunnel.ConnectionID(), User: user}
+}
+
+// DownloadPolicy restricts the files sent to the client through a tunnel, such as those downloaded from a
+// shared drive or over SFTP. The streams of the files are intercepted in the same way as the
+// StreamInterceptingTunnel of guacamole-client, while directory listings pass untouched. A blocked file never
+// reaches the client, and guacd is sent an ack with ClientForbidden. Without MaxSize, a file blocked part way through is ended early instead.
+type DownloadPolicy struct {
+	// MaxSize blocks files larger than this many bytes, unlimited if zero. A file is held until it is complete
+	// so that the client never sees a part of one which is too large, which means the client sees no progress
+	// until then. Files are held in memory, so allow for MaxSize for each download in progress.
+	MaxSize int64
+	// Mimetypes lists the types of file allowed, any if empty. "image/*" allows every image type.
+	Mimetypes []string
+	// BlockedFilenames lists patterns of the names of files which are blocked, matched against the base name
+	// of each file with path.Match, ignoring case, e.g. "*.exe".
+	BlockedFilenames []string
+	// Storage keeps a copy of each file which isn't blocked by its name or type, if set.
+	Storage DownloadStorage
+}
+
+// check returns the reason a file is blocked by its name or type, if it is.
+func (p *DownloadPolicy) check(mimetype, filename string) string {
+	if !mimetypeAllowed(p.Mimetypes, mimetype) {
+		return "Files of this type may not be downloaded."
+	}
+	name := strings.ToLower(path.Base(filename))
+	for _, pattern := range p.BlockedFilenames {
+		if matched, _ := path.Match(strings.ToLower(pattern), name); matched {
+			return "Files with this name may not be downloaded."
+		}
+	}
+	return ""
+}
+
+// streamIndexMimetype is the type of the bodies listing a directory of a filesystem object, which aren't files
+const streamIndexMimetype = "application/vnd.glyptodon.guacamole.stream-index+json"
+
+// downloadFilter enforces a DownloadPolicy on the file streams from guacd, and mirrors them to its storage.
+type downloadFilter struct {
+	policy *DownloadPolicy
+	logger *slog.Logger
+	// base holds the fields identifying the session
+	base Download
+
+	// mu guards the streams, which both directions of the session use
+	mu sync.Mutex
+	// the downloads in progress by stream index
+	streams map[string]*downloadStream
+	// replayed counts the acks the client still owes for held files which it has since been sent, which
+	// guacd had from the filter instead
+	replayed map[string]int
+}
+
+type downloadStream struct {
+	download Download
+	// begin starts the stream, the file or body instruction
+	begin *Instruction
+	// held is true if the file is held until complete, in data
+	held bool
+	// sent is true if the client has the beginning of the stream, which it must be sent the end of
+	sent bool
+	data []byte
+	size int64
+	// storage receives the copy of the file, if any
+	storage io.WriteCloser
+	// blocked is true if the stream is blocked, whose remaining instructions are dropped
+	blocked bool
+}
+
+// newDownloadFilter returns the filter enforcing the policy, or nil if there is no policy.
+func newDownloadFilter(policy *DownloadPolicy, logger *slog.Logger, base Download) instructionFilter {
+	if policy == nil {
+		return nil
+	}
+	return &downloadFilter{
+		policy:   policy,
+		logger:   logger,
+		base:     base,
+		streams:  make(map[string]*downloadStream),
+		replayed: make(map[string]int),
+	}
+}
+
+func (f *downloadFilter) filter(direction string, ins []byte, out filterOutput) (bool, error) {
+	deferred := &deferredOutput{}
+	f.mu.Lock()
+	pass, err := f.filterLocked(direction, ins, deferred)
+	f.mu.Unlock()
+	if err == nil {
+		err = deferred.flush(out)
+	}
+	return pass, err
+}
+
+func (f *downloadFilter) filterLocked(direction string, ins []byte, out filterOutput) (bool, error) {
+	opcode, args := nextElement(ins)
+	if direction == directionToGuacd {
+		if string(opcode) == "ack" {
+			return f.ack(args), nil
+		}
+		return true, nil
+	}
+
+	switch string(opcode) {
+	case "file":
+		index, args := nextElement(args)
+		mimetype, args := nextElement(args)
+		filename, _ := nextElement(args)
+		begin := NewInstruction("file", string(index), string(mimetype), string(filename))
+		return f.begin(index, begin, string(mimetype), string(filename), out)
+
+	case "body":
+		object, args := nextElement(args)
+		index, args := nextElement(args)
+		mimetype, args := nextElement(args)
+		name, _ := nextElement(args)
+		if string(mimetype) == streamIndexMimetype {
+			// browsing the filesystem downloads nothing
+			return true, nil
+		}
+		begin := NewInstruction("body", string(object), string(index), string(mimetype), string(name))
+		return f.begin(index, begin, string(mimetype), string(name), out)
+
+	case "blob":
+		if len(f.streams) == 0 {
+			return true, nil
+		}
+		index, args := nextElement(args)
+		stream, ok := f.streams[string(index)]
+		if !ok {
+			return true, nil
+		}
+		if stream.blocked {
+			return false, nil
+		}
+		encoded, _ := nextElement(args)
+		data := make([]byte, base64.StdEncoding.DecodedLen(len(encoded)))
+		n, err := base64.StdEncoding.Decode(data, encoded)
+		if err != nil {
+			return false, f.block(index, stream, out, "Invalid file data.")
+		}
+		data = data[:n]
+		stream.size += int64(n)
+		if !stream.held {
+			f.store(stream, data)
+			return true, nil
+		}
+		if stream.size > f.policy.MaxSize {
+			return false, f.block(index, stream, out, "File is too large.")
+		}
+		f.store(stream, data)
+		stream.data = append(stream.data, data...)
+		return false, out.reply(successAck(index))
+
+	case "end":
+		if len(f.streams) == 0 {
+			return true, nil
+		}
+		index, _ := nextElement(args)
+		stream, ok := f.streams[string(index)]
+		if !ok {
+			return true, nil
+		}
+		delete(f.streams, string(index))
+		if stream.blocked {
+			return false, nil
+		}
+		if stream.storage != nil {
+			if err := stream.storage.Close(); err != nil {
+				f.logger.Error("Unable to store download", "filename", stream.download.Filename, "error", err)
+			}
+		}
+		if !stream.held {
+			return true, nil
+		}
+		// the client acks the beginning and each blob
+		f.replayed[string(index)] += 1 + (len(stream.data)+blobSize-1)/blobSize
+		return false, forwardStream(out, stream.begin, index, stream.data)
+	}
+	return true, nil
+}
+
+// begin checks a new download, holding it if there is a maximum size.
+func (f *downloadFilter) begin(index []byte, begin *Instruction, mimetype, filename string, out filterOutput) (bool, error) {
+	download := f.base
+	download.Stream = string(index)
+	download.Mimetype = mimetype
+	download.Filename = filename
+	stream := &downloadStream{download: download, begin: begin, held: f.policy.MaxSize > 0}
+	f.streams[string(index)] = stream
+
+	if reason := f.policy.check(mimetype, filename); reason != "" {
+		return false, f.block(index, stream, out, reason)
+	}
+	if f.policy.Storage != nil {
+		storage, err := f.policy.Storage.Store(download)
+		if err != nil {
+			f.logger.Error("Unable to store download", "filename", filename, "error", err)
+		} else {
+			stream.storage = storage
+		}
+	}
+	if !stream.held {
+		stream.sent = true
+		return true, nil
+	}
+	return false, out.reply(successAck(index))
+}
+
+// ack drops the acks the client owes guacd's held streams, and notices the client refusing a download. It
+// returns true to pass the ack on.
+func (f *downloadFilter) ack(args []byte) bool {
+	index, args := nextElement(args)
+	_, args = nextElement(args)
+	code, _ := nextElement(args)
+	refused := string(code) != "0"
+
+	if n, ok := f.replayed[string(index)]; ok {
+		// a client refusing a file acks nothing more of it
+		if n <= 1 || refused {
+			delete(f.replayed, string(index))
+		} else {
+			f.replayed[string(index)] = n - 1
+		}
+		return false
+	}
+	stream, ok := f.streams[string(index)]
+	if ok && !stream.held && refused {
+		delete(f.streams, string(index))
+		abortDownload(stream, "Download refused by the client.", f.logger)
+	}
+	return true
+}
+
+// store writes data to the stream's storage, giving up on storing the stream if that fails.
+func (f *downloadFilter) store(stream *downloadStream, data []byte) {
+	if stream.storage == nil {
+		return
+	}
+	if _, err := stream.storage.Write(data); err != nil {
+		f.logger.Error("Unable to store download", "filename", stream.download.Filename, "error", err)
+		abortDownload(stream, "Unable to store download.", f.logger)
+	}
+}
+
+// block drops the rest of the stream and tells guacd it is forbidden. A client which has the beginning of the
+// stream is sent its end, so its download doesn't wait for more.
+func (f *downloadFilter) block(index []byte, stream *downloadStream, out filterOutput, reason string) error {
+	f.logger.Info("Download blocked", "filename", stream.download.Filename, "mimetype", stream.download.Mimetype,
+		"reason", reason)
+	abortDownload(stream, reason, f.logger)
+	stream.blocked = true
+	stream.data = nil
+	if stream.sent {
+		if err := out.forward(NewInstruction("end", string(index)).Byte()); err != nil {
+			return err
+		}
+	}
+	code := strconv.Itoa(ClientForbidden.GetGuacamoleStatusCode())
+	return out.reply(NewInstruction("ack", string(index), reason, code).Byte())
+}
+
+// end gives up on storing the downloads still in progress.
+func (f *downloadFilter) end() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for index, stream := range f.streams {
+		abortDownload(stream, "Session ended during download.", f.logger)
+		delete(f.streams, index)
+	}
+}
+
+// abortDownload closes the storage of a download which won't complete, if it has any.
+func abortDownload(stream *downloadStream, reason string, logger *slog.Logger) {
+	if stream.storage == nil {
+		return
+	}
+	var err error
+	if aborter, ok := stream.storage.(interface{ CloseWithError(error) error }); ok {
+		err = aborter.CloseWithError(ErrResourceClosed.NewError(reason))
+	} else {
+		err = stream.storage.Close()
+	}
+	if err != nil {
+		logger.Error("Unable to store download", "filename", stream.download.Filename, "error", err)
+	}
+	stream.storage = nil
+}
+
+// successAck acknowledges the instruction of a stream on behalf of the client
+func successAck(index []byte) []byte {
+	return NewInstruction("ack", string(index), "OK", strconv.Itoa(Success.GetGuacamoleStatusCode())).Byte()
+}
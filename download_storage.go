@@ -0,0 +1,71 @@
+package guac
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// partialSuffix ends the name of a stored download until it is complete
+const partialSuffix = ".part"
+
+// DirectoryDownloadStorage is a DownloadStorage which keeps downloads as files in a directory, with a
+// subdirectory for each tunnel. Each file is named by the time the download started, its stream and its
+// original name, e.g. "20240102T030405.000Z-1-report.pdf". A download which never completes keeps the suffix
+// ".part".
+type DirectoryDownloadStorage struct {
+	Dir string
+}
+
+// Store creates the file for a copy of the download.
+func (s DirectoryDownloadStorage) Store(download Download) (io.WriteCloser, error) {
+	dir := filepath.Join(s.Dir, storedName(download.TunnelUUID))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("%s-%s-%s", time.Now().UTC().Format("20060102T150405.000Z"), storedName(download.Stream),
+		storedName(path.Base(download.Filename)))
+	name = filepath.Join(dir, name)
+	f, err := os.OpenFile(name+partialSuffix, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &storedDownload{File: f, name: name}, nil
+}
+
+// storedName returns a name safe to use within the directory
+func storedName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r < ' ' {
+			return '_'
+		}
+		return r
+	}, name)
+	if strings.Trim(name, ".") == "" {
+		return "download"
+	}
+	return name
+}
+
+// storedDownload is a download being written to a file
+type storedDownload struct {
+	*os.File
+	name string
+}
+
+// Close closes the file, removing its partial suffix.
+func (d *storedDownload) Close() error {
+	if err := d.File.Close(); err != nil {
+		return err
+	}
+	return os.Rename(d.name+partialSuffix, d.name)
+}
+
+// CloseWithError closes the file, which keeps its partial suffix.
+func (d *storedDownload) CloseWithError(error) error {
+	return d.File.Close()
+}
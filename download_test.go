@@ -0,0 +1,314 @@
+package guac
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// downloadRecorder is a DownloadStorage which keeps the downloads in memory.
+type downloadRecorder struct {
+	mu        sync.Mutex
+	downloads []*recordedDownload
+}
+
+type recordedDownload struct {
+	recorder *downloadRecorder
+	download Download
+	data     bytes.Buffer
+	closed   bool
+	err      error
+}
+
+func (r *downloadRecorder) Store(download Download) (io.WriteCloser, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d := &recordedDownload{recorder: r, download: download}
+	r.downloads = append(r.downloads, d)
+	return d, nil
+}
+
+func (d *recordedDownload) Write(p []byte) (int, error) {
+	d.recorder.mu.Lock()
+	defer d.recorder.mu.Unlock()
+	return d.data.Write(p)
+}
+
+func (d *recordedDownload) Close() error {
+	return d.CloseWithError(nil)
+}
+
+func (d *recordedDownload) CloseWithError(err error) error {
+	d.recorder.mu.Lock()
+	defer d.recorder.mu.Unlock()
+	d.closed, d.err = true, err
+	return nil
+}
+
+// wait waits for the condition to hold of the downloads.
+func (r *downloadRecorder) wait(t *testing.T, condition func(downloads []*recordedDownload) bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r.mu.Lock()
+		ok := condition(r.downloads)
+		r.mu.Unlock()
+		if ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Downloads not stored as expected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func fileInstructions(index, mimetype, filename, text string) string {
+	return NewInstruction("file", index, mimetype, filename).String() +
+		NewInstruction("blob", index, base64Of(text)).String() +
+		NewInstruction("end", index).String()
+}
+
+func TestDownloadPolicy_Check(t *testing.T) {
+	p := &DownloadPolicy{Mimetypes: []string{"text/*", "application/pdf"}, BlockedFilenames: []string{"*.key", "secret*"}}
+	tests := []struct {
+		mimetype, filename, want string
+	}{
+		{"text/plain", "notes.txt", ""},
+		{"application/pdf", "/home/alice/report.pdf", ""},
+		{"application/octet-stream", "setup.bin", "Files of this type may not be downloaded."},
+		{"text/plain", "/etc/ssl/SERVER.KEY", "Files with this name may not be downloaded."},
+		{"text/plain", "secrets.txt", "Files with this name may not be downloaded."},
+	}
+	for _, test := range tests {
+		if got := p.check(test.mimetype, test.filename); got != test.want {
+			t.Errorf("check(%q, %q) = %q, want %q", test.mimetype, test.filename, got, test.want)
+		}
+	}
+}
+
+func TestServer_DownloadPolicy_Storage(t *testing.T) {
+	s, guacd := newPipeServer(t)
+	storage := &downloadRecorder{}
+	s.DownloadPolicy = func(r *http.Request) *DownloadPolicy {
+		return &DownloadPolicy{Storage: storage}
+	}
+	s.User = func(r *http.Request) string { return "alice" }
+	received := recordGuacd(guacd)
+
+	rec := serve(s, http.MethodPost, "connect", "", "")
+	uuid, token := rec.Body.String(), rec.Header().Get(TunnelTokenHeader)
+
+	// without a maximum size the files pass straight through, one completing and one refused by the client
+	read := make(chan string)
+	go func() { read <- serve(s, http.MethodGet, "read:"+uuid+":0", token, "").Body.String() }()
+	sent := fileInstructions("1", "text/plain", "a.txt", "hello") +
+		NewInstruction("file", "2", "text/plain", "b.txt").String() +
+		NewInstruction("blob", "2", base64Of("par")).String()
+	if _, err := guacd.Write([]byte(sent)); err != nil {
+		t.Fatal(err)
+	}
+	storage.wait(t, func(downloads []*recordedDownload) bool {
+		return len(downloads) == 2 && downloads[1].data.String() == "par"
+	})
+	serve(s, http.MethodPost, "write:"+uuid, token, "3.ack,1.2,7.Refused,3.256;")
+	received.wait(t, "3.ack,1.2,7.Refused,3.256;")
+	_ = guacd.Close()
+
+	if body := <-read; !strings.HasPrefix(body, sent) {
+		t.Errorf("Unexpected instructions read %q, want prefix %q", body, sent)
+	}
+	storage.wait(t, func(downloads []*recordedDownload) bool {
+		return downloads[0].closed && downloads[1].closed
+	})
+	if got := storage.downloads[0]; got.data.String() != "hello" || got.err != nil {
+		t.Errorf("Unexpected completed download %q %v", got.data.String(), got.err)
+	}
+	want := Download{TunnelUUID: uuid, User: "alice", Stream: "1", Mimetype: "text/plain", Filename: "a.txt"}
+	if got := storage.downloads[0].download; got != want {
+		t.Errorf("Unexpected download %+v, want %+v", got, want)
+	}
+	if got := storage.downloads[1]; got.err == nil {
+		t.Error("Expected the refused download to be stored as incomplete")
+	}
+}
+
+func TestDownloadPolicy_BlockStreamed(t *testing.T) {
+	filter := newTunnelFilter(newDownloadFilter(&DownloadPolicy{}, slog.Default(), Download{}))
+	var replies []string
+	filter.setInject(func(ins []byte) error {
+		replies = append(replies, string(ins))
+		return nil
+	})
+
+	// without a maximum size the client has the beginning of the file when its data turns out to be invalid
+	begin := NewInstruction("file", "1", "text/plain", "a.txt").String()
+	sent := begin + NewInstruction("blob", "1", "!!!!").String() + NewInstruction("blob", "1", base64Of("more")).String() +
+		NewInstruction("end", "1").String() + "4.sync,1.0;"
+	reader := filter.reader(NewStream(&fakeConn{ToRead: []byte(sent)}, time.Minute))
+	var got string
+	for !strings.HasSuffix(got, "4.sync,1.0;") {
+		ins, err := reader.ReadSome()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got += string(ins)
+	}
+
+	// so it is sent the end of the stream, once
+	if want := begin + NewInstruction("end", "1").String() + "4.sync,1.0;"; got != want {
+		t.Errorf("Unexpected instructions read %q, want %q", got, want)
+	}
+	if want := []string{forbiddenAck("1", "Invalid file data.")}; strings.Join(replies, "") != strings.Join(want, "") {
+		t.Errorf("Unexpected instructions sent to guacd %q, want %q", replies, want)
+	}
+}
+
+func TestDownloadPolicy_DirectoryListing(t *testing.T) {
+	filter := newTunnelFilter(newDownloadFilter(&DownloadPolicy{MaxSize: 1024, Mimetypes: []string{"text/plain"}},
+		slog.Default(), Download{}))
+	var replies []string
+	filter.setInject(func(ins []byte) error {
+		replies = append(replies, string(ins))
+		return nil
+	})
+
+	// the client browses a directory, then downloads a file from it which the policy refuses
+	listing := NewInstruction("body", "0", "1", streamIndexMimetype, "/").String() +
+		NewInstruction("blob", "1", base64Of(`{"/a.txt":"text/plain"}`)).String() +
+		NewInstruction("end", "1").String()
+	refused := NewInstruction("body", "0", "2", "application/pdf", "/b.pdf").String()
+	reader := filter.reader(NewStream(&fakeConn{ToRead: []byte(listing + refused + "4.sync,1.0;")}, time.Minute))
+	var got string
+	for !strings.HasSuffix(got, "4.sync,1.0;") {
+		ins, err := reader.ReadSome()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got += string(ins)
+	}
+
+	// the listing reaches the client as guacd sent it, for the client to ack
+	if want := listing + "4.sync,1.0;"; got != want {
+		t.Errorf("Unexpected instructions read %q, want %q", got, want)
+	}
+	if want := forbiddenAck("2", "Files of this type may not be downloaded."); strings.Join(replies, "") != want {
+		t.Errorf("Unexpected instructions sent to guacd %q, want %q", replies, want)
+	}
+}
+
+// readWebsocket reads messages from the websocket until they add up to at least n bytes.
+func readWebsocket(t *testing.T, ws *websocket.Conn, n int) string {
+	t.Helper()
+	var got string
+	for len(got) < n {
+		_, message, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got += string(message)
+	}
+	return got
+}
+
+func TestWebsocketServer_DownloadPolicy(t *testing.T) {
+	guacd, client := net.Pipe()
+	server := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		return NewSimpleTunnel(NewStream(client, time.Minute)), nil
+	})
+	server.DownloadPolicy = func(r *http.Request) *DownloadPolicy {
+		return &DownloadPolicy{MaxSize: 8, BlockedFilenames: []string{"*.exe"}}
+	}
+	received := recordGuacd(guacd)
+
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ws.Close() }()
+	if _, _, err = ws.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a small file is acked on the client's behalf, and reaches the client once complete
+	small := fileInstructions("1", "text/plain", "a.txt", "hello")
+	if _, err = guacd.Write([]byte(small)); err != nil {
+		t.Fatal(err)
+	}
+	acks := string(successAck([]byte("1"))) + string(successAck([]byte("1")))
+	received.wait(t, acks)
+	if got := readWebsocket(t, ws, len(small)); got != small {
+		t.Errorf("Unexpected instructions read %q, want %q", got, small)
+	}
+
+	// so the client's own acks go no further
+	clientAcks := "3.ack,1.1,2.OK,1.0;3.ack,1.1,2.OK,1.0;3.nop;"
+	if err = ws.WriteMessage(websocket.TextMessage, []byte(clientAcks)); err != nil {
+		t.Fatal(err)
+	}
+	if got := received.wait(t, "3.nop;"); got != acks+"3.nop;" {
+		t.Errorf("Unexpected instructions written to guacd %q, want %q", got, acks+"3.nop;")
+	}
+
+	// files which are too large or have a blocked name never reach the client
+	blocked := fileInstructions("2", "text/plain", "b.txt", "far too long") +
+		fileInstructions("3", "application/octet-stream", "setup.exe", "MZ") + "4.sync,1.0;"
+	if _, err = guacd.Write([]byte(blocked)); err != nil {
+		t.Fatal(err)
+	}
+	received.wait(t, forbiddenAck("2", "File is too large.")+forbiddenAck("3", "Files with this name may not be downloaded."))
+	if got := readWebsocket(t, ws, len("4.sync,1.0;")); got != "4.sync,1.0;" {
+		t.Errorf("Unexpected instructions read %q", got)
+	}
+}
+
+func TestDirectoryDownloadStorage(t *testing.T) {
+	dir := t.TempDir()
+	storage := DirectoryDownloadStorage{Dir: dir}
+	download := Download{TunnelUUID: "tunnel", Stream: "1", Filename: "/home/alice/../report.pdf"}
+
+	complete, err := storage.Store(download)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = complete.Write([]byte("%PDF")); err != nil {
+		t.Fatal(err)
+	}
+	if err = complete.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	download.Stream, download.Filename = "2", ".."
+	incomplete, err := storage.Store(download)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = incomplete.(interface{ CloseWithError(error) error }).CloseWithError(errors.New("refused")); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "tunnel", "*"))
+	if err != nil || len(names) != 2 {
+		t.Fatalf("Unexpected stored files %v %v", names, err)
+	}
+	if !strings.HasSuffix(names[0], "-1-report.pdf") || !strings.HasSuffix(names[1], "-2-download.part") {
+		t.Errorf("Unexpected stored files %v", names)
+	}
+	if data, _ := os.ReadFile(names[0]); string(data) != "%PDF" {
+		t.Errorf("Unexpected stored data %q", data)
+	}
+}
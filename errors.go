@@ -1,16 +1,47 @@
 package guac
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 )
 
+// ErrGuac is an error carrying the Guacamole Status to report to the client. It may wrap the underlying
+// error which caused it, and matches its ErrKind with errors.Is, e.g. errors.Is(err, ErrUpstreamTimeout).
 type ErrGuac struct {
-	error
 	Status Status
 	Kind   ErrKind
+
+	message string
+	cause   error
+
+	// upstream is set when guacd itself reported the error with an error instruction
+	upstream bool
+}
+
+// Error returns the message, followed by the message of the cause if there is one.
+func (e *ErrGuac) Error() string {
+	switch {
+	case e.cause == nil:
+		return e.message
+	case len(e.message) == 0:
+		return e.cause.Error()
+	}
+	return e.message + ": " + e.cause.Error()
+}
+
+// Unwrap returns the underlying error, if any.
+func (e *ErrGuac) Unwrap() error {
+	return e.cause
+}
+
+// Is returns true if target is the ErrKind of this error.
+func (e *ErrGuac) Is(target error) bool {
+	kind, ok := target.(ErrKind)
+	return ok && kind == e.Kind
 }
 
+// ErrKind classifies errors. Each kind is itself an error so it can be used as the target of errors.Is.
 type ErrKind int
 
 const (
@@ -89,11 +120,110 @@ func (e ErrKind) Status() (state Status) {
 	return
 }
 
+// errKindFromStatus returns the ErrKind which best matches the given Status.
+func errKindFromStatus(status Status) ErrKind {
+	switch status {
+	case ClientBadType:
+		return ErrClientBadType
+	case ClientBadRequest:
+		return ErrClient
+	case ClientOverrun:
+		return ErrClientOverrun
+	case ClientTimeout:
+		return ErrClientTimeout
+	case ClientTooMany:
+		return ErrClientTooMany
+	case ResourceClosed:
+		return ErrResourceClosed
+	case ResourceConflict:
+		return ErrResourceConflict
+	case ResourceNotFound:
+		return ErrResourceNotFound
+	case ClientForbidden:
+		return ErrSecurity
+	case ServerBusy:
+		return ErrServerBusy
+	case SessionClosed:
+		return ErrSessionClosed
+	case SessionConflict:
+		return ErrSessionConflict
+	case SessionTimeout:
+		return ErrSessionTimeout
+	case ClientUnauthorized:
+		return ErrUnauthorized
+	case Unsupported:
+		return ErrUnsupported
+	case UpstreamError:
+		return ErrUpstream
+	case UpstreamNotFound:
+		return ErrUpstreamNotFound
+	case UpstreamTimeout:
+		return ErrUpstreamTimeout
+	case UpstreamUnavailable:
+		return ErrUpstreamUnavailable
+	}
+	return ErrServer
+}
+
+var errKindNames = [...]string{
+	ErrClientBadType:       "client bad type",
+	ErrClient:              "client error",
+	ErrClientOverrun:       "client overrun",
+	ErrClientTimeout:       "client timeout",
+	ErrClientTooMany:       "client too many",
+	ErrConnectionClosed:    "connection closed",
+	ErrOther:               "other error",
+	ErrResourceClosed:      "resource closed",
+	ErrResourceConflict:    "resource conflict",
+	ErrResourceNotFound:    "resource not found",
+	ErrSecurity:            "security error",
+	ErrServerBusy:          "server busy",
+	ErrServer:              "server error",
+	ErrSessionClosed:       "session closed",
+	ErrSessionConflict:     "session conflict",
+	ErrSessionTimeout:      "session timeout",
+	ErrUnauthorized:        "unauthorized",
+	ErrUnsupported:         "unsupported",
+	ErrUpstream:            "upstream error",
+	ErrUpstreamNotFound:    "upstream not found",
+	ErrUpstreamTimeout:     "upstream timeout",
+	ErrUpstreamUnavailable: "upstream unavailable",
+}
+
+// Error returns the name of the kind.
+func (e ErrKind) Error() string {
+	if e >= 0 && int(e) < len(errKindNames) {
+		return errKindNames[e]
+	}
+	return fmt.Sprintf("ErrKind(%d)", int(e))
+}
+
 // NewError creates a new error struct instance with Kind and included message
 func (e ErrKind) NewError(args ...string) error {
+	return e.newError(nil, args...)
+}
+
+// Wrap creates a new error with Kind and included message which wraps cause, so that errors.Is and errors.As
+// can see the underlying error.
+func (e ErrKind) Wrap(cause error, args ...string) error {
+	return e.newError(cause, args...)
+}
+
+func (e ErrKind) newError(cause error, args ...string) *ErrGuac {
 	return &ErrGuac{
-		error:  fmt.Errorf("%v", strings.Join(args, ", ")),
-		Status: e.Status(),
-		Kind:   e,
+		Status:  e.Status(),
+		Kind:    e,
+		message: strings.Join(args, ", "),
+		cause:   cause,
+	}
+}
+
+// guacErrorOf returns err as an *ErrGuac if it is or wraps one, otherwise a new error of the given kind which
+// wraps err. It is used wherever an error of unknown origin must be reported to a client.
+func guacErrorOf(err error, kind ErrKind, args ...string) *ErrGuac {
+	var guacErr *ErrGuac
+	if errors.As(err, &guacErr) {
+		return guacErr
 	}
+	return kind.newError(err, args...)
 }
@@ -0,0 +1,76 @@
+package guac
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestErrGuac_Is(t *testing.T) {
+	err := fmt.Errorf("session ended: %w", ErrUpstreamTimeout.Wrap(io.EOF, "Connection to guacd timed out."))
+
+	if !errors.Is(err, ErrUpstreamTimeout) {
+		t.Error("Expected error to match its kind")
+	}
+	if errors.Is(err, ErrUpstreamNotFound) {
+		t.Error("Expected error not to match another kind")
+	}
+	if !errors.Is(err, io.EOF) {
+		t.Error("Expected error to match its cause")
+	}
+
+	var guacErr *ErrGuac
+	if !errors.As(err, &guacErr) || guacErr.Status != UpstreamTimeout {
+		t.Error("Expected to find the *ErrGuac with its status", guacErr)
+	}
+}
+
+func TestErrGuac_Error(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{ErrServer.NewError("a", "b"), "a, b"},
+		{ErrServer.Wrap(io.EOF, "Connection closed."), "Connection closed.: EOF"},
+		{ErrServer.Wrap(io.EOF), "EOF"},
+		{ErrUpstreamTimeout, "upstream timeout"},
+	}
+
+	for _, test := range tests {
+		if got := test.err.Error(); got != test.want {
+			t.Errorf("Error()=%q, want %q", got, test.want)
+		}
+	}
+}
+
+func TestStream_ReadSome_WrapsNetError(t *testing.T) {
+	guacd, client := net.Pipe()
+	defer guacd.Close()
+
+	stream := NewStream(client, time.Millisecond)
+	_, err := stream.ReadSome()
+
+	if !errors.Is(err, ErrUpstreamTimeout) {
+		t.Fatal("Expected an upstream timeout, got", err)
+	}
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Error("Expected the underlying net.Error to be available, got", err)
+	}
+}
+
+func TestGuacErrorOf(t *testing.T) {
+	original := ErrUnauthorized.NewError("denied")
+	if got := guacErrorOf(fmt.Errorf("wrapped: %w", original), ErrServer); got != original {
+		t.Error("Expected the wrapped *ErrGuac to be returned, got", got)
+	}
+
+	cause := errors.New("boom")
+	got := guacErrorOf(cause, ErrServer, "Failed.")
+	if got.Kind != ErrServer || !errors.Is(got, cause) {
+		t.Error("Expected a new server error wrapping the cause, got", got)
+	}
+}
@@ -0,0 +1,346 @@
+package guac
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// blobSize is the most stream data a filter sends in one blob, as the JavaScript client does
+const blobSize = 6048
+
+// instructionFilter inspects the instructions passing through a tunnel, such as the streams of a clipboard
+// policy. filter is called with each complete instruction on its way in the direction, from one goroutine per
+// direction, and returns false to consume it. Other instructions are sent with out: on in the same direction, or
+// back to where the instruction came from.
+type instructionFilter interface {
+	filter(direction string, ins []byte, out filterOutput) (pass bool, err error)
+}
+
+// filterOutput sends instructions from a filter. Both methods copy the instruction.
+type filterOutput interface {
+	// forward sends the instruction on through the filters after this one, ahead of the one being filtered if
+	// that passes
+	forward(ins []byte) error
+	// reply sends the instruction back to where the one being filtered came from
+	reply(ins []byte) error
+}
+
+// policyOf returns the policy for a connect request, if there is a callback to ask.
+func policyOf[P any](policy func(*http.Request) *P, r *http.Request) *P {
+	if policy == nil {
+		return nil
+	}
+	return policy(r)
+}
+
+// tunnelFilter applies the filters of one session. Instructions for the client are queued, and go out ahead
+// of the next instruction from guacd. Instructions for guacd are written straight away with inject, which the
+// transport sets with setInject to a write path safe to use alongside the one carrying the client's
+// instructions. Its methods pass everything through on a nil tunnelFilter, which is what sessions without
+// filters use.
+type tunnelFilter struct {
+	filters []instructionFilter
+
+	mu       sync.Mutex
+	inject   func(ins []byte) error
+	toClient [][]byte
+}
+
+// sessionEnder is a filter which releases what it holds when the session ends
+type sessionEnder interface {
+	end()
+}
+
+// newTunnelFilter returns the filter applying the filters which aren't nil, or nil if there are none.
+func newTunnelFilter(filters ...instructionFilter) *tunnelFilter {
+	f := &tunnelFilter{}
+	for _, filter := range filters {
+		if filter != nil {
+			f.filters = append(f.filters, filter)
+		}
+	}
+	if len(f.filters) == 0 {
+		return nil
+	}
+	return f
+}
+
+// apply passes the instruction through each filter until one consumes it.
+func (f *tunnelFilter) apply(direction string, ins []byte, out filterOutput) (bool, error) {
+	return f.applyFrom(0, direction, ins, out)
+}
+
+// applyFrom passes the instruction through the filters from the ith.
+func (f *tunnelFilter) applyFrom(i int, direction string, ins []byte, out filterOutput) (bool, error) {
+	for ; i < len(f.filters); i++ {
+		next := chainedOutput{filter: f, next: i + 1, direction: direction, out: out}
+		if pass, err := f.filters[i].filter(direction, ins, next); err != nil || !pass {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// chainedOutput passes what a filter forwards through the filters after it
+type chainedOutput struct {
+	filter    *tunnelFilter
+	next      int
+	direction string
+	out       filterOutput
+}
+
+func (o chainedOutput) forward(ins []byte) error {
+	pass, err := o.filter.applyFrom(o.next, o.direction, ins, o.out)
+	if err != nil || !pass {
+		return err
+	}
+	return o.out.forward(ins)
+}
+
+func (o chainedOutput) reply(ins []byte) error { return o.out.reply(ins) }
+
+// end tells the filters the session has ended.
+func (f *tunnelFilter) end() {
+	if f == nil {
+		return
+	}
+	for _, filter := range f.filters {
+		if ender, ok := filter.(sessionEnder); ok {
+			ender.end()
+		}
+	}
+}
+
+// sendToClient queues a copy of the instruction for the client.
+func (f *tunnelFilter) sendToClient(ins []byte) error {
+	f.mu.Lock()
+	f.toClient = append(f.toClient, append([]byte(nil), ins...))
+	f.mu.Unlock()
+	return nil
+}
+
+// setInject sets how instructions are written to guacd.
+func (f *tunnelFilter) setInject(inject func(ins []byte) error) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	f.inject = inject
+	f.mu.Unlock()
+}
+
+// sendToGuacd writes the instruction to guacd.
+func (f *tunnelFilter) sendToGuacd(ins []byte) error {
+	f.mu.Lock()
+	inject := f.inject
+	f.mu.Unlock()
+	if inject == nil {
+		return ErrConnectionClosed.NewError("Tunnel is not connected.")
+	}
+	return inject(ins)
+}
+
+// nextToClient returns the next instruction queued for the client, if any.
+func (f *tunnelFilter) nextToClient() []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.toClient) == 0 {
+		return nil
+	}
+	ins := f.toClient[0]
+	f.toClient[0] = nil
+	f.toClient = f.toClient[1:]
+	return ins
+}
+
+func (f *tunnelFilter) queuedToClient() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.toClient) > 0
+}
+
+// reader returns r, filtering the instructions it reads from guacd.
+func (f *tunnelFilter) reader(r InstructionReader) InstructionReader {
+	if f == nil {
+		return r
+	}
+	return &filteringReader{InstructionReader: r, filter: f}
+}
+
+// writer returns w, filtering the instructions written to guacd. Closing it closes w, after checking that the
+// last instruction written was complete.
+func (f *tunnelFilter) writer(w io.WriteCloser) io.WriteCloser {
+	if f == nil {
+		return w
+	}
+	return &filteringWriter{w: w, filter: f}
+}
+
+// filteringReader filters the instructions read from guacd, returning the instructions queued for the client
+// first.
+type filteringReader struct {
+	InstructionReader
+	filter *tunnelFilter
+}
+
+// ReadSome returns the next instruction for the client
+func (r *filteringReader) ReadSome() ([]byte, error) {
+	return copied(r.ReadSomeNoCopy())
+}
+
+// ReadSomeNoCopy returns the next instruction for the client without copying it
+func (r *filteringReader) ReadSomeNoCopy() ([]byte, error) {
+	for {
+		if ins := r.filter.nextToClient(); ins != nil {
+			return ins, nil
+		}
+		ins, err := readSomeNoCopy(r.InstructionReader)
+		if err != nil || len(ins) == 0 {
+			return ins, err
+		}
+		pass, err := r.filter.apply(directionToClient, ins, readerOutput{r.filter})
+		if err != nil {
+			return nil, err
+		}
+		if !pass {
+			continue
+		}
+		if r.filter.queuedToClient() {
+			// after what the filters forwarded
+			_ = r.filter.sendToClient(ins)
+			continue
+		}
+		return ins, nil
+	}
+}
+
+// Available returns true if there are instructions queued for the client or buffered from guacd
+func (r *filteringReader) Available() bool {
+	return r.filter.queuedToClient() || r.InstructionReader.Available()
+}
+
+// readerOutput forwards to the client and replies to guacd
+type readerOutput struct {
+	filter *tunnelFilter
+}
+
+func (o readerOutput) forward(ins []byte) error { return o.filter.sendToClient(ins) }
+func (o readerOutput) reply(ins []byte) error   { return o.filter.sendToGuacd(ins) }
+
+// filteringWriter filters the instructions written to guacd, which may be split across writes
+type filteringWriter struct {
+	w        io.WriteCloser
+	filter   *tunnelFilter
+	splitter instructionSplitter
+}
+
+// Write filters the instructions completed by p, writing those which pass
+func (w *filteringWriter) Write(p []byte) (int, error) {
+	err := w.splitter.split(p, func(ins []byte) error {
+		pass, err := w.filter.apply(directionToGuacd, ins, writerOutput{w})
+		if err == nil && pass {
+			_, err = w.w.Write(ins)
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close closes the underlying writer, failing if the last instruction written was incomplete.
+func (w *filteringWriter) Close() error {
+	incomplete := w.splitter.partial != nil
+	w.splitter.release()
+	err := w.w.Close()
+	if err == nil && incomplete {
+		err = ErrClient.NewError("Incomplete instruction from client.")
+	}
+	return err
+}
+
+// writerOutput forwards to guacd and replies to the client
+type writerOutput struct {
+	w *filteringWriter
+}
+
+func (o writerOutput) forward(ins []byte) error {
+	_, err := o.w.w.Write(ins)
+	return err
+}
+
+func (o writerOutput) reply(ins []byte) error { return o.w.filter.sendToClient(ins) }
+
+// deferredOutput keeps what a filter sends while it holds a lock, to be sent once it is released, as sending
+// to guacd may wait for the other direction of the session
+type deferredOutput struct {
+	sent []deferredInstruction
+}
+
+type deferredInstruction struct {
+	ins   []byte
+	reply bool
+}
+
+func (o *deferredOutput) forward(ins []byte) error {
+	o.sent = append(o.sent, deferredInstruction{ins: append([]byte(nil), ins...)})
+	return nil
+}
+
+func (o *deferredOutput) reply(ins []byte) error {
+	o.sent = append(o.sent, deferredInstruction{ins: append([]byte(nil), ins...), reply: true})
+	return nil
+}
+
+// flush sends the instructions kept, in order.
+func (o *deferredOutput) flush(out filterOutput) error {
+	for _, sent := range o.sent {
+		send := out.forward
+		if sent.reply {
+			send = out.reply
+		}
+		if err := send(sent.ins); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forwardStream sends the instruction beginning a stream, then the data in blobs and the end of the stream.
+func forwardStream(out filterOutput, begin *Instruction, index []byte, data []byte) error {
+	if err := out.forward(begin.Byte()); err != nil {
+		return err
+	}
+	for len(data) > 0 {
+		n := len(data)
+		if n > blobSize {
+			n = blobSize
+		}
+		blob := NewInstruction("blob", string(index), base64.StdEncoding.EncodeToString(data[:n]))
+		if err := out.forward(blob.Byte()); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return out.forward(NewInstruction("end", string(index)).Byte())
+}
+
+// mimetypeAllowed returns true if the mimetype, ignoring any parameters, is one of those allowed, which may end
+// in "/*" to allow every subtype. Any mimetype is allowed if none are listed.
+func mimetypeAllowed(allowed []string, mimetype string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	mimetype, _, _ = strings.Cut(mimetype, ";")
+	mimetype = strings.TrimSpace(mimetype)
+	for _, a := range allowed {
+		if a == mimetype || strings.HasSuffix(a, "/*") && strings.HasPrefix(mimetype, a[:len(a)-1]) {
+			return true
+		}
+	}
+	return false
+}
@@ -3,14 +3,15 @@ package guac
 import (
 	"errors"
 	"fmt"
+	"io"
 	"strconv"
+	"unicode/utf8"
 )
 
 // Instruction represents a Guacamole instruction
 type Instruction struct {
 	Opcode string
 	Args   []string
-	cache  string
 }
 
 // NewInstruction creates an instruction
@@ -21,93 +22,260 @@ func NewInstruction(opcode string, args ...string) *Instruction {
 	}
 }
 
-// String returns the on-wire representation of the instruction
+// String returns the on-wire representation of the instruction. Element lengths are counted in Unicode code
+// points as the protocol requires. Bytes which are not part of valid UTF-8 are each replaced with U+FFFD, the
+// same substitution Parse and Stream make when decoding, so invalid input always round-trips to the same value.
 func (i *Instruction) String() string {
-	if len(i.cache) > 0 {
-		return i.cache
+	return string(i.AppendTo(make([]byte, 0, i.encodedLen())))
+}
+
+// Byte returns the on-wire representation of the instruction as a new slice.
+func (i *Instruction) Byte() []byte {
+	return i.AppendTo(make([]byte, 0, i.encodedLen()))
+}
+
+// AppendTo appends the on-wire representation of the instruction to buf and returns the extended buffer.
+// It does not allocate unless buf must grow or an element contains invalid UTF-8.
+func (i *Instruction) AppendTo(buf []byte) []byte {
+	buf = appendElement(buf, i.Opcode)
+	for _, value := range i.Args {
+		buf = append(buf, ',')
+		buf = appendElement(buf, value)
 	}
+	return append(buf, ';')
+}
 
-	i.cache = fmt.Sprintf("%d.%s", len(i.Opcode), i.Opcode)
+// WriteTo writes the on-wire representation of the instruction to w with a single Write, encoding into a
+// pooled buffer. It implements io.WriterTo.
+func (i *Instruction) WriteTo(w io.Writer) (int64, error) {
+	bufp := getBuffer()
+	*bufp = i.AppendTo(*bufp)
+	n, err := w.Write(*bufp)
+	putBuffer(bufp)
+	return int64(n), err
+}
+
+// encodedLen returns an upper bound of the encoded length of the instruction, which is exact for ASCII.
+// Elements containing invalid UTF-8 may grow when encoded.
+func (i *Instruction) encodedLen() int {
+	n := encodedElementLen(i.Opcode) + 1
 	for _, value := range i.Args {
-		i.cache += fmt.Sprintf(",%d.%s", len(value), value)
+		n += encodedElementLen(value) + 1
 	}
-	i.cache += ";"
+	return n
+}
 
-	return i.cache
+// encodedElementLen returns the length of the element with its length prefix, counting the prefix as if every
+// byte were a code point.
+func encodedElementLen(value string) int {
+	n := len(value) + 2
+	for l := len(value); l >= 10; l /= 10 {
+		n++
+	}
+	return n
 }
 
-func (i *Instruction) Byte() []byte {
-	return []byte(i.String())
+func appendElement(buf []byte, value string) []byte {
+	value = validUTF8(value)
+	buf = strconv.AppendInt(buf, int64(utf8.RuneCountInString(value)), 10)
+	buf = append(buf, '.')
+	return append(buf, value...)
+}
+
+// validUTF8 replaces each byte of s which is not part of a valid UTF-8 sequence with U+FFFD, leaving the number
+// of code points unchanged.
+func validUTF8(s string) string {
+	if utf8.ValidString(s) {
+		return s
+	}
+	return string([]rune(s))
 }
 
+// ParseError describes where and why an instruction could not be parsed.
+type ParseError struct {
+	// Offset is the byte offset in the input at which parsing failed.
+	Offset int
+	// Element is the index of the element being parsed when parsing failed, where 0 is the opcode.
+	Element int
+	// Reason describes the failure.
+	Reason string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("guac.Parse: %s at byte %d (element %d)", e.Reason, e.Offset, e.Element)
+}
+
+// Parse parses a single instruction from buf. Data after the instruction's terminating semicolon is ignored.
+// Element lengths are counted in Unicode code points; each byte which is not part of valid UTF-8 counts as one
+// code point and is decoded as U+FFFD. Parse never panics, and failures are reported as a *ParseError.
 func Parse(buf []byte) (*Instruction, error) {
-	data := []rune(string(buf))
-
-	elementStart := 0
-
-	// Build list of elements
-	elements := make([]string, 0, 1)
-	for elementStart < len(data) {
-		// Find end of length
-		lengthEnd := -1
-		for i := elementStart; i < len(data); i++ {
-			if data[i] == '.' {
-				lengthEnd = i
-				break
+	return parse(buf, false)
+}
+
+// ParseStrict is like Parse but also rejects data following the instruction and elements declaring more than
+// MaxGuacMessage code points. It is intended for instructions received from untrusted clients.
+func ParseStrict(buf []byte) (*Instruction, error) {
+	return parse(buf, true)
+}
+
+func parse(buf []byte, strict bool) (*Instruction, error) {
+	elements := make([]string, 0, 4)
+	pos := 0
+
+	fail := func(offset int, reason string) (*Instruction, error) {
+		return nil, &ParseError{Offset: offset, Element: len(elements), Reason: reason}
+	}
+
+	for {
+		// Parse length, which may not exceed the remaining bytes as every code point takes at least one
+		lengthStart := pos
+		length := 0
+		for ; pos < len(buf) && buf[pos] != '.'; pos++ {
+			c := buf[pos]
+			if c < '0' || c > '9' {
+				return fail(pos, "wrong pattern instruction")
+			}
+			length = length*10 + int(c-'0')
+			if strict && length > MaxGuacMessage {
+				return fail(lengthStart, "element too long")
+			}
+			if length > len(buf) {
+				return fail(lengthStart, "invalid length (corrupted instruction?)")
 			}
 		}
-		// read() is required to return a complete instruction. If it does
-		// not, this is a severe internal error.
-		if lengthEnd == -1 {
-			return nil, errors.New("guac.Parse: incomplete instruction")
+		if pos >= len(buf) {
+			return fail(pos, "incomplete instruction")
 		}
-
-		// Parse length
-		length, e := strconv.Atoi(string(data[elementStart:lengthEnd]))
-		if e != nil {
-			return nil, errors.New("guac.Parse: wrong pattern instruction")
+		if pos == lengthStart {
+			return fail(pos, "wrong pattern instruction")
 		}
 
 		// Parse element from just after period
-		elementStart = lengthEnd + 1
-		elementEnd := elementStart + length
-		if elementEnd >= len(data) {
-			return nil, errors.New("guac.Parse: invalid length (corrupted instruction?)")
+		pos++
+		elementStart := pos
+		for n := 0; n < length; n++ {
+			if pos >= len(buf) {
+				return fail(elementStart, "invalid length (corrupted instruction?)")
+			}
+			_, size := utf8.DecodeRune(buf[pos:])
+			pos += size
 		}
+		elements = append(elements, validUTF8(string(buf[elementStart:pos])))
 
-		element := string(data[elementStart:elementEnd])
-
-		// Append element to list of elements
-		elements = append(elements, element)
-
-		// ReadSome terminator after element
-		elementStart += length
+		// Read terminator after element
+		if pos >= len(buf) {
+			return fail(pos, "incomplete instruction")
+		}
+		terminator := buf[pos]
+		pos++
 
-		if elementStart >= len(data) {
-			return nil, errors.New("guac.Parse: invalid length (corrupted instruction?)")
+		switch terminator {
+		case ',':
+			// keep going
+		case ';':
+			if strict && pos < len(buf) {
+				return fail(pos, "trailing data after instruction")
+			}
+			return NewInstruction(elements[0], elements[1:]...), nil
+		default:
+			elements = elements[:len(elements)-1]
+			return fail(pos-1, "invalid terminator")
 		}
-		terminator := data[elementStart]
+	}
+}
 
-		// Continue reading instructions after terminator
-		elementStart++
+var (
+	errElementLength      = errors.New("non-numeric character in element length")
+	errElementTerminator  = errors.New("element terminator of instruction was not ';' nor ','")
+	errInstructionTooLong = errors.New("instruction is too long")
+)
+
+// maxInstructionSize bounds the bytes held for one instruction, and so the element lengths accepted by
+// scanInstruction. It leaves room for MaxGuacMessage code points of any encoding.
+const maxInstructionSize = MaxGuacMessage * utf8.UTFMax * 2
 
-		// If we've reached the end of the instruction
-		if terminator == ';' {
-			break
+// scanInstruction finds the end of the instruction at the start of buf without decoding it, counting element
+// lengths in code points like Parse. Scanning starts at from, which is 0 or the element boundary returned by an
+// earlier call on the same instruction. If buf holds the whole instruction its length is returned, otherwise 0
+// and the element boundary to resume from once more data has arrived.
+func scanInstruction(buf []byte, from int) (n int, resume int, err error) {
+	i := from
+	for i < len(buf) {
+		// Length of element
+		length := 0
+		for ; i < len(buf) && buf[i] != '.'; i++ {
+			c := buf[i]
+			if c < '0' || c > '9' {
+				return 0, from, errElementLength
+			}
+			length = length*10 + int(c-'0')
+			if length > maxInstructionSize {
+				return 0, from, errInstructionTooLong
+			}
+		}
+		// Skip the period, then the element, unless more data is needed
+		for i++; length > 0 && i < len(buf); length-- {
+			if !utf8.FullRune(buf[i:]) {
+				return 0, from, nil
+			}
+			_, size := utf8.DecodeRune(buf[i:])
+			i += size
+		}
+		if length > 0 || i >= len(buf) {
+			return 0, from, nil
 		}
 
+		terminator := buf[i]
+		i++
+		switch terminator {
+		case ';':
+			return i, i, nil
+		case ',':
+			// Continue here if necessary
+			from = i
+		default:
+			return 0, from, errElementTerminator
+		}
 	}
-
-	return NewInstruction(elements[0], elements[1:]...), nil
+	return 0, from, nil
 }
 
-// ReadOne takes an instruction from the stream and parses it into an Instruction
+// ReadOne takes an instruction from the stream and parses it into an Instruction. If guacd sent an error
+// instruction it is returned along with an *ErrGuac carrying guacd's message and status.
 func ReadOne(stream *Stream) (instruction *Instruction, err error) {
 	var instructionBuffer []byte
-	instructionBuffer, err = stream.ReadSome()
+	instructionBuffer, err = stream.ReadSomeNoCopy()
 	if err != nil {
 		return
 	}
 
-	return Parse(instructionBuffer)
+	instruction, err = Parse(instructionBuffer)
+	if err != nil {
+		return
+	}
+
+	if instruction.Opcode == "error" {
+		err = errorFromInstruction(instruction)
+	}
+	return
+}
+
+// errorFromInstruction converts an error instruction ("error", message, status code) into an *ErrGuac.
+// Status codes which are missing or unknown are reported as server errors.
+func errorFromInstruction(instruction *Instruction) error {
+	message := "guacd reported an error."
+	if len(instruction.Args) > 0 && len(instruction.Args[0]) > 0 {
+		message = instruction.Args[0]
+	}
+
+	status := Undefined
+	if len(instruction.Args) > 1 {
+		if code, e := strconv.Atoi(instruction.Args[1]); e == nil {
+			status = FromGuacamoleStatusCode(code)
+		}
+	}
+
+	err := errKindFromStatus(status).newError(nil, message)
+	err.upstream = true
+	return err
 }
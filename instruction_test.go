@@ -1,8 +1,14 @@
 package guac
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
 	"testing"
 	"time"
+	"unicode/utf8"
 )
 
 func TestParse(t *testing.T) {
@@ -23,7 +29,7 @@ func TestParse(t *testing.T) {
 
 		if _, err := Parse(invalid); err == nil {
 			t.Fatal("expected error")
-		} else if err.Error() != "guac.Parse: wrong pattern instruction" {
+		} else if err.Error() != "guac.Parse: invalid terminator at byte 7 (element 0)" {
 			t.Fatalf("unexpected error: %#v", err.Error())
 		}
 	})
@@ -34,6 +40,54 @@ func TestParse(t *testing.T) {
 			t.Fatal("expected error")
 		}
 	})
+
+	t.Run("IgnoresTrailingData", func(t *testing.T) {
+		if instr, err := Parse([]byte("4.sync,1.0;4.sync")); err != nil {
+			t.Fatal(err)
+		} else if instr.Opcode != "sync" {
+			t.Fatalf("Opcode=%v, want sync", instr.Opcode)
+		}
+	})
+}
+
+func TestParse_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		strict  bool
+		offset  int
+		element int
+		reason  string
+	}{
+		{"Empty", "", false, 0, 0, "incomplete instruction"},
+		{"NoLength", ".;", false, 0, 0, "wrong pattern instruction"},
+		{"NonDigitLength", "4.sync,x.0;", false, 7, 1, "wrong pattern instruction"},
+		{"NegativeLength", "-1.a;", false, 0, 0, "wrong pattern instruction"},
+		{"HugeLength", "99999999999999999999999.a;", false, 0, 0, "invalid length (corrupted instruction?)"},
+		{"LengthPastEnd", "4.sync,5.abc;", false, 9, 1, "invalid length (corrupted instruction?)"},
+		{"MissingTerminator", "4.sync", false, 6, 1, "incomplete instruction"},
+		{"MultiByteOffset", "4.🚀🚀🚀🚀x", false, 18, 0, "invalid terminator"},
+		{"StrictTrailing", "4.sync,1.0;4.sync", true, 11, 2, "trailing data after instruction"},
+		{"StrictTooLong", "8193." + strings.Repeat("a", 8193) + ";", true, 0, 0, "element too long"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parse := Parse
+			if test.strict {
+				parse = ParseStrict
+			}
+
+			_, err := parse([]byte(test.data))
+			var parseErr *ParseError
+			if !errors.As(err, &parseErr) {
+				t.Fatalf("Expected *ParseError, got %#v", err)
+			}
+			if parseErr.Offset != test.offset || parseErr.Element != test.element || parseErr.Reason != test.reason {
+				t.Errorf("Unexpected error %+v", parseErr)
+			}
+		})
+	}
 }
 
 func TestInstruction_String(t *testing.T) {
@@ -68,3 +122,287 @@ func TestReadOne(t *testing.T) {
 		t.Error("Unexpected", ins.String())
 	}
 }
+
+func TestReadOne_Error(t *testing.T) {
+	tests := []struct {
+		data    string
+		kind    ErrKind
+		status  Status
+		message string
+	}{
+		{"5.error,18.Connection refused,3.519;", ErrUpstreamNotFound, UpstreamNotFound, "Connection refused"},
+		{"5.error,9.Forbidden,3.771;", ErrSecurity, ClientForbidden, "Forbidden"},
+		{"5.error,4.Oops,5.99999;", ErrServer, ServerError, "Oops"},
+		{"5.error;", ErrServer, ServerError, "guacd reported an error."},
+	}
+
+	for _, test := range tests {
+		stream := NewStream(&fakeConn{ToRead: []byte(test.data)}, time.Minute)
+
+		ins, err := ReadOne(stream)
+		if ins == nil || ins.Opcode != "error" {
+			t.Errorf("%v: expected the error instruction to be returned, got %v", test.data, ins)
+		}
+		guacErr, ok := err.(*ErrGuac)
+		if !ok {
+			t.Errorf("%v: expected *ErrGuac, got %#v", test.data, err)
+			continue
+		}
+		if guacErr.Kind != test.kind || guacErr.Status != test.status || guacErr.Error() != test.message {
+			t.Errorf("%v: unexpected error %v %v %q", test.data, guacErr.Kind, guacErr.Status, guacErr.Error())
+		}
+	}
+}
+
+// unicodeCases covers the element values the encoding must round-trip. want is the decoded value, which
+// differs from the input only for invalid UTF-8.
+var unicodeCases = []struct {
+	name   string
+	value  string
+	want   string
+	length int
+}{
+	{"Empty", "", "", 0},
+	{"ASCII", "hello", "hello", 5},
+	{"Latin1", "héllo wörld", "héllo wörld", 11},
+	{"CJK", "剪贴板", "剪贴板", 3},
+	{"Astral", "rocket🚀", "rocket🚀", 7},
+	{"ZWJSequence", "👩‍👩‍👧", "👩‍👩‍👧", 5},
+	{"Combining", "é", "é", 2},
+	{"Delimiters", "1.a,2.bc;", "1.a,2.bc;", 9},
+	{"InvalidByte", "a\xffb", "a�b", 3},
+	{"TruncatedSequence", "a\xe2\x82", "a��", 3},
+	{"EncodedSurrogate", "\xed\xa0\x80", "���", 3},
+}
+
+func TestInstruction_UnicodeRoundTrip(t *testing.T) {
+	for _, test := range unicodeCases {
+		t.Run(test.name, func(t *testing.T) {
+			encoded := NewInstruction("clipboard", test.value).String()
+
+			if want := fmt.Sprintf("9.clipboard,%d.%s;", test.length, test.want); encoded != want {
+				t.Fatalf("String()=%q, want %q", encoded, want)
+			}
+			if !utf8.ValidString(encoded) {
+				t.Error("Encoded instruction is not valid UTF-8")
+			}
+
+			ins, err := Parse([]byte(encoded))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ins.Args) != 1 || ins.Args[0] != test.want {
+				t.Errorf("Parse()=%q, want %q", ins.Args, test.want)
+			}
+
+			// Read through a Stream, one byte at a time so every multi-byte sequence is split across reads
+			for _, size := range []int{1, len(encoded)} {
+				stream := NewStream(&chunkedConn{data: []byte(encoded + encoded), size: size}, time.Minute)
+				for n := 0; n < 2; n++ {
+					ins, err = ReadOne(stream)
+					if err != nil {
+						t.Fatalf("chunk size %d: %v", size, err)
+					}
+					if len(ins.Args) != 1 || ins.Args[0] != test.want {
+						t.Errorf("chunk size %d: ReadOne()=%q, want %q", size, ins.Args, test.want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestInstruction_StringOpcodeLength(t *testing.T) {
+	if got, want := NewInstruction("é").String(), "1.é;"; got != want {
+		t.Errorf("String()=%q, want %q", got, want)
+	}
+}
+
+// chunkedConn returns its data at most size bytes per Read.
+type chunkedConn struct {
+	fakeConn
+	data []byte
+	size int
+}
+
+func (c *chunkedConn) Read(b []byte) (int, error) {
+	if len(c.data) == 0 {
+		return 0, io.EOF
+	}
+	n := c.size
+	if n > len(c.data) {
+		n = len(c.data)
+	}
+	n = copy(b, c.data[:n])
+	c.data = c.data[n:]
+	return n, nil
+}
+
+func TestInstruction_AppendTo(t *testing.T) {
+	ins := NewInstruction("select", "hi", "hello", "asdf")
+
+	buf := ins.AppendTo([]byte("3.nop;"))
+	if got, want := string(buf), "3.nop;6.select,2.hi,5.hello,4.asdf;"; got != want {
+		t.Errorf("AppendTo()=%q, want %q", got, want)
+	}
+
+	buf = make([]byte, 0, 64)
+	if allocs := testing.AllocsPerRun(100, func() { buf = ins.AppendTo(buf[:0]) }); allocs != 0 {
+		t.Error("Expected AppendTo not to allocate, got", allocs)
+	}
+}
+
+func TestInstruction_WriteTo(t *testing.T) {
+	var buf bytes.Buffer
+	n, err := NewInstruction("clipboard", "rocket🚀").WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "9.clipboard,7.rocket🚀;"; got != want || n != int64(len(want)) {
+		t.Errorf("WriteTo()=%q (%d), want %q", got, n, want)
+	}
+}
+
+func TestStream_WriteInstructions(t *testing.T) {
+	conn := &recordingConn{}
+	stream := NewStream(conn, time.Minute)
+
+	_, err := stream.WriteInstructions(NewInstruction("size", "1024", "768", "96"), NewInstruction("audio"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conn.Writes) != 1 {
+		t.Fatal("Expected a single write, got", len(conn.Writes))
+	}
+	if got, want := string(conn.Writes[0]), "4.size,4.1024,3.768,2.96;5.audio;"; got != want {
+		t.Errorf("Wrote %q, want %q", got, want)
+	}
+}
+
+// recordingConn records every Write made to it.
+type recordingConn struct {
+	fakeConn
+	Writes [][]byte
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.Writes = append(c.Writes, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+var benchInstruction = NewInstruction("mouse", "1024", "768", "1")
+
+// sprintfEncode is how instructions used to be encoded, kept as a baseline for the benchmarks.
+func sprintfEncode(i *Instruction) string {
+	ret := fmt.Sprintf("%d.%s", utf8.RuneCountInString(i.Opcode), i.Opcode)
+	for _, value := range i.Args {
+		ret += fmt.Sprintf(",%d.%s", utf8.RuneCountInString(value), value)
+	}
+	return ret + ";"
+}
+
+func BenchmarkInstruction_Sprintf(b *testing.B) {
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		_ = sprintfEncode(benchInstruction)
+	}
+}
+
+func BenchmarkInstruction_String(b *testing.B) {
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		_ = benchInstruction.String()
+	}
+}
+
+func BenchmarkInstruction_AppendTo(b *testing.B) {
+	b.ReportAllocs()
+	buf := make([]byte, 0, 64)
+	for n := 0; n < b.N; n++ {
+		buf = benchInstruction.AppendTo(buf[:0])
+	}
+}
+
+func BenchmarkInstruction_WriteTo(b *testing.B) {
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		_, _ = benchInstruction.WriteTo(io.Discard)
+	}
+}
+
+func BenchmarkStream_WriteSeparately(b *testing.B) {
+	b.ReportAllocs()
+	stream := NewStream(&fakeConn{}, time.Minute)
+	for n := 0; n < b.N; n++ {
+		for i := 0; i < 5; i++ {
+			_, _ = stream.Write(benchInstruction.Byte())
+		}
+	}
+}
+
+func BenchmarkStream_WriteInstructions(b *testing.B) {
+	b.ReportAllocs()
+	stream := NewStream(&fakeConn{}, time.Minute)
+	for n := 0; n < b.N; n++ {
+		_, _ = stream.WriteInstructions(benchInstruction, benchInstruction, benchInstruction, benchInstruction, benchInstruction)
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	for _, seed := range []string{
+		"", ";", "0.;", "4.name,7.rocket🚀;", "5.name,7.rocket*;", "4.sync,1.0;4.sync", "3.a\xff\xfe;",
+		"99999999999999999999.a;", "-1.a;", "0.,36.0d3a1f4e-7a6e-4a43-9c2b-43b0d8e4f7aa;",
+	} {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ins, err := Parse(data)
+		strictIns, strictErr := ParseStrict(data)
+
+		if err != nil {
+			var parseErr *ParseError
+			if !errors.As(err, &parseErr) || parseErr.Offset < 0 || parseErr.Offset > len(data) {
+				t.Fatalf("Unexpected error %#v", err)
+			}
+			if strictErr == nil {
+				t.Fatal("ParseStrict accepted what Parse rejected")
+			}
+			return
+		}
+
+		// Whatever parses must encode to something which parses to the same instruction
+		encoded := ins.Byte()
+		again, err := Parse(encoded)
+		if err != nil {
+			t.Fatalf("Re-encoded %q does not parse: %v", encoded, err)
+		}
+		if again.String() != string(encoded) {
+			t.Fatalf("Round trip changed %q to %q", encoded, again.String())
+		}
+		if strictErr == nil && strictIns.String() != string(encoded) {
+			t.Fatalf("Parse and ParseStrict disagree: %q and %q", encoded, strictIns.String())
+		}
+	})
+}
+
+func FuzzInstructionRoundTrip(f *testing.F) {
+	for _, test := range unicodeCases {
+		f.Add("clipboard", test.value, "text/plain")
+	}
+
+	f.Fuzz(func(t *testing.T, opcode, arg1, arg2 string) {
+		encoded := NewInstruction(opcode, arg1, arg2).Byte()
+
+		ins, err := ParseStrict(encoded)
+		if err != nil {
+			if pe, ok := err.(*ParseError); ok && pe.Reason == "element too long" {
+				return
+			}
+			t.Fatalf("%q does not parse: %v", encoded, err)
+		}
+		if ins.Opcode != validUTF8(opcode) || len(ins.Args) != 2 || ins.Args[0] != validUTF8(arg1) || ins.Args[1] != validUTF8(arg2) {
+			t.Fatalf("Round trip of %q returned %q %q", encoded, ins.Opcode, ins.Args)
+		}
+	})
+}
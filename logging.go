@@ -0,0 +1,38 @@
+package guac
+
+import (
+	"log/slog"
+	"net/http"
+)
+
+// Log attributes identifying a session
+const (
+	logTunnelUUID   = "tunnel_uuid"
+	logConnectionID = "connection_id"
+	logUser         = "user"
+)
+
+// loggerOr returns the logger, or the default slog logger if it is nil.
+func loggerOr(logger *slog.Logger) *slog.Logger {
+	if logger == nil {
+		return slog.Default()
+	}
+	return logger
+}
+
+// sessionLogger returns the logger with the attributes identifying the tunnel and its user.
+func sessionLogger(logger *slog.Logger, tunnel Tunnel, user string) *slog.Logger {
+	return logger.With(
+		slog.String(logTunnelUUID, tunnel.GetUUID()),
+		slog.String(logConnectionID, tunnel.ConnectionID()),
+		slog.String(logUser, user),
+	)
+}
+
+// userOf returns the user making the request, or an empty string without a callback to find out.
+func userOf(user func(*http.Request) string, r *http.Request) string {
+	if user == nil {
+		return ""
+	}
+	return user(r)
+}
@@ -0,0 +1,100 @@
+package guac
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestConfig_LogValue(t *testing.T) {
+	config := NewGuacamoleConfiguration()
+	config.Protocol = "ssh"
+	config.Parameters = map[string]string{
+		"hostname":         "example",
+		"password":         "hunter2",
+		"gateway-password": "hunter3",
+		"passphrase":       "open sesame",
+		"private-key":      "-----BEGIN",
+	}
+
+	var buf bytes.Buffer
+	slog.New(slog.NewTextHandler(&buf, nil)).Info("connect", "config", config)
+	line := buf.String()
+
+	for _, secret := range []string{"hunter2", "hunter3", "open sesame", "BEGIN"} {
+		if strings.Contains(line, secret) {
+			t.Errorf("Logged %q: %s", secret, line)
+		}
+	}
+	for _, want := range []string{"config.protocol=ssh", "config.parameters.hostname=example", "config.parameters.password=********"} {
+		if !strings.Contains(line, want) {
+			t.Errorf("Expected %s in %s", want, line)
+		}
+	}
+	if config.Parameters["password"] != "hunter2" {
+		t.Error("Logging changed the config")
+	}
+}
+
+func TestConfig_LogValue_Keys(t *testing.T) {
+	config := NewGuacamoleConfiguration()
+	config.Protocol = "kubernetes"
+	config.Parameters = map[string]string{
+		"sftp-private-key": "-----BEGIN RSA",
+		"client-key":       "-----BEGIN EC",
+		"client-cert":      "-----BEGIN CERTIFICATE",
+		"color-scheme":     "gray-black",
+	}
+
+	var buf bytes.Buffer
+	slog.New(slog.NewTextHandler(&buf, nil)).Info("connect", "config", config)
+	line := buf.String()
+
+	for _, want := range []string{
+		"config.parameters.sftp-private-key=********",
+		"config.parameters.client-key=********",
+		`config.parameters.client-cert="-----BEGIN CERTIFICATE"`,
+		"config.parameters.color-scheme=gray-black",
+	} {
+		if !strings.Contains(line, want) {
+			t.Errorf("Expected %s in %s", want, line)
+		}
+	}
+	for _, secret := range []string{"BEGIN RSA", "BEGIN EC"} {
+		if strings.Contains(line, secret) {
+			t.Errorf("Logged %q: %s", secret, line)
+		}
+	}
+}
+
+func TestServer_Logger(t *testing.T) {
+	var buf bytes.Buffer
+	s, guacd := newPipeServer(t)
+	s.Logger = slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	s.User = func(r *http.Request) string { return "alice" }
+
+	rec := serve(s, http.MethodPost, "connect", "", "")
+	uuid, token := rec.Body.String(), rec.Header().Get(TunnelTokenHeader)
+	_ = guacd.Close()
+	serve(s, http.MethodGet, "read:"+uuid+":0", token, "")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) < 2 {
+		t.Fatalf("Expected the tunnel to be registered and deregistered, got %q", lines)
+	}
+	for _, line := range lines {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry[logTunnelUUID] != uuid || entry[logUser] != "alice" {
+			t.Errorf("Log line missing session fields: %s", line)
+		}
+		if _, ok := entry[logConnectionID]; !ok {
+			t.Errorf("Log line missing the connection ID: %s", line)
+		}
+	}
+}
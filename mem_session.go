@@ -6,7 +6,7 @@ import (
 )
 
 // MemorySessionStore is a simple in-memory store of connected sessions that is used by
-// the WebsocketServer to store active sessions.
+// the WebsocketServer and Server to store active sessions.
 type MemorySessionStore struct {
 	sync.RWMutex
 	ConnIds map[string]int
@@ -0,0 +1,135 @@
+package guac
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Transports label the active tunnels metric
+const (
+	transportHTTP      = "http"
+	transportWebsocket = "websocket"
+)
+
+// durationBuckets are the upper bounds in seconds of the duration histograms
+var durationBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metrics are recorded by the servers, streams and tunnel maps of the package and collected through Metrics.
+var metrics = newMetricSet()
+
+type metricSet struct {
+	tunnelsActive     *prometheus.GaugeVec
+	handshakeDuration prometheus.Histogram
+	handshakeFailures *prometheus.CounterVec
+	tunnelExpired     prometheus.Counter
+	bytes             *prometheus.CounterVec
+	websocketCloses   *prometheus.CounterVec
+	lockWait          prometheus.Histogram
+	bytesToClient     prometheus.Counter
+	bytesToGuacd      prometheus.Counter
+
+	collectors []prometheus.Collector
+}
+
+func newMetricSet() *metricSet {
+	m := &metricSet{
+		tunnelsActive: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "guac_tunnels_active",
+			Help: "Open tunnels by transport and protocol.",
+		}, []string{"transport", "protocol"}),
+		handshakeDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "guac_handshake_duration_seconds",
+			Help:    "Duration of guacd handshakes.",
+			Buckets: durationBuckets,
+		}),
+		handshakeFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "guac_handshake_failures_total",
+			Help: "Failed guacd handshakes by status.",
+		}, []string{"status"}),
+		tunnelExpired: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "guac_tunnel_expirations_total",
+			Help: "HTTP tunnels closed because the client stopped polling.",
+		}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "guac_bytes_total",
+			Help: "Bytes through tunnels by direction.",
+		}, []string{"direction"}),
+		websocketCloses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "guac_websocket_closes_total",
+			Help: "WebSocket closes by code and which side closed.",
+		}, []string{"code", "side"}),
+		lockWait: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "guac_lock_wait_seconds",
+			Help:    "Time spent waiting for tunnel reader and writer locks.",
+			Buckets: durationBuckets,
+		}),
+	}
+	m.bytesToClient = m.bytes.WithLabelValues(directionToClient)
+	m.bytesToGuacd = m.bytes.WithLabelValues(directionToGuacd)
+	m.collectors = []prometheus.Collector{
+		m.tunnelsActive, m.handshakeDuration, m.handshakeFailures, m.tunnelExpired, m.bytes,
+		m.websocketCloses, m.lockWait,
+	}
+	return m
+}
+
+// Describe implements prometheus.Collector
+func (m *metricSet) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range m.collectors {
+		c.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector
+func (m *metricSet) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range m.collectors {
+		c.Collect(ch)
+	}
+}
+
+// tunnelOpened counts an open tunnel, returning a func which counts it closed.
+func (m *metricSet) tunnelOpened(transport string, tunnel Tunnel) func() {
+	protocol := protocolOf(tunnel)
+	if protocol == "" {
+		protocol = "unknown"
+	}
+	active := m.tunnelsActive.WithLabelValues(transport, protocol)
+	active.Inc()
+	return active.Dec
+}
+
+// handshakeDone records a handshake which took d and ended with err.
+func (m *metricSet) handshakeDone(d time.Duration, err error) {
+	m.handshakeDuration.Observe(d.Seconds())
+	if err != nil {
+		status := guacErrorOf(err, ErrServer).Status
+		m.handshakeFailures.WithLabelValues(status.String()).Inc()
+	}
+}
+
+// websocketClosed counts a WebSocket close with the code, sent by the server or the client.
+func (m *metricSet) websocketClosed(code int, side string) {
+	m.websocketCloses.WithLabelValues(strconv.Itoa(code), side).Inc()
+}
+
+// Metrics returns the collector of the metrics of every server, stream and tunnel map in the process, to
+// register with a Prometheus registry:
+//
+//	prometheus.MustRegister(guac.Metrics())
+func Metrics() prometheus.Collector {
+	return metrics
+}
+
+// MetricsHandler serves the metrics of every server on a registry of their own, for programs which don't
+// otherwise use Prometheus:
+//
+//	mux.Handle("/metrics", guac.MetricsHandler())
+func MetricsHandler() http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metrics)
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,89 @@
+package guac
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics_Register(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(Metrics()); err != nil {
+		t.Fatal(err)
+	}
+	metrics.lockWait.Observe(0)
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[string]bool{}
+	for _, family := range families {
+		found[family.GetName()] = true
+	}
+	for _, name := range []string{"guac_handshake_duration_seconds", "guac_tunnel_expirations_total", "guac_lock_wait_seconds"} {
+		if !found[name] {
+			t.Errorf("Expected %s among the metrics gathered", name)
+		}
+	}
+
+	// the same metrics can't be registered twice
+	if err = registry.Register(Metrics()); err == nil {
+		t.Error("Expected registering twice to fail")
+	}
+}
+
+func TestStream_Handshake_Metrics(t *testing.T) {
+	failures := metrics.handshakeFailures.WithLabelValues(UpstreamNotFound.String())
+	before := testutil.ToFloat64(failures)
+
+	stream := NewStream(&fakeConn{ToRead: []byte("5.error,7.Failed.,3.519;")}, time.Minute)
+	if err := stream.Handshake(NewGuacamoleConfiguration()); err == nil {
+		t.Fatal("Expected the handshake to fail")
+	}
+
+	if got := testutil.ToFloat64(failures) - before; got != 1 {
+		t.Error("Expected 1 handshake failure recorded, got", got)
+	}
+}
+
+func TestServer_Metrics(t *testing.T) {
+	active := metrics.tunnelsActive.WithLabelValues(transportHTTP, "unknown")
+	activeBefore := testutil.ToFloat64(active)
+	expiredBefore := testutil.ToFloat64(metrics.tunnelExpired)
+
+	s, _ := newPipeServer(t)
+	serve(s, http.MethodPost, "connect", "", "")
+	if got := testutil.ToFloat64(active) - activeBefore; got != 1 {
+		t.Error("Expected 1 more active tunnel, got", got)
+	}
+
+	s.tunnels.tunnelTimeout = 0
+	s.tunnels.tunnelTimeoutTaskRun()
+	if got := testutil.ToFloat64(active) - activeBefore; got != 0 {
+		t.Error("Expected the expired tunnel to be inactive, got", got)
+	}
+	if got := testutil.ToFloat64(metrics.tunnelExpired) - expiredBefore; got != 1 {
+		t.Error("Expected 1 expiration, got", got)
+	}
+
+	rec := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	for _, name := range []string{
+		`guac_tunnels_active{protocol="unknown",transport="http"}`,
+		"guac_handshake_duration_seconds_count",
+		"guac_tunnel_expirations_total",
+		`guac_bytes_total{direction="to_client"}`,
+		"guac_lock_wait_seconds_bucket",
+	} {
+		if !strings.Contains(body, name) {
+			t.Errorf("Expected %s in the metrics", name)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package guac
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket limiting bandwidth in bytes per second. A limiter may be shared by several
+// tunnels, e.g. all the tunnels of one user, and its limit changed while they are open.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+// NewRateLimiter creates a limiter allowing bytesPerSecond on average and bursts of up to burst bytes.
+// A bytesPerSecond of zero or less means no limit.
+func NewRateLimiter(bytesPerSecond, burst int) *RateLimiter {
+	l := &RateLimiter{now: time.Now}
+	l.SetLimit(bytesPerSecond, burst)
+	l.tokens = l.burst
+	return l
+}
+
+// SetLimit changes the limit, taking effect for the next instruction.
+func (l *RateLimiter) SetLimit(bytesPerSecond, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill()
+	l.rate = float64(bytesPerSecond)
+	l.burst = float64(burst)
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+}
+
+// Limit returns the current limit.
+func (l *RateLimiter) Limit() (bytesPerSecond, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.rate), int(l.burst)
+}
+
+// reserve takes n bytes from the bucket and returns how long to wait before sending them. Instructions larger
+// than the burst are let through once the bucket has paid for them.
+func (l *RateLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+	l.refill()
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+func (l *RateLimiter) refill() {
+	now := l.now()
+	if !l.last.IsZero() && l.rate > 0 {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+}
+
+// RateLimits configures the bandwidth of a RateLimitedTunnel. Every limiter in a direction applies, so a
+// tunnel may have its own limiter alongside one shared with the other tunnels of its user.
+type RateLimits struct {
+	// ToClient limits the instructions read from guacd.
+	ToClient []*RateLimiter
+	// ToGuacd limits the instructions written to guacd.
+	ToGuacd []*RateLimiter
+}
+
+// reserveAll reserves n bytes from each limiter and returns how long to wait until all of them allow it.
+func reserveAll(limiters []*RateLimiter, n int) (delay time.Duration) {
+	for _, limiter := range limiters {
+		if d := limiter.reserve(n); d > delay {
+			delay = d
+		}
+	}
+	return
+}
+
+// sleep waits for the delay, returning false if done is closed first.
+func sleep(delay time.Duration, done <-chan struct{}) bool {
+	if delay <= 0 {
+		return true
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// RateLimitedTunnel limits the bandwidth of a tunnel in both directions. Limits apply at instruction
+// boundaries: an instruction is passed on whole once the limiters allow it. Return one from the connect
+// callback to limit a session:
+//
+//	return guac.NewRateLimitedTunnel(tunnel, guac.RateLimits{
+//		ToClient: []*guac.RateLimiter{sessionLimit, userLimits[user]},
+//	}), nil
+type RateLimitedTunnel struct {
+	Tunnel
+	// TunnelCloser records why the tunnel was closed, whether or not the tunnel does so itself.
+	TunnelCloser
+
+	mu     sync.RWMutex
+	limits RateLimits
+}
+
+// NewRateLimitedTunnel wraps the tunnel with the limits.
+func NewRateLimitedTunnel(tunnel Tunnel, limits RateLimits) *RateLimitedTunnel {
+	return &RateLimitedTunnel{
+		Tunnel:       tunnel,
+		TunnelCloser: closerOf(tunnel),
+		limits:       limits,
+	}
+}
+
+// Close closes the tunnel as if it ended normally
+func (t *RateLimitedTunnel) Close() error {
+	return t.CloseWithReason(closedNormally)
+}
+
+// Protocol returns the protocol of the tunnel's guacd connection, if the tunnel knows it
+func (t *RateLimitedTunnel) Protocol() string {
+	return protocolOf(t.Tunnel)
+}
+
+// Stats returns the traffic through the tunnel so far, none if the tunnel doesn't count it
+func (t *RateLimitedTunnel) Stats() TunnelStats {
+	return statsOf(t.Tunnel)
+}
+
+// SetLimits replaces the limiters of the tunnel, taking effect for the next instruction.
+func (t *RateLimitedTunnel) SetLimits(limits RateLimits) {
+	t.mu.Lock()
+	t.limits = limits
+	t.mu.Unlock()
+}
+
+// Limits returns the limiters of the tunnel.
+func (t *RateLimitedTunnel) Limits() RateLimits {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.limits
+}
+
+// AcquireReader acquires the reader of the tunnel, limiting the instructions read from it
+func (t *RateLimitedTunnel) AcquireReader() InstructionReader {
+	return &rateLimitedReader{
+		InstructionReader: t.Tunnel.AcquireReader(),
+		tunnel:            t,
+	}
+}
+
+// AcquireWriter acquires the writer of the tunnel, limiting the instructions written to it
+func (t *RateLimitedTunnel) AcquireWriter() io.Writer {
+	return &rateLimitedWriter{
+		w:      t.Tunnel.AcquireWriter(),
+		tunnel: t,
+	}
+}
+
+type rateLimitedReader struct {
+	InstructionReader
+	tunnel *RateLimitedTunnel
+}
+
+// ReadSome returns the next instruction once the limiters allow it
+func (r *rateLimitedReader) ReadSome() ([]byte, error) {
+	return copied(r.ReadSomeNoCopy())
+}
+
+// ReadSomeNoCopy returns the next instruction once the limiters allow it, without copying it
+func (r *rateLimitedReader) ReadSomeNoCopy() ([]byte, error) {
+	ins, err := readSomeNoCopy(r.InstructionReader)
+	if err != nil {
+		return ins, err
+	}
+	if !sleep(reserveAll(r.tunnel.Limits().ToClient, len(ins)), r.tunnel.Done()) {
+		return nil, ErrConnectionClosed.NewError("Tunnel closed.")
+	}
+	return ins, nil
+}
+
+type rateLimitedWriter struct {
+	w        io.Writer
+	tunnel   *RateLimitedTunnel
+	splitter instructionSplitter
+}
+
+// Write passes on each instruction in p once the limiters allow it. Instructions which are allowed straight
+// away are written together, and an instruction split across writes is passed on once complete.
+func (w *rateLimitedWriter) Write(p []byte) (int, error) {
+	limiters := w.tunnel.Limits().ToGuacd
+	bufp := getBuffer()
+	defer putBuffer(bufp)
+
+	err := w.splitter.split(p, func(ins []byte) error {
+		if delay := reserveAll(limiters, len(ins)); delay > 0 {
+			// send what is already allowed before waiting
+			if err := w.flush(bufp); err != nil {
+				return err
+			}
+			if !sleep(delay, w.tunnel.Done()) {
+				return ErrConnectionClosed.NewError("Tunnel closed.")
+			}
+		}
+		*bufp = append(*bufp, ins...)
+		return nil
+	})
+	if err == nil {
+		err = w.flush(bufp)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *rateLimitedWriter) flush(bufp *[]byte) error {
+	if len(*bufp) == 0 {
+		return nil
+	}
+	_, err := w.w.Write(*bufp)
+	*bufp = (*bufp)[:0]
+	return err
+}
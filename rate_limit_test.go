@@ -0,0 +1,143 @@
+package guac
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_Reserve(t *testing.T) {
+	l := NewRateLimiter(1000, 500)
+	now := l.last
+	l.now = func() time.Time { return now }
+
+	if d := l.reserve(500); d != 0 {
+		t.Error("Expected the burst to pass straight away, waited", d)
+	}
+	if d := l.reserve(100); d != 100*time.Millisecond {
+		t.Error("Expected to wait 100ms, waited", d)
+	}
+	now = now.Add(time.Second)
+	// the bucket refills up to the burst, less what was owed
+	if d := l.reserve(400); d != 0 {
+		t.Error("Expected no wait after refilling, waited", d)
+	}
+
+	l.SetLimit(100, 100)
+	if rate, burst := l.Limit(); rate != 100 || burst != 100 {
+		t.Error("Unexpected limit", rate, burst)
+	}
+	// 100 bytes are left from the burst
+	if d := l.reserve(200); d != time.Second {
+		t.Error("Expected the new limit to apply, waited", d)
+	}
+
+	l.SetLimit(0, 0)
+	if d := l.reserve(1 << 20); d != 0 {
+		t.Error("Expected no limit, waited", d)
+	}
+}
+
+func TestRateLimitedTunnel_Reader(t *testing.T) {
+	const ins = "4.sync,3.100;"
+	conn := &repeatConn{data: []byte(ins)}
+	limiter := NewRateLimiter(len(ins)*100, len(ins))
+	tunnel := NewRateLimitedTunnel(NewSimpleTunnel(NewStream(conn, time.Minute)), RateLimits{
+		ToClient: []*RateLimiter{limiter},
+	})
+	reader := tunnel.AcquireReader()
+
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		got, err := reader.ReadSome()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != ins {
+			t.Fatalf("Unexpected instruction %q", got)
+		}
+	}
+	// the first instruction uses the burst, the other five wait 10ms each
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Error("Reads not limited, took", elapsed)
+	}
+
+	// lifting the limit at runtime lets reads through straight away
+	limiter.SetLimit(0, 0)
+	start = time.Now()
+	for i := 0; i < 100; i++ {
+		if _, err := reader.ReadSome(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 40*time.Millisecond {
+		t.Error("Reads still limited, took", elapsed)
+	}
+}
+
+func TestRateLimitedTunnel_CloseWhileWaiting(t *testing.T) {
+	conn := &repeatConn{data: []byte("4.sync,3.100;")}
+	tunnel := NewRateLimitedTunnel(NewSimpleTunnel(NewStream(conn, time.Minute)), RateLimits{
+		ToClient: []*RateLimiter{NewRateLimiter(1, 1)},
+	})
+	reader := tunnel.AcquireReader()
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		_ = tunnel.Close()
+	}()
+	_, err := reader.ReadSome()
+	if !errors.Is(err, ErrConnectionClosed) {
+		t.Error("Expected the read to end with the tunnel, got", err)
+	}
+}
+
+func TestRateLimitedTunnel_Writer(t *testing.T) {
+	guacd, client := net.Pipe()
+	defer guacd.Close()
+	written := make(chan []byte, 16)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := guacd.Read(buf)
+			if err != nil {
+				close(written)
+				return
+			}
+			written <- append([]byte(nil), buf[:n]...)
+		}
+	}()
+
+	const key = "3.key,5.65307,1.1;"
+	tunnel := NewRateLimitedTunnel(NewSimpleTunnel(NewStream(client, time.Minute)), RateLimits{
+		ToGuacd: []*RateLimiter{NewRateLimiter(len(key)*100, len(key)*2)},
+	})
+	writer := tunnel.AcquireWriter()
+
+	// three instructions, the last split across writes: two fit the burst and go together, the third waits
+	start := time.Now()
+	data := []byte(key + key + key)
+	if _, err := writer.Write(data[:len(data)-4]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.Write(data[len(data)-4:]); err != nil {
+		t.Fatal(err)
+	}
+	_ = tunnel.Close()
+
+	var got [][]byte
+	for w := range written {
+		got = append(got, w)
+	}
+	if len(got) != 2 || string(got[0]) != key+key || string(got[1]) != key {
+		t.Errorf("Unexpected writes %q", got)
+	}
+	if !bytes.Equal(bytes.Join(got, nil), data) {
+		t.Error("Writes don't add up to the data")
+	}
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Error("Writes not limited, took", elapsed)
+	}
+}
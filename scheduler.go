@@ -0,0 +1,238 @@
+package guac
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// DefaultStreamQueueSize is how many bytes of stream data, such as an upload, may wait behind interactive
+// input on the way to guacd before writers block.
+const DefaultStreamQueueSize = 1024 * 1024
+
+// inputOpcodes prefix the instructions which overtake stream data on the way to guacd. sync acknowledges
+// frames, so holding it back would make guacd throttle the display as if the client were lagging.
+var inputOpcodes = [][]byte{
+	[]byte("3.key,"),
+	[]byte("5.mouse,"),
+	[]byte("5.touch,"),
+	[]byte("4.sync,"),
+}
+
+// isInput returns true if the instruction is interactive input.
+func isInput(ins []byte) bool {
+	for _, opcode := range inputOpcodes {
+		if bytes.HasPrefix(ins, opcode) {
+			return true
+		}
+	}
+	return false
+}
+
+// instructionSplitter takes data written in arbitrary pieces, such as the body of an HTTP tunnel write, and
+// passes on whole instructions.
+type instructionSplitter struct {
+	// the start of an instruction split across writes is held here until the rest arrives
+	partial *[]byte
+	resume  int
+}
+
+// split calls fn with each instruction completed by p. fn must not keep the slice.
+func (s *instructionSplitter) split(p []byte, fn func(ins []byte) error) error {
+	if s.partial != nil {
+		*s.partial = append(*s.partial, p...)
+		buf := *s.partial
+		n, resume, err := scanInstruction(buf, s.resume)
+		if err != nil {
+			return ErrClient.Wrap(err, "Invalid instruction from client.")
+		}
+		if n == 0 {
+			s.resume = resume
+			return nil
+		}
+		if err = fn(buf[:n]); err != nil {
+			return err
+		}
+		// the rest of p follows the completed instruction
+		p = p[len(p)-(len(buf)-n):]
+		putBuffer(s.partial)
+		s.partial, s.resume = nil, 0
+	}
+
+	for len(p) > 0 {
+		n, resume, err := scanInstruction(p, 0)
+		if err != nil {
+			return ErrClient.Wrap(err, "Invalid instruction from client.")
+		}
+		if n == 0 {
+			s.partial = getBuffer()
+			*s.partial = append(*s.partial, p...)
+			s.resume = resume
+			return nil
+		}
+		if err = fn(p[:n]); err != nil {
+			return err
+		}
+		p = p[n:]
+	}
+	return nil
+}
+
+// release returns the held partial instruction, if any, to the pool.
+func (s *instructionSplitter) release() {
+	if s.partial != nil {
+		putBuffer(s.partial)
+		s.partial, s.resume = nil, 0
+	}
+}
+
+// inputScheduler is the write path to guacd. It lets interactive input overtake queued stream data at
+// instruction boundaries, so a large upload doesn't freeze the session. Instructions are written from its own
+// goroutine, input first, otherwise in the order they were written. Only one goroutine may call Write.
+type inputScheduler struct {
+	w        io.Writer
+	splitter instructionSplitter
+	maxQueue int
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	input     [][]byte
+	queue     [][]byte
+	queueSize int
+	closed    bool
+	err       error
+	done      chan struct{}
+}
+
+func newInputScheduler(w io.Writer, maxQueue int) *inputScheduler {
+	if maxQueue <= 0 {
+		maxQueue = DefaultStreamQueueSize
+	}
+	s := &inputScheduler{
+		w:        w,
+		maxQueue: maxQueue,
+		done:     make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	go s.run()
+	return s
+}
+
+// Write queues the instructions in p, blocking while the stream data queue is full. An instruction split
+// across writes is queued once it is complete. Errors writing to guacd are returned by later calls.
+func (s *inputScheduler) Write(p []byte) (int, error) {
+	if err := s.splitter.split(p, s.enqueue); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *inputScheduler) enqueue(ins []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if isInput(ins) {
+		if s.err != nil {
+			return s.err
+		}
+		s.input = append(s.input, append([]byte(nil), ins...))
+	} else {
+		// wait for room, though one instruction is always let through
+		for s.err == nil && s.queueSize > 0 && s.queueSize+len(ins) > s.maxQueue {
+			s.cond.Wait()
+		}
+		if s.err != nil {
+			return s.err
+		}
+		s.queue = append(s.queue, append([]byte(nil), ins...))
+		s.queueSize += len(ins)
+	}
+	s.cond.Broadcast()
+	return nil
+}
+
+// inject queues a complete instruction from a goroutine other than the one calling Write, such as an ack
+// for guacd sent while reading from it.
+func (s *inputScheduler) inject(ins []byte) error {
+	s.mu.Lock()
+	closed := s.closed
+	s.mu.Unlock()
+	if closed {
+		return ErrConnectionClosed.NewError("Connection to guacd is closed.")
+	}
+	return s.enqueue(ins)
+}
+
+// Close writes whatever is queued, then stops. It returns the first error writing to guacd, or an error if the
+// last instruction written was incomplete.
+func (s *inputScheduler) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	<-s.done
+	if s.err == nil && s.splitter.partial != nil {
+		s.err = ErrClient.NewError("Incomplete instruction from client.")
+	}
+	s.splitter.release()
+	return s.err
+}
+
+func (s *inputScheduler) run() {
+	defer close(s.done)
+
+	for {
+		bufp := getBuffer()
+		if !s.next(bufp) {
+			putBuffer(bufp)
+			return
+		}
+		_, err := s.w.Write(*bufp)
+		putBuffer(bufp)
+		if err != nil {
+			s.fail(err)
+			return
+		}
+	}
+}
+
+// next waits for instructions to write and appends them to bufp: all the queued input if there is any,
+// otherwise stream data up to MaxGuacMessage bytes. It returns false once closed and drained.
+func (s *inputScheduler) next(bufp *[]byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(s.input) == 0 && len(s.queue) == 0 && !s.closed {
+		s.cond.Wait()
+	}
+	if len(s.input) > 0 {
+		for _, ins := range s.input {
+			*bufp = append(*bufp, ins...)
+		}
+		s.input = s.input[:0]
+		return true
+	}
+	if len(s.queue) == 0 {
+		return false
+	}
+	n := 0
+	for ; n < len(s.queue) && (n == 0 || len(*bufp)+len(s.queue[n]) <= MaxGuacMessage); n++ {
+		*bufp = append(*bufp, s.queue[n]...)
+		s.queueSize -= len(s.queue[n])
+		s.queue[n] = nil
+	}
+	s.queue = s.queue[n:]
+	s.cond.Broadcast()
+	return true
+}
+
+// fail records the error and discards the queued instructions, releasing any blocked writer.
+func (s *inputScheduler) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.err = err
+	s.input, s.queue, s.queueSize = nil, nil, 0
+	s.cond.Broadcast()
+}
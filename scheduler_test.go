@@ -0,0 +1,159 @@
+package guac
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInstructionSplitter(t *testing.T) {
+	instructions := []string{"4.sync,1.0;", "3.key,5.65307,1.1;", "9.clipboard,1.2,10.text/plain;", "4.blob,1.2,2.🚀é;", "3.end,1.2;"}
+	data := []byte(strings.Join(instructions, ""))
+
+	for size := 1; size <= len(data); size++ {
+		var splitter instructionSplitter
+		var got []string
+		for p := data; len(p) > 0; {
+			n := size
+			if n > len(p) {
+				n = len(p)
+			}
+			err := splitter.split(p[:n], func(ins []byte) error {
+				got = append(got, string(ins))
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("chunk size %d: %v", size, err)
+			}
+			p = p[n:]
+		}
+		if strings.Join(got, "|") != strings.Join(instructions, "|") {
+			t.Fatalf("chunk size %d: got %q", size, got)
+		}
+		if splitter.partial != nil {
+			t.Fatalf("chunk size %d: partial instruction left over", size)
+		}
+	}
+}
+
+func TestInstructionSplitter_Invalid(t *testing.T) {
+	var splitter instructionSplitter
+	err := splitter.split([]byte("4.sync,1.0;x.bad;"), func(ins []byte) error { return nil })
+	if !errors.Is(err, ErrClient) {
+		t.Error("Expected ErrClient, got", err)
+	}
+}
+
+// slowWriter stands in for guacd reading slowly, as it does while forwarding an upload.
+type slowWriter struct {
+	delay  time.Duration
+	mu     sync.Mutex
+	writes []string
+	keyAt  time.Time
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(w.delay)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.writes = append(w.writes, string(p))
+	if bytes.Contains(p, []byte("3.key,")) && w.keyAt.IsZero() {
+		w.keyAt = time.Now()
+	}
+	return len(p), nil
+}
+
+func TestInputScheduler_InputOvertakesUpload(t *testing.T) {
+	const blobs = 100
+	w := &slowWriter{delay: 2 * time.Millisecond}
+	scheduler := newInputScheduler(w, 0)
+
+	blob := NewInstruction("blob", "2", strings.Repeat("A", 4096)).Byte()
+	for i := 0; i < blobs; i++ {
+		if _, err := scheduler.Write(blob); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sent := time.Now()
+	if _, err := scheduler.Write([]byte("3.key,5.65307,1.1;")); err != nil {
+		t.Fatal(err)
+	}
+	if err := scheduler.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The key waits for at most the write in progress, not the rest of the upload
+	keyWrite := -1
+	for i, write := range w.writes {
+		if strings.Contains(write, "3.key,") {
+			keyWrite = i
+		}
+	}
+	if keyWrite < 0 || keyWrite > 2 {
+		t.Errorf("Expected the key in one of the first writes, got write %d of %d", keyWrite, len(w.writes))
+	}
+	if latency := w.keyAt.Sub(sent); latency > 20*w.delay {
+		t.Error("Input latency not bounded during upload:", latency)
+	}
+	if got := strings.Count(strings.Join(w.writes, ""), "4.blob,"); got != blobs {
+		t.Errorf("Expected %d blobs written, got %d", blobs, got)
+	}
+}
+
+func TestInputScheduler_KeepsStreamOrder(t *testing.T) {
+	w := &slowWriter{}
+	scheduler := newInputScheduler(w, 16)
+
+	const stream = "3.put,1.2,10.text/plain,4.file;4.blob,1.2,4.AAAA;4.blob,1.2,4.BBBB;3.end,1.2;"
+	// written in pieces which split instructions, with a queue smaller than an instruction
+	for i := 0; i < len(stream); i += 5 {
+		end := i + 5
+		if end > len(stream) {
+			end = len(stream)
+		}
+		if _, err := scheduler.Write([]byte(stream[i:end])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := scheduler.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(w.writes, ""); got != stream {
+		t.Errorf("Unexpected data written %q", got)
+	}
+}
+
+// failingWriter fails every write.
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) { return 0, errors.New("broken pipe") }
+
+func TestInputScheduler_WriteError(t *testing.T) {
+	scheduler := newInputScheduler(failingWriter{}, 8)
+
+	// the queue fills once the first write fails, so writes must be released rather than block
+	var err error
+	for i := 0; i < 10 && err == nil; i++ {
+		_, err = scheduler.Write([]byte("4.blob,1.2,4.AAAA;"))
+		time.Sleep(time.Millisecond)
+	}
+	if err == nil || err.Error() != "broken pipe" {
+		t.Error("Expected the write error, got", err)
+	}
+	if err = scheduler.Close(); err == nil {
+		t.Error("Expected Close to return the write error")
+	}
+}
+
+func TestInputScheduler_IncompleteInstruction(t *testing.T) {
+	scheduler := newInputScheduler(&slowWriter{}, 0)
+	if _, err := scheduler.Write([]byte("4.sync,1.")); err != nil {
+		t.Fatal(err)
+	}
+	if err := scheduler.Close(); !errors.Is(err, ErrClient) {
+		t.Error("Expected ErrClient, got", err)
+	}
+}
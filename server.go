@@ -1,77 +1,274 @@
 package guac
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
-	logger "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
 	"io"
+	"log/slog"
 	"net/http"
 	"strings"
 )
 
 const (
-	readPrefix        string = "read:"
-	writePrefix       string = "write:"
-	readPrefixLength         = len(readPrefix)
-	writePrefixLength        = len(writePrefix)
-	uuidLength               = 36
+	readPrefix  string = "read:"
+	writePrefix string = "write:"
+	uuidLength         = 36
+
+	// TunnelTokenHeader is the header used by guacamole-common-js 1.5+ to carry the HTTP tunnel session token.
+	// The token is returned in the response to the connect request and must accompany every read and write.
+	TunnelTokenHeader = "Guacamole-Tunnel-Token"
+	tunnelTokenLength = 32
 )
 
 // Server uses HTTP requests to talk to guacd (as opposed to WebSockets in ws_server.go)
 type Server struct {
 	tunnels *TunnelMap
 	connect func(*http.Request) (Tunnel, error)
+
+	// OnConnect is an optional callback called when a tunnel is registered.
+	OnConnect func(string, *http.Request)
+	// OnDisconnect is an optional callback called when a tunnel is deregistered, whether it was closed,
+	// timed out or failed. The request is the one which originally connected the tunnel. If the
+	// tunnel is a StatsTunnel, its Stats are the traffic of the whole session.
+	OnDisconnect func(string, *http.Request, Tunnel)
+	// OnDisconnectReason is an optional callback like OnDisconnect which also receives the reason.
+	OnDisconnectReason func(string, *http.Request, Tunnel, DisconnectReason)
+
+	// Batching configures how guacd output is grouped into chunks of the read responses.
+	Batching OutputBatching
+
+	// Tracing configures the spans traced for each session.
+	Tracing Tracing
+
+	// Logger receives the server's logs, the default slog logger if nil. Logs about a tunnel carry its UUID,
+	// connection ID and user.
+	Logger *slog.Logger
+	// User is an optional callback returning the user making a request, for logs and audit events.
+	User func(*http.Request) string
+
+	// Auditor records the security-relevant events of each session, if set.
+	Auditor Auditor
+	// ClipboardPolicy optionally returns the policy restricting the clipboard of the session a connect request
+	// creates. The session's clipboard is unrestricted if it returns nil.
+	ClipboardPolicy func(*http.Request) *ClipboardPolicy
+	// DownloadPolicy optionally returns the policy restricting the files downloaded in the session a connect
+	// request creates. The session's downloads are unrestricted if it returns nil.
+	DownloadPolicy func(*http.Request) *DownloadPolicy
+	// Streams optionally serves the streams of the server's tunnels over plain HTTP.
+	Streams *StreamServer
+	// Clipboards optionally gives programs access to the clipboards of the server's tunnels.
+	Clipboards *Clipboards
+
+	// AllowMissingTunnelToken lets read and write requests without a tunnel token reach a tunnel by its UUID
+	// alone, for clients older than guacamole-common-js 1.5 which never send one. Anyone who learns a tunnel's
+	// UUID can then use it, so it is off by default.
+	AllowMissingTunnelToken bool
+
+	// StreamQueueSize is how many bytes of stream data in a write request, such as an upload, may wait behind
+	// its input on the way to guacd, DefaultStreamQueueSize if zero.
+	StreamQueueSize int
 }
 
 // NewServer constructor
 func NewServer(connect func(r *http.Request) (Tunnel, error)) *Server {
-	return &Server{
-		tunnels: NewTunnelMap(),
+	s := &Server{
 		connect: connect,
 	}
+	s.tunnels = newTunnelMap(func(tunnel *LastAccessedTunnel) {
+		s.disconnected(tunnel, DisconnectTimeout)
+	})
+	return s
 }
 
 // Registers the given tunnel such that future read/write requests to that tunnel will be properly directed.
-func (s *Server) registerTunnel(tunnel Tunnel) {
-	s.tunnels.Put(tunnel.GetUUID(), tunnel)
-	logger.Debugf("Registered tunnel %v.", tunnel.GetUUID())
+// The returned token must be presented by clients which send the tunnel token header. The session span is
+// ended when the tunnel is deregistered.
+func (s *Server) registerTunnel(tunnel Tunnel, request *http.Request, session trace.Span) (token string, err error) {
+	if token, err = newTunnelToken(); err != nil {
+		return
+	}
+	registered := NewLastAccessedTunnel(tunnel)
+	registered.token = token
+	registered.request = request
+	registered.closed = metrics.tunnelOpened(transportHTTP, tunnel)
+	registered.session = session
+	user := userOf(s.User, request)
+	registered.logger = sessionLogger(s.logger(), tunnel, user)
+	registered.auditor = newSessionAuditor(s.Auditor, registered.logger, transportHTTP, request, user, tunnel)
+	registered.filter = s.Streams.register(tunnel.GetUUID(), token, newTunnelFilter(
+		newClipboardFilter(policyOf(s.ClipboardPolicy, request), registered.logger, registered.auditor),
+		newDownloadFilter(policyOf(s.DownloadPolicy, request), registered.logger, downloadOf(tunnel, user)),
+	), registered.logger)
+	registered.filter = s.Clipboards.register(tunnel.GetUUID(), registered.filter, registered.logger)
+	registered.filter.setInject(registered.inject)
+	s.tunnels.put(tunnel.GetUUID(), &registered)
+	registered.logger.Debug("Registered tunnel")
+	registered.auditor.start()
+
+	if s.OnConnect != nil {
+		s.OnConnect(tunnel.ConnectionID(), request)
+	}
+	return
 }
 
 // Deregisters the given tunnel such that future read/write requests to that tunnel will be rejected.
-func (s *Server) deregisterTunnel(tunnel Tunnel) {
-	s.tunnels.Remove(tunnel.GetUUID())
-	logger.Debugf("Deregistered tunnel %v.", tunnel.GetUUID())
+// Disconnect callbacks are only called by the first deregistration of a tunnel.
+func (s *Server) deregisterTunnel(tunnel Tunnel, reason DisconnectReason) {
+	registered, ok := s.tunnels.Remove(tunnel.GetUUID())
+	if !ok {
+		return
+	}
+	s.loggerOf(registered).Debug("Deregistered tunnel", "reason", reason.String())
+	s.disconnected(registered, reason)
+}
+
+// closeTunnel closes and deregisters the tunnel. If the tunnel had already been closed, e.g. killed by the
+// application, the reason it was first closed for is the one reported.
+func (s *Server) closeTunnel(tunnel *LastAccessedTunnel, reason CloseReason) {
+	if err := tunnel.CloseWithReason(reason); err != nil {
+		s.loggerOf(tunnel).Debug("Error closing tunnel", "error", err)
+	}
+	s.deregisterTunnel(tunnel, tunnel.CloseReason().Cause)
+}
+
+// logger returns the server's logger
+func (s *Server) logger() *slog.Logger {
+	return loggerOr(s.Logger)
+}
+
+// loggerOf returns the logger of a registered tunnel, which carries the fields identifying its session.
+func (s *Server) loggerOf(tunnel Tunnel) *slog.Logger {
+	if registered, ok := tunnel.(*LastAccessedTunnel); ok && registered.logger != nil {
+		return registered.logger
+	}
+	return s.logger().With(slog.String(logTunnelUUID, tunnel.GetUUID()))
+}
+
+// requestLogger returns the logger of the tunnel a read or write request is for. An unknown tunnel is
+// identified by its UUID alone.
+func (s *Server) requestLogger(r *http.Request) *slog.Logger {
+	query := r.URL.RawQuery
+	tunnelUUID, ok := parseTunnelUUID(query, readPrefix)
+	if !ok {
+		tunnelUUID, ok = parseTunnelUUID(query, writePrefix)
+	}
+	if !ok {
+		return s.logger()
+	}
+	// looked up directly so that logging doesn't count as an access
+	s.tunnels.RLock()
+	tunnel := s.tunnels.tunnelMap[tunnelUUID]
+	s.tunnels.RUnlock()
+	if tunnel != nil && tunnel.logger != nil {
+		return tunnel.logger
+	}
+	return s.logger().With(slog.String(logTunnelUUID, tunnelUUID))
+}
+
+// disconnected calls the disconnect callbacks for a tunnel which is no longer registered.
+func (s *Server) disconnected(tunnel *LastAccessedTunnel, reason DisconnectReason) {
+	if tunnel.closed != nil {
+		tunnel.closed()
+	}
+	if tunnel.session != nil {
+		endSession(tunnel.session, tunnel.CloseReason())
+	}
+	tunnel.filter.end()
+	tunnel.auditor.end(tunnel.Tunnel, tunnel.CloseReason())
+	id := tunnel.ConnectionID()
+	if s.OnDisconnect != nil {
+		s.OnDisconnect(id, tunnel.request, tunnel.Tunnel)
+	}
+	if s.OnDisconnectReason != nil {
+		s.OnDisconnectReason(id, tunnel.request, tunnel.Tunnel, reason)
+	}
 }
 
-// Returns the tunnel with the given UUID.
-func (s *Server) getTunnel(tunnelUUID string) (ret Tunnel, err error) {
-	var ok bool
-	ret, ok = s.tunnels.Get(tunnelUUID)
+// Returns the tunnel with the given UUID. The request must carry the tunnel token issued when the tunnel was
+// registered, unless AllowMissingTunnelToken lets it leave the token out.
+func (s *Server) getTunnel(request *http.Request, tunnelUUID string) (ret *LastAccessedTunnel, err error) {
+	tunnel, ok := s.tunnels.Get(tunnelUUID)
+
+	if ok {
+		token := request.Header.Get(TunnelTokenHeader)
+		if missing := len(token) == 0 && s.AllowMissingTunnelToken; !missing && !tunnel.checkToken(token) {
+			tunnel.auditor.authFailed(request, userOf(s.User, request), "Invalid tunnel token.")
+			ok = false
+		}
+	}
 
 	if !ok {
 		err = ErrResourceNotFound.NewError("No such tunnel.")
+		return
 	}
+	ret = tunnel
 	return
 }
 
+// newTunnelToken generates a random token which authorizes HTTP requests to a tunnel.
+func newTunnelToken() (string, error) {
+	buf := make([]byte, tunnelTokenLength)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// parseTunnelUUID extracts the tunnel UUID from a read or write query. guacamole-common-js 1.5+ appends a
+// request sequence number to reads ("read:<uuid>:<n>") to defeat caching, which is accepted and ignored.
+func parseTunnelUUID(query, prefix string) (tunnelUUID string, ok bool) {
+	if !strings.HasPrefix(query, prefix) {
+		return
+	}
+	rest := query[len(prefix):]
+	if len(rest) < uuidLength {
+		return
+	}
+
+	tunnelUUID, rest = rest[:uuidLength], rest[uuidLength:]
+	if len(rest) == 0 {
+		return tunnelUUID, true
+	}
+
+	if rest[0] != ':' || len(rest) == 1 {
+		return "", false
+	}
+	for _, c := range rest[1:] {
+		if c < '0' || c > '9' {
+			return "", false
+		}
+	}
+	return tunnelUUID, true
+}
+
 func (s *Server) sendError(response http.ResponseWriter, guacStatus Status, message string) {
+	sendHTTPError(response, guacStatus, message)
+}
+
+// sendHTTPError responds with the status, and its code and the message in the headers the JavaScript client
+// reads.
+func sendHTTPError(response http.ResponseWriter, guacStatus Status, message string) {
 	response.Header().Set("Guacamole-Status-Code", fmt.Sprintf("%v", guacStatus.GetGuacamoleStatusCode()))
 	response.Header().Set("Guacamole-Error-Message", message)
 	response.WriteHeader(guacStatus.GetHTTPStatusCode())
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// taken first, as the request may deregister its tunnel
+	logger := s.requestLogger(r)
 	err := s.handleTunnelRequestCore(w, r)
 	if err == nil {
 		return
 	}
-	guacErr := err.(*ErrGuac)
-	switch guacErr.Kind {
-	case ErrClient:
-		logger.Warn("HTTP tunnel request rejected: ", err.Error())
+	guacErr := guacErrorOf(err, ErrServer)
+	switch {
+	case guacErr.Status.isClientError():
+		logger.Warn("HTTP tunnel request rejected", "error", err)
 		s.sendError(w, guacErr.Status, err.Error())
 	default:
-		logger.Error("HTTP tunnel request failed: ", err.Error())
-		logger.Debug("Internal error in HTTP tunnel.", err)
+		logger.Error("HTTP tunnel request failed", "error", err, "status", guacErr.Status.String())
 		s.sendError(w, guacErr.Status, "Internal server error.")
 	}
 	return
@@ -85,31 +282,47 @@ func (s *Server) handleTunnelRequestCore(response http.ResponseWriter, request *
 
 	// Call the supplied connect callback upon HTTP connect request
 	if query == "connect" {
-		tunnel, e := s.connect(request)
+		request, session := s.Tracing.startSession(request, transportHTTP)
+
+		// Callbacks may return an *ErrGuac to report a more specific status to the client
+		tunnel, e := traceConnect(request, s.connect)
 		if e != nil {
-			err = ErrResourceNotFound.NewError("No tunnel created.", e.Error())
+			guacErr := guacErrorOf(e, ErrResourceNotFound, "No tunnel created.")
+			auditConnectFailure(s.Auditor, s.logger(), transportHTTP, request, userOf(s.User, request), guacErr)
+			err = guacErr
+			endSpan(session, err)
 			return
 		}
+		session.SetAttributes(tunnelAttributes(tunnel)...)
 
-		s.registerTunnel(tunnel)
+		token, e := s.registerTunnel(tunnel, request, session)
+		if e != nil {
+			_ = tunnel.Close()
+			err = ErrServer.Wrap(e, "Unable to generate tunnel token.")
+			endSpan(session, err)
+			return
+		}
 
 		// Ensure buggy browsers do not cache response
 		response.Header().Set("Cache-Control", "no-cache")
 
+		// Newer clients refuse the tunnel unless a session token is issued
+		response.Header().Set(TunnelTokenHeader, token)
+
 		_, e = response.Write([]byte(tunnel.GetUUID()))
 
 		if e != nil {
-			err = ErrServer.NewError(e.Error())
+			err = ErrServer.Wrap(e)
 			return
 		}
 		return
 	}
 
 	// Connect has already been called so we use the UUID to do read and writes to the existing session
-	if strings.HasPrefix(query, readPrefix) && len(query) >= readPrefixLength+uuidLength {
-		err = s.doRead(response, request, query[readPrefixLength:readPrefixLength+uuidLength])
-	} else if strings.HasPrefix(query, writePrefix) && len(query) >= writePrefixLength+uuidLength {
-		err = s.doWrite(response, request, query[writePrefixLength:writePrefixLength+uuidLength])
+	if tunnelUUID, ok := parseTunnelUUID(query, readPrefix); ok {
+		err = s.doRead(response, request, tunnelUUID)
+	} else if tunnelUUID, ok := parseTunnelUUID(query, writePrefix); ok {
+		err = s.doWrite(response, request, tunnelUUID)
 	} else {
 		err = ErrClient.NewError("Invalid tunnel operation: " + query)
 	}
@@ -119,12 +332,12 @@ func (s *Server) handleTunnelRequestCore(response http.ResponseWriter, request *
 
 // doRead takes guacd messages and sends them in the response
 func (s *Server) doRead(response http.ResponseWriter, request *http.Request, tunnelUUID string) error {
-	tunnel, err := s.getTunnel(tunnelUUID)
+	tunnel, err := s.getTunnel(request, tunnelUUID)
 	if err != nil {
 		return err
 	}
 
-	reader := tunnel.AcquireReader()
+	reader := tunnel.filter.reader(tunnel.auditor.reader(tunnel.AcquireReader()))
 	defer tunnel.ReleaseReader()
 
 	// Note that although we are sending text, Webkit browsers will
@@ -144,21 +357,26 @@ func (s *Server) doRead(response http.ResponseWriter, request *http.Request, tun
 		return err
 	}
 
-	switch err.(*ErrGuac).Kind {
-	// Send end-of-stream marker and close tunnel if connection is closed
-	case ErrConnectionClosed:
-		s.deregisterTunnel(tunnel)
-		tunnel.Close()
+	s.closeTunnel(tunnel, closeReasonOf(err))
 
+	switch reason := tunnel.CloseReason(); reason.Cause {
+	// Send end-of-stream marker if connection is closed
+	case DisconnectClosed:
 		// End-of-instructions marker
 		_, _ = response.Write([]byte("0.;"))
 		if v, ok := response.(http.Flusher); ok {
 			v.Flush()
 		}
+	// Tell the client why the application closed the tunnel
+	case DisconnectKilled:
+		code := fmt.Sprintf("%v", reason.Status.GetGuacamoleStatusCode())
+		_, _ = NewInstruction("error", reason.Message, code).WriteTo(response)
+		_, _ = response.Write([]byte("0.;"))
+		if v, ok := response.(http.Flusher); ok {
+			v.Flush()
+		}
 	default:
-		logger.Debugln("Error writing to output", err)
-		s.deregisterTunnel(tunnel)
-		tunnel.Close()
+		s.loggerOf(tunnel).Debug("Error writing to output", "error", err)
 	}
 
 	return err
@@ -168,28 +386,39 @@ func (s *Server) doRead(response http.ResponseWriter, request *http.Request, tun
 func (s *Server) writeSome(response http.ResponseWriter, guacd InstructionReader, tunnel Tunnel) (err error) {
 	var message []byte
 
+	batch := newBatcher(s.Batching, func(data []byte) error {
+		if _, e := response.Write(data); e != nil {
+			return ErrOther.Wrap(e)
+		}
+		if v, ok := response.(http.Flusher); ok {
+			v.Flush()
+		}
+		return nil
+	})
+	defer batch.stop()
+
 	for {
-		message, err = guacd.ReadSome()
+		message, err = readSomeNoCopy(guacd)
 		if err != nil {
-			s.deregisterTunnel(tunnel)
-			tunnel.Close()
+			// doRead deregisters and closes the tunnel, after passing on what guacd sent before it went away
+			_ = batch.flush()
 			return
 		}
 
 		if len(message) == 0 {
-			return
+			return batch.flush()
 		}
 
-		_, e := response.Write(message)
-		if e != nil {
-			err = ErrOther.NewError(e.Error())
+		if err = batch.write(message, guacd.Available()); err != nil {
 			return
 		}
 
-		if !guacd.Available() {
-			if v, ok := response.(http.Flusher); ok {
-				v.Flush()
+		// guacd ends the session after an error instruction
+		if err = upstreamError(message); err != nil {
+			if e := batch.flush(); e != nil {
+				err = e
 			}
+			return
 		}
 
 		// No more messages another guacd can take over
@@ -199,18 +428,15 @@ func (s *Server) writeSome(response http.ResponseWriter, guacd InstructionReader
 	}
 
 	// End-of-instructions marker
-	if _, err = response.Write([]byte("0.;")); err != nil {
+	if err = batch.write([]byte("0.;"), true); err != nil {
 		return err
 	}
-	if v, ok := response.(http.Flusher); ok {
-		v.Flush()
-	}
-	return nil
+	return batch.flush()
 }
 
 // doWrite takes data from the request and sends it to guacd
 func (s *Server) doWrite(response http.ResponseWriter, request *http.Request, tunnelUUID string) error {
-	tunnel, err := s.getTunnel(tunnelUUID)
+	tunnel, err := s.getTunnel(request, tunnelUUID)
 	if err != nil {
 		return err
 	}
@@ -223,16 +449,19 @@ func (s *Server) doWrite(response http.ResponseWriter, request *http.Request, tu
 	response.Header().Set("Cache-Control", "no-cache")
 	response.Header().Set("Content-Length", "0")
 
-	writer := tunnel.AcquireWriter()
+	writer := tunnel.auditor.writer(tunnel.AcquireWriter())
 	defer tunnel.ReleaseWriter()
 
-	_, err = io.Copy(writer, request.Body)
+	// input in the request overtakes uploads on the way to guacd
+	input := tunnel.filter.writer(newInputScheduler(writer, s.StreamQueueSize))
+	_, err = io.Copy(input, request.Body)
+	if e := input.Close(); err == nil {
+		err = e
+	}
 
 	if err != nil {
-		s.deregisterTunnel(tunnel)
-		if err = tunnel.Close(); err != nil {
-			logger.Debug("Error closing tunnel")
-		}
+		err = guacErrorOf(err, ErrConnectionClosed, "I/O error sending data to server.")
+		s.closeTunnel(tunnel, CloseReason{Cause: DisconnectError, Status: ServerError, Message: err.Error()})
 	}
 
 	return err
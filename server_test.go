@@ -0,0 +1,396 @@
+package guac
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newPipeServer returns a Server whose tunnels talk to the returned connection as if it were guacd.
+func newPipeServer(t *testing.T) (*Server, net.Conn) {
+	guacd, client := net.Pipe()
+	s := NewServer(func(r *http.Request) (Tunnel, error) {
+		return NewSimpleTunnel(NewStream(client, time.Minute)), nil
+	})
+	t.Cleanup(func() {
+		s.tunnels.Shutdown()
+		_ = guacd.Close()
+	})
+	return s, guacd
+}
+
+func serve(s *Server, method, query, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/tunnel?"+query, strings.NewReader(body))
+	if len(token) > 0 {
+		req.Header.Set(TunnelTokenHeader, token)
+	}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	return rec
+}
+
+// TestServer_JSClientSequence replays the requests guacamole-common-js 1.5 makes over the HTTP tunnel.
+func TestServer_JSClientSequence(t *testing.T) {
+	s, guacd := newPipeServer(t)
+
+	// POST ?connect
+	rec := serve(s, http.MethodPost, "connect", "", "scheme=ssh&hostname=example")
+	if rec.Code != http.StatusOK {
+		t.Fatal("Unexpected connect status", rec.Code)
+	}
+	uuid := rec.Body.String()
+	token := rec.Header().Get(TunnelTokenHeader)
+	if len(uuid) != uuidLength {
+		t.Fatal("Unexpected tunnel UUID", uuid)
+	}
+	if len(token) == 0 {
+		t.Fatal("Expected a tunnel token header")
+	}
+
+	// POST ?write:<uuid> (the client's periodic nop)
+	written := make(chan string)
+	go func() {
+		buf := make([]byte, 64)
+		n, _ := guacd.Read(buf)
+		written <- string(buf[:n])
+	}()
+	if rec = serve(s, http.MethodPost, "write:"+uuid, token, "3.nop;"); rec.Code != http.StatusOK {
+		t.Fatal("Unexpected write status", rec.Code)
+	}
+	if got := <-written; got != "3.nop;" {
+		t.Error("Unexpected data written to guacd", got)
+	}
+
+	// GET ?read:<uuid>:0 streams until the next read request is queued behind it
+	first := httptest.NewRecorder()
+	firstDone := make(chan struct{})
+	go func() {
+		req := httptest.NewRequest(http.MethodGet, "/tunnel?read:"+uuid+":0", nil)
+		req.Header.Set(TunnelTokenHeader, token)
+		s.ServeHTTP(first, req)
+		close(firstDone)
+	}()
+	if _, err := guacd.Write([]byte("4.sync,1.0;")); err != nil {
+		t.Fatal(err)
+	}
+
+	// GET ?read:<uuid>:1 is made as soon as the first response starts, taking over once the first finishes
+	second := httptest.NewRecorder()
+	secondDone := make(chan struct{})
+	go func() {
+		req := httptest.NewRequest(http.MethodGet, "/tunnel?read:"+uuid+":1", nil)
+		req.Header.Set(TunnelTokenHeader, token)
+		s.ServeHTTP(second, req)
+		close(secondDone)
+	}()
+	tunnel, _ := s.tunnels.Get(uuid)
+	for !tunnel.HasQueuedReaderThreads() {
+		select {
+		case <-firstDone:
+		default:
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		break
+	}
+	if _, err := guacd.Write([]byte("4.sync,1.1;")); err != nil {
+		t.Fatal(err)
+	}
+	<-firstDone
+
+	_ = guacd.Close()
+	<-secondDone
+
+	// Each response ends with the end-of-instructions marker and together they carry everything guacd sent
+	for _, body := range []string{first.Body.String(), second.Body.String()} {
+		if !strings.HasSuffix(body, "0.;") {
+			t.Errorf("Expected response %q to end with the end-of-instructions marker", body)
+		}
+	}
+	got := strings.ReplaceAll(first.Body.String()+second.Body.String(), "0.;", "")
+	if want := "4.sync,1.0;4.sync,1.1;"; got != want {
+		t.Errorf("Unexpected instructions read %q, want %q", got, want)
+	}
+}
+
+func TestServer_TunnelToken(t *testing.T) {
+	s, _ := newPipeServer(t)
+
+	rec := serve(s, http.MethodPost, "connect", "", "")
+	uuid := rec.Body.String()
+
+	rec = serve(s, http.MethodPost, "write:"+uuid, "not-the-token", "3.nop;")
+	if rec.Code != http.StatusNotFound {
+		t.Error("Expected 404 for a mismatched token, got", rec.Code)
+	}
+	if got := rec.Header().Get("Guacamole-Status-Code"); got != "516" {
+		t.Error("Unexpected Guacamole-Status-Code", got)
+	}
+
+	// leaving the token out is no better
+	if rec = serve(s, http.MethodPost, "write:"+uuid, "", "3.nop;"); rec.Code != http.StatusNotFound {
+		t.Error("Expected 404 for a missing token, got", rec.Code)
+	}
+}
+
+func TestServer_AllowMissingTunnelToken(t *testing.T) {
+	s, guacd := newPipeServer(t)
+	s.AllowMissingTunnelToken = true
+	received := recordGuacd(guacd)
+
+	rec := serve(s, http.MethodPost, "connect", "", "")
+	uuid := rec.Body.String()
+
+	if rec = serve(s, http.MethodPost, "write:"+uuid, "", "3.nop;"); rec.Code != http.StatusOK {
+		t.Error("Expected a request without a token to be allowed, got", rec.Code)
+	}
+	received.wait(t, "3.nop;")
+	if rec = serve(s, http.MethodPost, "write:"+uuid, "not-the-token", "3.nop;"); rec.Code != http.StatusNotFound {
+		t.Error("Expected 404 for a mismatched token, got", rec.Code)
+	}
+}
+
+func TestParseTunnelUUID(t *testing.T) {
+	const uuid = "0d3a1f4e-7a6e-4a43-9c2b-43b0d8e4f7aa"
+
+	tests := []struct {
+		query string
+		ok    bool
+	}{
+		{"read:" + uuid, true},
+		{"read:" + uuid + ":0", true},
+		{"read:" + uuid + ":12345", true},
+		{"read:" + uuid + ":", false},
+		{"read:" + uuid + ":1a", false},
+		{"read:" + uuid + "junk", false},
+		{"read:" + uuid[:35], false},
+		{"write:" + uuid, false},
+	}
+
+	for _, test := range tests {
+		got, ok := parseTunnelUUID(test.query, readPrefix)
+		if ok != test.ok {
+			t.Errorf("%q: ok=%v, want %v", test.query, ok, test.ok)
+		}
+		if ok && got != uuid {
+			t.Errorf("%q: uuid=%q", test.query, got)
+		}
+	}
+}
+
+// disconnectRecorder collects the arguments of Server disconnect callbacks.
+type disconnectRecorder struct {
+	sync.Mutex
+	reasons []DisconnectReason
+}
+
+func (d *disconnectRecorder) record(id string, r *http.Request, tunnel Tunnel, reason DisconnectReason) {
+	d.Lock()
+	d.reasons = append(d.reasons, reason)
+	d.Unlock()
+}
+
+func (d *disconnectRecorder) get() []DisconnectReason {
+	d.Lock()
+	defer d.Unlock()
+	return append([]DisconnectReason(nil), d.reasons...)
+}
+
+func TestServer_Callbacks(t *testing.T) {
+	t.Run("Closed", func(t *testing.T) {
+		s, guacd := newPipeServer(t)
+		sessions := NewMemorySessionStore()
+		s.OnConnect = sessions.Add
+		s.OnDisconnect = sessions.Delete
+		disconnects := &disconnectRecorder{}
+		s.OnDisconnectReason = disconnects.record
+
+		rec := serve(s, http.MethodPost, "connect", "", "")
+		uuid, token := rec.Body.String(), rec.Header().Get(TunnelTokenHeader)
+		tunnel, _ := s.tunnels.Get(uuid)
+		if got := sessions.Get(tunnel.ConnectionID()); got != 1 {
+			t.Error("Expected 1 session, got", got)
+		}
+
+		_ = guacd.Close()
+		rec = serve(s, http.MethodGet, "read:"+uuid+":0", token, "")
+
+		if got := rec.Body.String(); got != "0.;" {
+			t.Errorf("Expected end-of-instructions marker, got %q", got)
+		}
+		if got := sessions.Get(tunnel.ConnectionID()); got != 0 {
+			t.Error("Expected 0 sessions, got", got)
+		}
+		if got := disconnects.get(); len(got) != 1 || got[0] != DisconnectClosed {
+			t.Error("Unexpected disconnect reasons", got)
+		}
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		s, _ := newPipeServer(t)
+		disconnects := &disconnectRecorder{}
+		s.OnDisconnectReason = disconnects.record
+
+		uuid := serve(s, http.MethodPost, "connect", "", "").Body.String()
+
+		s.tunnels.tunnelTimeout = 0
+		s.tunnels.tunnelTimeoutTaskRun()
+
+		if _, ok := s.tunnels.Get(uuid); ok {
+			t.Error("Expected tunnel to have expired")
+		}
+		if got := disconnects.get(); len(got) != 1 || got[0] != DisconnectTimeout {
+			t.Error("Unexpected disconnect reasons", got)
+		}
+	})
+
+	t.Run("WriteError", func(t *testing.T) {
+		s, guacd := newPipeServer(t)
+		disconnects := &disconnectRecorder{}
+		s.OnDisconnectReason = disconnects.record
+
+		rec := serve(s, http.MethodPost, "connect", "", "")
+		uuid, token := rec.Body.String(), rec.Header().Get(TunnelTokenHeader)
+
+		_ = guacd.Close()
+		serve(s, http.MethodPost, "write:"+uuid, token, "3.nop;")
+		serve(s, http.MethodPost, "write:"+uuid, token, "3.nop;")
+
+		if got := disconnects.get(); len(got) != 1 || got[0] != DisconnectError {
+			t.Error("Unexpected disconnect reasons", got)
+		}
+	})
+}
+
+func TestServer_Kill(t *testing.T) {
+	s, _ := newPipeServer(t)
+	disconnects := &disconnectRecorder{}
+	s.OnDisconnectReason = disconnects.record
+
+	rec := serve(s, http.MethodPost, "connect", "", "")
+	uuid, token := rec.Body.String(), rec.Header().Get(TunnelTokenHeader)
+	tunnel, _ := s.tunnels.Get(uuid)
+
+	_ = tunnel.CloseWithReason(CloseReason{Cause: DisconnectKilled, Status: SessionClosed, Message: "Killed by admin."})
+	rec = serve(s, http.MethodGet, "read:"+uuid+":0", token, "")
+
+	if got, want := rec.Body.String(), "5.error,16.Killed by admin.,3.523;0.;"; got != want {
+		t.Errorf("Unexpected response %q, want %q", got, want)
+	}
+	if got := disconnects.get(); len(got) != 1 || got[0] != DisconnectKilled {
+		t.Error("Unexpected disconnect reasons", got)
+	}
+}
+
+func TestServer_MinimalTunnel(t *testing.T) {
+	guacd, client := net.Pipe()
+	defer func() { _ = guacd.Close() }()
+	// a Tunnel implemented elsewhere may have none of the optional methods of SimpleTunnel
+	s := NewServer(func(r *http.Request) (Tunnel, error) {
+		return struct{ Tunnel }{NewSimpleTunnel(NewStream(client, time.Minute))}, nil
+	})
+	defer s.tunnels.Shutdown()
+	disconnects := &disconnectRecorder{}
+	s.OnDisconnectReason = disconnects.record
+
+	rec := serve(s, http.MethodPost, "connect", "", "")
+	uuid, token := rec.Body.String(), rec.Header().Get(TunnelTokenHeader)
+	tunnel, _ := s.tunnels.Get(uuid)
+
+	_ = tunnel.CloseWithReason(CloseReason{Cause: DisconnectKilled, Status: SessionClosed, Message: "Killed by admin."})
+	rec = serve(s, http.MethodGet, "read:"+uuid+":0", token, "")
+
+	if got, want := rec.Body.String(), "5.error,16.Killed by admin.,3.523;0.;"; got != want {
+		t.Errorf("Unexpected response %q, want %q", got, want)
+	}
+	if got := disconnects.get(); len(got) != 1 || got[0] != DisconnectKilled {
+		t.Error("Unexpected disconnect reasons", got)
+	}
+}
+
+func TestServer_GuacdError(t *testing.T) {
+	s, guacd := newPipeServer(t)
+	disconnects := &disconnectRecorder{}
+	s.OnDisconnectReason = disconnects.record
+
+	rec := serve(s, http.MethodPost, "connect", "", "")
+	uuid, token := rec.Body.String(), rec.Header().Get(TunnelTokenHeader)
+	tunnel, _ := s.tunnels.Get(uuid)
+
+	const errorIns = "5.error,10.Host down.,3.515;"
+	go func() { _, _ = guacd.Write([]byte(errorIns)) }()
+	rec = serve(s, http.MethodGet, "read:"+uuid+":0", token, "")
+
+	if got := rec.Body.String(); got != errorIns {
+		t.Errorf("Unexpected response %q, want %q", got, errorIns)
+	}
+	if got := disconnects.get(); len(got) != 1 || got[0] != DisconnectUpstream {
+		t.Error("Unexpected disconnect reasons", got)
+	}
+	if got := tunnel.CloseReason(); got.Status != UpstreamError {
+		t.Error("Unexpected close reason", got)
+	}
+}
+
+func TestServer_ConnectError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		httpStatus int
+		guacStatus string
+		message    string
+	}{
+		{"Unauthorized", ErrUnauthorized.NewError("Access denied."), 403, "769", "Access denied."},
+		{"Wrapped", fmt.Errorf("dialing: %w", ErrUpstreamNotFound.NewError("no route")), 502, "519", "Internal server error."},
+		{"Other", errors.New("boom"), 404, "516", "Internal server error."},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := NewServer(func(r *http.Request) (Tunnel, error) {
+				return nil, test.err
+			})
+			defer s.tunnels.Shutdown()
+
+			rec := serve(s, http.MethodPost, "connect", "", "")
+
+			if rec.Code != test.httpStatus {
+				t.Error("Unexpected HTTP status", rec.Code)
+			}
+			if got := rec.Header().Get("Guacamole-Status-Code"); got != test.guacStatus {
+				t.Error("Unexpected Guacamole-Status-Code", got)
+			}
+			if got := rec.Header().Get("Guacamole-Error-Message"); got != test.message {
+				t.Error("Unexpected Guacamole-Error-Message", got)
+			}
+		})
+	}
+}
+
+// errReader is an InstructionReader which always fails with a plain error.
+type errReader struct{}
+
+func (errReader) ReadSome() ([]byte, error) { return nil, errors.New("boom") }
+func (errReader) Available() bool           { return false }
+func (errReader) Flush()                    {}
+
+func TestServer_ServeHTTP_ForeignError(t *testing.T) {
+	const uuid = "0d3a1f4e-7a6e-4a43-9c2b-43b0d8e4f7aa"
+
+	s := NewServer(nil)
+	defer s.tunnels.Shutdown()
+	s.tunnels.Put(uuid, &fakeTunnel{reader: errReader{}})
+
+	// Must not panic on an error which is not an *ErrGuac
+	rec := serve(s, http.MethodGet, "read:"+uuid+":0", "", "")
+
+	if rec.Code != http.StatusOK {
+		t.Error("Expected the already started response to be kept, got", rec.Code)
+	}
+}
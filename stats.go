@@ -0,0 +1,245 @@
+package guac
+
+import (
+	"bytes"
+	"io"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// TrafficClass groups instructions for accounting.
+type TrafficClass int
+
+const (
+	// TrafficOther is everything not in another class, such as drawing, sync and acks
+	TrafficOther TrafficClass = iota
+	// TrafficImage is image data: img and video streams and the legacy png, jpeg and webp instructions
+	TrafficImage
+	// TrafficAudio is audio streams
+	TrafficAudio
+	// TrafficInput is key, mouse and touch events
+	TrafficInput
+	// TrafficFile is file transfers: file, put and body streams
+	TrafficFile
+
+	numTrafficClasses
+)
+
+// String returns the name of the class
+func (c TrafficClass) String() string {
+	switch c {
+	case TrafficOther:
+		return "other"
+	case TrafficImage:
+		return "image"
+	case TrafficAudio:
+		return "audio"
+	case TrafficInput:
+		return "input"
+	case TrafficFile:
+		return "file"
+	default:
+		return "unknown"
+	}
+}
+
+// TrafficCount counts the bytes and instructions sent
+type TrafficCount struct {
+	Bytes        int64
+	Instructions int64
+}
+
+// DirectionStats counts the traffic in one direction of a tunnel, in total and by class.
+type DirectionStats struct {
+	TrafficCount
+	ByClass map[TrafficClass]TrafficCount
+}
+
+// TunnelStats counts the traffic through a tunnel.
+type TunnelStats struct {
+	// ToClient is the traffic read from guacd
+	ToClient DirectionStats
+	// ToGuacd is the traffic written to guacd
+	ToGuacd DirectionStats
+}
+
+// StatsTunnel is implemented by tunnels which count their traffic, such as SimpleTunnel.
+type StatsTunnel interface {
+	// Stats returns the traffic through the tunnel so far
+	Stats() TunnelStats
+}
+
+// statsOf returns the traffic through the tunnel so far, or none if the tunnel doesn't count it.
+func statsOf(tunnel Tunnel) TunnelStats {
+	if counted, ok := tunnel.(StatsTunnel); ok {
+		return counted.Stats()
+	}
+	return TunnelStats{}
+}
+
+// instructionClasses maps opcodes which aren't part of a stream to their class
+var instructionClasses = map[string]TrafficClass{
+	"png":   TrafficImage,
+	"jpeg":  TrafficImage,
+	"webp":  TrafficImage,
+	"key":   TrafficInput,
+	"mouse": TrafficInput,
+	"touch": TrafficInput,
+}
+
+// streamOpcodes maps the opcodes which open a stream to its class and the argument holding the stream index
+var streamOpcodes = map[string]struct {
+	class TrafficClass
+	arg   int
+}{
+	"img":   {TrafficImage, 0},
+	"video": {TrafficImage, 0},
+	"audio": {TrafficAudio, 0},
+	"file":  {TrafficFile, 0},
+	"put":   {TrafficFile, 1},
+	"body":  {TrafficFile, 1},
+}
+
+// trafficCounter counts the traffic in one direction. Instructions are classified by whoever holds the
+// tunnel's reader or writer lock, so only the counts need be atomic.
+type trafficCounter struct {
+	bytes        atomic.Int64
+	instructions atomic.Int64
+	classes      [numTrafficClasses]struct {
+		bytes        atomic.Int64
+		instructions atomic.Int64
+	}
+
+	// the class of each open stream by index, so blob and end instructions count toward their stream
+	streams map[string]TrafficClass
+}
+
+// count classifies and counts one instruction
+func (c *trafficCounter) count(ins []byte) {
+	class := c.classify(ins)
+	c.instructions.Add(1)
+	c.classes[class].bytes.Add(int64(len(ins)))
+	c.classes[class].instructions.Add(1)
+}
+
+func (c *trafficCounter) classify(ins []byte) TrafficClass {
+	opcode, args := nextElement(ins)
+
+	switch string(opcode) {
+	case "blob":
+		index, _ := nextElement(args)
+		return c.streams[string(index)]
+	case "end":
+		index, _ := nextElement(args)
+		class := c.streams[string(index)]
+		delete(c.streams, string(index))
+		return class
+	}
+
+	if class, ok := instructionClasses[string(opcode)]; ok {
+		return class
+	}
+	if stream, ok := streamOpcodes[string(opcode)]; ok {
+		var index []byte
+		for i := 0; i <= stream.arg; i++ {
+			index, args = nextElement(args)
+		}
+		if c.streams == nil {
+			c.streams = make(map[string]TrafficClass)
+		}
+		c.streams[string(index)] = stream.class
+		return stream.class
+	}
+	return TrafficOther
+}
+
+func (c *trafficCounter) stats() DirectionStats {
+	stats := DirectionStats{
+		TrafficCount: TrafficCount{
+			Bytes:        c.bytes.Load(),
+			Instructions: c.instructions.Load(),
+		},
+		ByClass: make(map[TrafficClass]TrafficCount, numTrafficClasses),
+	}
+	for class := range c.classes {
+		stats.ByClass[TrafficClass(class)] = TrafficCount{
+			Bytes:        c.classes[class].bytes.Load(),
+			Instructions: c.classes[class].instructions.Load(),
+		}
+	}
+	return stats
+}
+
+// nextElement returns the value of the first element of an encoded instruction and the elements after it.
+// Both are empty if the instruction is malformed.
+func nextElement(ins []byte) (value []byte, rest []byte) {
+	dot := bytes.IndexByte(ins, '.')
+	if dot < 0 {
+		return nil, nil
+	}
+	length := 0
+	for _, c := range ins[:dot] {
+		if c < '0' || c > '9' {
+			return nil, nil
+		}
+		length = length*10 + int(c-'0')
+	}
+	// lengths are in code points, though the values counted here are ASCII
+	end := dot + 1
+	for ; length > 0 && end < len(ins); length-- {
+		_, size := utf8.DecodeRune(ins[end:])
+		end += size
+	}
+	if length > 0 || end >= len(ins) {
+		return nil, nil
+	}
+	return ins[dot+1 : end], ins[end+1:]
+}
+
+// countingReader counts the instructions read from guacd
+type countingReader struct {
+	InstructionReader
+	counter *trafficCounter
+}
+
+// ReadSome reads and counts the next instruction
+func (r *countingReader) ReadSome() ([]byte, error) {
+	return copied(r.ReadSomeNoCopy())
+}
+
+// ReadSomeNoCopy reads and counts the next instruction without copying it
+func (r *countingReader) ReadSomeNoCopy() ([]byte, error) {
+	ins, err := readSomeNoCopy(r.InstructionReader)
+	if len(ins) > 0 {
+		r.counter.bytes.Add(int64(len(ins)))
+		metrics.bytesToClient.Add(float64(len(ins)))
+		r.counter.count(ins)
+	}
+	return ins, err
+}
+
+// countingWriter counts the instructions written to guacd, which may be split across writes
+type countingWriter struct {
+	w        io.Writer
+	counter  *trafficCounter
+	splitter instructionSplitter
+}
+
+// Write writes p and counts the instructions it completes
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.counter.bytes.Add(int64(n))
+	metrics.bytesToGuacd.Add(float64(n))
+	if err != nil {
+		return n, err
+	}
+	countErr := w.splitter.split(p, func(ins []byte) error {
+		w.counter.count(ins)
+		return nil
+	})
+	if countErr != nil {
+		// guacd will reject the data, only resynchronize the count
+		w.splitter.release()
+	}
+	return n, nil
+}
@@ -0,0 +1,106 @@
+package guac
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestSimpleTunnel_Stats(t *testing.T) {
+	const (
+		img     = "3.img,1.1,2.14,1.0,9.image/png,1.0,1.0;"
+		imgData = "4.blob,1.1,8.iVBORw0K;"
+		imgEnd  = "3.end,1.1;"
+		audio   = "5.audio,1.2,9.audio/L16;"
+		audData = "4.blob,1.2,4.AAAA;"
+		sync    = "4.sync,3.100;"
+		key     = "3.key,5.65307,1.1;"
+		mouse   = "5.mouse,2.10,2.20,1.1;"
+		file    = "4.file,1.3,10.text/plain,5.a.txt;"
+		data    = "4.blob,1.3,4.aGk=;"
+		end     = "3.end,1.3;"
+		ack     = "3.ack,1.1,2.OK,1.0;"
+	)
+	conn := &recordingConn{fakeConn: fakeConn{ToRead: []byte(img + imgData + imgEnd + audio + audData + sync + ack)}}
+	tunnel := NewSimpleTunnel(NewStream(conn, time.Minute))
+
+	reader := tunnel.AcquireReader()
+	for i := 0; i < 7; i++ {
+		if _, err := reader.ReadSome(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tunnel.ReleaseReader()
+
+	writer := tunnel.AcquireWriter()
+	// the upload is split across writes
+	upload := file + data + end
+	for _, p := range []string{key + mouse + upload[:10], upload[10:], ack} {
+		if _, err := writer.Write([]byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tunnel.ReleaseWriter()
+
+	stats := tunnel.Stats()
+	tests := []struct {
+		name string
+		got  TrafficCount
+		want TrafficCount
+	}{
+		{"ToClient", stats.ToClient.TrafficCount, TrafficCount{int64(len(img + imgData + imgEnd + audio + audData + sync + ack)), 7}},
+		{"ToClient image", stats.ToClient.ByClass[TrafficImage], TrafficCount{int64(len(img + imgData + imgEnd)), 3}},
+		{"ToClient audio", stats.ToClient.ByClass[TrafficAudio], TrafficCount{int64(len(audio + audData)), 2}},
+		{"ToClient other", stats.ToClient.ByClass[TrafficOther], TrafficCount{int64(len(sync + ack)), 2}},
+		{"ToGuacd", stats.ToGuacd.TrafficCount, TrafficCount{int64(len(key + mouse + upload + ack)), 6}},
+		{"ToGuacd input", stats.ToGuacd.ByClass[TrafficInput], TrafficCount{int64(len(key + mouse)), 2}},
+		{"ToGuacd file", stats.ToGuacd.ByClass[TrafficFile], TrafficCount{int64(len(upload)), 3}},
+		{"ToGuacd other", stats.ToGuacd.ByClass[TrafficOther], TrafficCount{int64(len(ack)), 1}},
+	}
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.want, test.got)
+		}
+	}
+	if string(bytes.Join(conn.Writes, nil)) != key+mouse+upload+ack {
+		t.Errorf("Unexpected data written %q", conn.Writes)
+	}
+}
+
+func TestNextElement(t *testing.T) {
+	tests := []struct {
+		ins, value, rest string
+	}{
+		{"4.blob,1.3,4.aGk=;", "blob", "1.3,4.aGk=;"},
+		{"1.3,4.aGk=;", "3", "4.aGk=;"},
+		{"2.é!,1.3;", "é!", "1.3;"},
+		{"3.nop;", "nop", ""},
+		{"9.nop;", "", ""},
+		{"x.nop;", "", ""},
+		{"", "", ""},
+	}
+	for _, test := range tests {
+		value, rest := nextElement([]byte(test.ins))
+		if string(value) != test.value || string(rest) != test.rest {
+			t.Errorf("%q: expected %q, %q, got %q, %q", test.ins, test.value, test.rest, value, rest)
+		}
+	}
+}
+
+func TestStatsOf(t *testing.T) {
+	conn := &recordingConn{fakeConn: fakeConn{ToRead: []byte("4.sync,3.100;")}}
+	tunnel := NewSimpleTunnel(NewStream(conn, time.Minute))
+	if _, err := tunnel.AcquireReader().ReadSome(); err != nil {
+		t.Fatal(err)
+	}
+	tunnel.ReleaseReader()
+
+	// wrappers pass on the stats of the tunnel they wrap, if it counts its traffic
+	limited := NewRateLimitedTunnel(tunnel, RateLimits{})
+	if got := statsOf(limited).ToClient.Instructions; got != 1 {
+		t.Error("Expected the wrapped tunnel's stats, got", got)
+	}
+	if got := statsOf(struct{ Tunnel }{tunnel}).ToClient.Instructions; got != 0 {
+		t.Error("Expected no stats for a tunnel which doesn't count its traffic, got", got)
+	}
+}
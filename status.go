@@ -150,6 +150,12 @@ func (s Status) GetGuacamoleStatusCode() int {
 	return -1
 }
 
+// isClientError returns true if the status blames the client, in which case error details may be shared with it.
+func (s Status) isClientError() bool {
+	code := s.GetGuacamoleStatusCode()
+	return code >= 0x0300 && code < 0x0400
+}
+
 // FromGuacamoleStatusCode returns the Status corresponding to the given Guacamole protocol Status code.
 func FromGuacamoleStatusCode(code int) (ret Status) {
 	// Search for a Status having the given Status code
@@ -1,11 +1,15 @@
 package guac
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"log/slog"
 	"net"
 	"time"
+	"unicode/utf8"
 
-	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const (
@@ -21,142 +25,184 @@ type Stream struct {
 
 	// ConnectionID is the ID Guacamole gives and can be used to reconnect or share sessions
 	ConnectionID string
-	timeout      time.Duration
-
-	// if more than a single instruction is read, the rest are buffered here
+	// Protocol is the protocol selected by the handshake, empty when joining a connection by its ID
+	Protocol string
+	// Logger receives the stream's logs, the default slog logger if nil
+	Logger  *slog.Logger
+	timeout time.Duration
+
+	// data read from guacd is held in buffer, which comes from bufferPool until the stream can no longer be
+	// read. Data before start has been returned, and elements before parseStart belong to the instruction being
+	// parsed.
+	bufp       *[]byte
+	buffer     []byte
+	start      int
 	parseStart int
-	buffer     []rune
-	reset      []rune
 }
 
-// NewStream creates a new stream
+// NewStream creates a new stream. Its buffer is taken from the shared pool once it is first read.
 func NewStream(conn net.Conn, timeout time.Duration) (ret *Stream) {
-	buffer := make([]rune, 0, MaxGuacMessage*3)
 	return &Stream{
 		conn:    conn,
 		timeout: timeout,
-		buffer:  buffer,
-		reset:   buffer[:cap(buffer)],
 	}
 }
 
+// Dial connects to guacd at the TCP address, returning a stream with the timeout. The dial is traced as a
+// child of any span in ctx.
+func Dial(ctx context.Context, address string, timeout time.Duration) (*Stream, error) {
+	ctx, span := startSpan(ctx, "guac.dial", attribute.String("server.address", address))
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	endSpan(span, err)
+	if err != nil {
+		return nil, ErrUpstreamUnavailable.Wrap(err, "Unable to connect to guacd.")
+	}
+	return NewStream(conn, timeout), nil
+}
+
 // Write sends messages to Guacamole with a timeout
 func (s *Stream) Write(data []byte) (n int, err error) {
 	if err = s.conn.SetWriteDeadline(time.Now().Add(s.timeout)); err != nil {
-		logrus.Error(err)
+		s.logger().Error("Unable to set write deadline", "error", err)
 		return
 	}
 	return s.conn.Write(data)
 }
 
+// WriteInstructions encodes the instructions into one buffer and sends them to Guacamole with a single Write.
+func (s *Stream) WriteInstructions(instructions ...*Instruction) (n int, err error) {
+	bufp := getBuffer()
+	for _, instruction := range instructions {
+		*bufp = instruction.AppendTo(*bufp)
+	}
+	n, err = s.Write(*bufp)
+	putBuffer(bufp)
+	return
+}
+
 // Available returns true if there are messages buffered
 func (s *Stream) Available() bool {
-	return len(s.buffer) > 0
+	return s.start < len(s.buffer)
 }
 
-// Flush resets the internal buffer
+// Flush moves the buffered data to the front of the buffer, making room to read more. It invalidates the
+// instruction last returned by ReadSomeNoCopy.
 func (s *Stream) Flush() {
-	copy(s.reset, s.buffer)
-	s.buffer = s.reset[:len(s.buffer)]
+	n := copy(s.buffer, s.buffer[s.start:])
+	s.parseStart -= s.start
+	s.start = 0
+	s.buffer = s.buffer[:n]
 }
 
 // ReadSome takes the next instruction (from the network or from the buffer) and returns it.
 // io.Reader is not implemented because this seems like the right place to maintain a buffer.
 func (s *Stream) ReadSome() (instruction []byte, err error) {
+	return copied(s.ReadSomeNoCopy())
+}
+
+// ReadSomeNoCopy returns the next instruction like ReadSome without allocating. The instruction is a slice of
+// the stream's buffer and is only valid until the next read. Bytes which are not part of valid UTF-8 are
+// replaced with U+FFFD, in which case the instruction is a copy.
+func (s *Stream) ReadSomeNoCopy() (instruction []byte, err error) {
 	if err = s.conn.SetReadDeadline(time.Now().Add(s.timeout)); err != nil {
-		logrus.Error(err)
+		s.logger().Error("Unable to set read deadline", "error", err)
+		err = ErrConnectionClosed.Wrap(err, "Connection to guacd is closed.")
 		return
 	}
 
-	buffer := make([]byte, MaxGuacMessage)
-	var n int
-	// While we're blocking, or input is available
 	for {
-		// Length of element
-		var elementLength int
-
-		// Resume where we left off
-		i := s.parseStart
-
-	parseLoop:
-		// Parse instruction in buffer
-		for i < len(s.buffer) {
-			// ReadSome character
-			readChar := s.buffer[i]
-			i++
-
-			switch readChar {
-			// If digit, update length
-			case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
-				elementLength = elementLength*10 + int(readChar-'0')
-
-			// If not digit, check for end-of-length character
-			case '.':
-				if i+elementLength >= len(s.buffer) {
-					// break for i < s.usedLength { ... }
-					// Otherwise, read more data
-					break parseLoop
-				}
-				// Check if element present in buffer
-				terminator := s.buffer[i+elementLength]
-				// Move to character after terminator
-				i += elementLength + 1
-
-				// Reset length
-				elementLength = 0
-
-				// Continue here if necessary
-				s.parseStart = i
-
-				// If terminator is semicolon, we have a full
-				// instruction.
-				switch terminator {
-				case ';':
-					instruction = []byte(string(s.buffer[0:i]))
-					s.parseStart = 0
-					s.buffer = s.buffer[i:]
-					return
-				case ',':
-					// keep going
-				default:
-					err = ErrServer.NewError("Element terminator of instruction was not ';' nor ','")
-					return
-				}
-			default:
-				// Otherwise, parse error
-				err = ErrServer.NewError("Non-numeric character in element length:", string(readChar))
-				return
-			}
+		var complete bool
+		if instruction, complete, err = s.parse(); complete || err != nil {
+			return
 		}
-
-		n, err = s.conn.Read(buffer)
-		if err != nil && n == 0 {
-			switch err.(type) {
-			case net.Error:
-				ex := err.(net.Error)
-				if ex.Timeout() {
-					err = ErrUpstreamTimeout.NewError("Connection to guacd timed out.", err.Error())
-				} else {
-					err = ErrConnectionClosed.NewError("Connection to guacd is closed.", err.Error())
-				}
-			default:
-				err = ErrServer.NewError(err.Error())
-			}
+		if err = s.fill(); err != nil {
+			s.release()
 			return
 		}
-		if n == 0 {
-			err = ErrServer.NewError("read 0 bytes")
+	}
+}
+
+// parse returns the next instruction if the buffer holds all of it.
+func (s *Stream) parse() (instruction []byte, complete bool, err error) {
+	n, resume, err := scanInstruction(s.buffer[s.start:], s.parseStart-s.start)
+	if err != nil {
+		err = ErrServer.Wrap(err, "Invalid instruction from guacd.")
+		return
+	}
+	if n == 0 {
+		// Continue here once more data is read
+		s.parseStart = s.start + resume
+		return
+	}
+
+	instruction = s.buffer[s.start : s.start+n]
+	complete = true
+	s.start += n
+	s.parseStart = s.start
+	if !utf8.Valid(instruction) {
+		instruction = []byte(validUTF8(string(instruction)))
+	}
+	return
+}
+
+// fill reads more data from guacd into the buffer, taking one from the pool or making room as needed.
+func (s *Stream) fill() (err error) {
+	if s.bufp == nil {
+		s.bufp = getBuffer()
+		s.buffer = *s.bufp
+	}
+	if len(s.buffer) == cap(s.buffer) {
+		s.Flush()
+	}
+	if len(s.buffer) == cap(s.buffer) {
+		if cap(s.buffer) >= maxInstructionSize {
+			return ErrServer.NewError("Instruction from guacd is too long.")
 		}
-		runes := []rune(string(buffer[:n]))
+		grown := make([]byte, len(s.buffer), cap(s.buffer)*2)
+		copy(grown, s.buffer)
+		putBuffer(s.bufp)
+		s.bufp = &grown
+		s.buffer = grown
+	}
+
+	n, err := s.conn.Read(s.buffer[len(s.buffer):cap(s.buffer)])
+	s.buffer = s.buffer[:len(s.buffer)+n]
+	if n == 0 {
+		return readError(err)
+	}
+	return nil
+}
 
-		if cap(s.buffer)-len(s.buffer) < len(runes) {
-			s.Flush()
+// readError converts the error from a read of guacd which returned no data.
+func readError(err error) error {
+	if err == nil {
+		return ErrServer.NewError("read 0 bytes")
+	}
+	if err == io.EOF {
+		return ErrConnectionClosed.Wrap(err, "Connection to guacd is closed.")
+	}
+	switch err.(type) {
+	case net.Error:
+		ex := err.(net.Error)
+		if ex.Timeout() {
+			return ErrUpstreamTimeout.Wrap(err, "Connection to guacd timed out.")
 		}
+		return ErrConnectionClosed.Wrap(err, "Connection to guacd is closed.")
+	default:
+		return ErrServer.Wrap(err)
+	}
+}
 
-		n = copy(s.buffer[len(s.buffer):cap(s.buffer)], runes)
-		// must reslice so len is changed
-		s.buffer = s.buffer[:len(s.buffer)+n]
+// release returns the buffer to the pool once the stream can no longer be read.
+func (s *Stream) release() {
+	if s.bufp != nil {
+		*s.bufp = s.buffer[:0]
+		putBuffer(s.bufp)
+		s.bufp = nil
 	}
+	s.buffer = nil
+	s.start, s.parseStart = 0, 0
 }
 
 // Close closes the underlying network connection
@@ -164,22 +210,61 @@ func (s *Stream) Close() error {
 	return s.conn.Close()
 }
 
-// Handshake configures the guacd session
+// Handshake configures the guacd session, recording how long it took and any failure in the metrics
 func (s *Stream) Handshake(config *Config) error {
+	return s.HandshakeContext(context.Background(), config)
+}
+
+// HandshakeContext is Handshake which traces the handshake and each of its phases as children of any span
+// in ctx, such as the context of the request passed to a server's connect callback.
+func (s *Stream) HandshakeContext(ctx context.Context, config *Config) (err error) {
+	ctx, span := startSpan(ctx, "guac.handshake", attrProtocol.String(config.Protocol))
+	defer func() {
+		if err == nil {
+			span.SetAttributes(attrConnectionID.String(s.ConnectionID))
+		}
+		endSpan(span, err)
+	}()
+
+	s.logger().Debug("Starting handshake", "config", config)
+	start := time.Now()
+	err = s.handshake(ctx, config)
+	metrics.handshakeDone(time.Since(start), err)
+	if err != nil {
+		s.logger().Debug("Handshake failed", "error", err)
+	}
+	return err
+}
+
+// logger returns the stream's logger with its connection ID
+func (s *Stream) logger() *slog.Logger {
+	return loggerOr(s.Logger).With(slog.String(logConnectionID, s.ConnectionID))
+}
+
+// handshakePhase runs one round trip of the handshake within a span.
+func handshakePhase(ctx context.Context, name string, fn func() error) error {
+	_, span := startSpan(ctx, name)
+	err := fn()
+	endSpan(span, err)
+	return err
+}
+
+func (s *Stream) handshake(ctx context.Context, config *Config) error {
 	// Get protocol / connection ID
 	selectArg := config.ConnectionID
 	if len(selectArg) == 0 {
 		selectArg = config.Protocol
 	}
 
-	// Send requested protocol or connection ID
-	_, err := s.Write(NewInstruction("select", selectArg).Byte())
-	if err != nil {
-		return err
-	}
-
-	// Wait for server Args
-	args, err := s.AssertOpcode("args")
+	// Send requested protocol or connection ID, then wait for server Args
+	var args *Instruction
+	err := handshakePhase(ctx, "guac.handshake.select", func() (err error) {
+		if _, err = NewInstruction("select", selectArg).WriteTo(s); err != nil {
+			return
+		}
+		args, err = s.AssertOpcode("args")
+		return
+	})
 	if err != nil {
 		return err
 	}
@@ -201,47 +286,30 @@ func (s *Stream) Handshake(config *Config) error {
 		argValueS = append(argValueS, value)
 	}
 
-	// Send size
-	_, err = s.Write(NewInstruction("size",
-		fmt.Sprintf("%v", config.OptimalScreenWidth),
-		fmt.Sprintf("%v", config.OptimalScreenHeight),
-		fmt.Sprintf("%v", config.OptimalResolution)).Byte(),
-	)
-
-	if err != nil {
-		return err
-	}
-
-	// Send supported audio formats
-	_, err = s.Write(NewInstruction("audio", config.AudioMimetypes...).Byte())
-	if err != nil {
-		return err
-	}
-
-	// Send supported video formats
-	_, err = s.Write(NewInstruction("video", config.VideoMimetypes...).Byte())
-	if err != nil {
-		return err
-	}
-
-	// Send supported image formats
-	_, err = s.Write(NewInstruction("image", config.ImageMimetypes...).Byte())
-	if err != nil {
-		return err
-	}
-
-	// Send Args
-	_, err = s.Write(NewInstruction("connect", argValueS...).Byte())
-	if err != nil {
-		return err
-	}
-
-	// Wait for ready, store ID
-	ready, err := s.AssertOpcode("ready")
+	// Send size, supported audio, video and image formats, and Args in a single write, then wait for ready
+	var ready *Instruction
+	err = handshakePhase(ctx, "guac.handshake.connect", func() (err error) {
+		_, err = s.WriteInstructions(
+			NewInstruction("size",
+				fmt.Sprintf("%v", config.OptimalScreenWidth),
+				fmt.Sprintf("%v", config.OptimalScreenHeight),
+				fmt.Sprintf("%v", config.OptimalResolution)),
+			NewInstruction("audio", config.AudioMimetypes...),
+			NewInstruction("video", config.VideoMimetypes...),
+			NewInstruction("image", config.ImageMimetypes...),
+			NewInstruction("connect", argValueS...),
+		)
+		if err != nil {
+			return
+		}
+		ready, err = s.AssertOpcode("ready")
+		return
+	})
 	if err != nil {
 		return err
 	}
 
+	// Store ID
 	readyArgs := ready.Args
 	if len(readyArgs) == 0 {
 		err = ErrServer.NewError("No connection ID received")
@@ -250,6 +318,9 @@ func (s *Stream) Handshake(config *Config) error {
 
 	s.Flush()
 	s.ConnectionID = readyArgs[0]
+	if len(config.ConnectionID) == 0 {
+		s.Protocol = config.Protocol
+	}
 
 	return nil
 }
@@ -0,0 +1,494 @@
+package guac
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StreamServer serves the streams of live tunnels over plain HTTP, like the tunnel stream REST endpoints of
+// guacamole-client, so that large files don't have to travel through the tunnel as base64 blobs:
+//
+//	GET    .../{tunnel}/streams/{index}[/{filename}]  downloads the stream guacd began with file or body
+//	POST   .../{tunnel}/streams/{index}[/{filename}]  uploads the request body to the stream the client began
+//	                                                   with file or put, once guacd has acked it
+//
+// The handler may be mounted under any prefix. The stream's instructions are translated to and from the body,
+// one blob at a time, each waiting for the ack of the one before. Downloads held by a DownloadPolicy with a
+// MaxSize can only be received through the tunnel.
+//
+// Set it as the Streams of a Server or WebsocketServer to serve their tunnels. Like the HTTP tunnel, requests
+// for the streams of a tunnel which was issued a tunnel token must carry it. WebSocket tunnels are issued none,
+// so their streams are found by the tunnel's UUID alone; authorize requests before passing them on if that
+// isn't secret enough.
+type StreamServer struct {
+	// Logger receives logs of requests which don't reach a tunnel, the default slog logger if nil.
+	Logger *slog.Logger
+	// AllowMissingTunnelToken lets requests without a tunnel token reach the streams of any tunnel by its UUID
+	// alone, e.g. downloads started by navigating the browser, which can't send the header. Anyone who learns a
+	// tunnel's UUID can then use its streams, so it is off by default.
+	AllowMissingTunnelToken bool
+
+	tunnels tunnelRegistry[*streamInterceptor]
+}
+
+// NewStreamServer constructor
+func NewStreamServer() *StreamServer {
+	return &StreamServer{}
+}
+
+// register adds a stream interceptor to the filter of a tunnel, creating the filter if the tunnel has none,
+// and serves the tunnel's streams until the session ends.
+func (s *StreamServer) register(tunnelUUID, token string, filter *tunnelFilter, logger *slog.Logger) *tunnelFilter {
+	if s == nil {
+		return filter
+	}
+	return s.tunnels.add(tunnelUUID, filter, func(session *tunnelFilter) *streamInterceptor {
+		return &streamInterceptor{
+			server:     s,
+			session:    session,
+			logger:     logger,
+			tunnelUUID: tunnelUUID,
+			token:      token,
+			downloads:  make(map[string]*interceptedStream),
+			uploads:    make(map[string]*interceptedStream),
+		}
+	})
+}
+
+// get returns the interceptor of a tunnel. The request must carry the tunnel's token if it was issued one,
+// unless AllowMissingTunnelToken lets it leave the token out.
+func (s *StreamServer) get(r *http.Request, tunnelUUID string) (*streamInterceptor, bool) {
+	interceptor, ok := s.tunnels.get(tunnelUUID)
+	if !ok {
+		return nil, false
+	}
+	token := r.Header.Get(TunnelTokenHeader)
+	missing := len(token) == 0 && (len(interceptor.token) == 0 || s.AllowMissingTunnelToken)
+	if !missing && subtle.ConstantTimeCompare([]byte(token), []byte(interceptor.token)) != 1 {
+		return nil, false
+	}
+	return interceptor, true
+}
+
+func (s *StreamServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger := loggerOr(s.Logger)
+	interceptor, index, err := s.find(r)
+	if err == nil {
+		logger = interceptor.logger.With("stream", index)
+		err = interceptor.serve(w, r, index)
+	}
+	if err == nil {
+		return
+	}
+	guacErr := guacErrorOf(err, ErrServer)
+	switch {
+	case guacErr.Status.isClientError():
+		logger.Warn("Stream request rejected", "error", err)
+		sendHTTPError(w, guacErr.Status, err.Error())
+	default:
+		logger.Error("Stream request failed", "error", err, "status", guacErr.Status.String())
+		sendHTTPError(w, guacErr.Status, "Internal server error.")
+	}
+}
+
+// find returns the interceptor of the tunnel whose stream is requested, and the stream's index.
+func (s *StreamServer) find(r *http.Request) (*streamInterceptor, string, error) {
+	tunnelUUID, index, ok := parseStreamPath(r.URL.EscapedPath())
+	if !ok {
+		return nil, "", ErrResourceNotFound.NewError("Invalid stream path.")
+	}
+	interceptor, ok := s.get(r, tunnelUUID)
+	if !ok {
+		return nil, "", ErrResourceNotFound.NewError("No such tunnel.")
+	}
+	return interceptor, index, nil
+}
+
+// serve transfers the stream as the request's method asks.
+func (i *streamInterceptor) serve(w http.ResponseWriter, r *http.Request, index string) error {
+	switch r.Method {
+	case http.MethodGet:
+		return i.download(w, r, index)
+	case http.MethodPost, http.MethodPut:
+		return i.upload(w, r, index)
+	}
+	w.Header().Set("Allow", "GET, POST, PUT")
+	return ErrClient.NewError("Method not allowed.")
+}
+
+// parseStreamPath returns the tunnel UUID and stream index of a path ending in
+// /{tunnel}/streams/{index}[/{filename}].
+func parseStreamPath(escapedPath string) (tunnelUUID, index string, ok bool) {
+	parts := strings.Split(strings.TrimSuffix(escapedPath, "/"), "/")
+	for _, i := range []int{len(parts) - 2, len(parts) - 3} {
+		if i < 1 || parts[i] != "streams" {
+			continue
+		}
+		tunnelUUID, err := url.PathUnescape(parts[i-1])
+		if err != nil || len(tunnelUUID) != uuidLength {
+			return "", "", false
+		}
+		index = parts[i+1]
+		if n, err := strconv.Atoi(index); err != nil || n < 0 || strconv.Itoa(n) != index {
+			return "", "", false
+		}
+		return tunnelUUID, index, true
+	}
+	return "", "", false
+}
+
+// streamInterceptor is the filter of a tunnel which passes the streams requested from its StreamServer to and
+// from HTTP requests instead of the client.
+type streamInterceptor struct {
+	server *StreamServer
+	// session is the filter of the tunnel, which sends to guacd
+	session    *tunnelFilter
+	logger     *slog.Logger
+	tunnelUUID string
+	token      string
+
+	mu sync.Mutex
+	// the streams begun by guacd and by the client, by index
+	downloads map[string]*interceptedStream
+	uploads   map[string]*interceptedStream
+	ended     bool
+}
+
+type interceptedStream struct {
+	mimetype string
+	name     string
+	// ready is true once the stream may be intercepted: a download as soon as guacd begins it, an upload once
+	// guacd has acked its beginning, so the ack isn't taken for that of the first blob
+	ready bool
+	// events carries the decoded blobs of a download or the acks of an upload while a request intercepts the
+	// stream. It is closed when the stream ends, with err set first if it ended early.
+	events chan streamEvent
+	err    error
+}
+
+type streamEvent struct {
+	data   []byte
+	status Status
+	// message is the message of an ack
+	message string
+}
+
+func (i *streamInterceptor) filter(direction string, ins []byte, _ filterOutput) (bool, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	opcode, args := nextElement(ins)
+	if direction == directionToGuacd {
+		switch string(opcode) {
+		case "file":
+			index, args := nextElement(args)
+			i.begin(i.uploads, index, args, false)
+		case "put":
+			_, args = nextElement(args)
+			index, args := nextElement(args)
+			i.begin(i.uploads, index, args, false)
+		case "end":
+			index, _ := nextElement(args)
+			delete(i.uploads, string(index))
+		case "ack":
+			// the client refused a download
+			index, args := nextElement(args)
+			if _, status := parseAck(args); status != Success {
+				delete(i.downloads, string(index))
+			}
+		}
+		return true, nil
+	}
+
+	switch string(opcode) {
+	case "file":
+		index, args := nextElement(args)
+		i.begin(i.downloads, index, args, true)
+	case "body":
+		_, args = nextElement(args)
+		index, args := nextElement(args)
+		i.begin(i.downloads, index, args, true)
+
+	case "blob":
+		index, args := nextElement(args)
+		stream, ok := i.downloads[string(index)]
+		if !ok || stream.events == nil {
+			return true, nil
+		}
+		encoded, _ := nextElement(args)
+		data, err := base64.StdEncoding.DecodeString(string(encoded))
+		if err != nil {
+			i.fail(i.downloads, string(index), ErrUpstream.NewError("Invalid stream data."))
+			return false, nil
+		}
+		select {
+		case stream.events <- streamEvent{data: data}:
+		default:
+			// guacd sent a blob before the last was acked
+			i.fail(i.downloads, string(index), ErrUpstream.NewError("Stream data was not acknowledged."))
+		}
+		return false, nil
+
+	case "end":
+		index, _ := nextElement(args)
+		stream, ok := i.downloads[string(index)]
+		if !ok {
+			return true, nil
+		}
+		delete(i.downloads, string(index))
+		if stream.events == nil {
+			return true, nil
+		}
+		close(stream.events)
+		return false, nil
+
+	case "ack":
+		index, args := nextElement(args)
+		stream, ok := i.uploads[string(index)]
+		if !ok {
+			return true, nil
+		}
+		message, status := parseAck(args)
+		if stream.events == nil {
+			if status != Success {
+				delete(i.uploads, string(index))
+			}
+			stream.ready = true
+			return true, nil
+		}
+		select {
+		case stream.events <- streamEvent{status: status, message: message}:
+		default:
+			i.fail(i.uploads, string(index), ErrUpstream.NewError("Stream data was acknowledged twice."))
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+// begin records a stream beginning with the index, whose remaining arguments are its mimetype and name.
+func (i *streamInterceptor) begin(streams map[string]*interceptedStream, index, args []byte, ready bool) {
+	mimetype, args := nextElement(args)
+	name, _ := nextElement(args)
+	streams[string(index)] = &interceptedStream{mimetype: string(mimetype), name: string(name), ready: ready}
+}
+
+// fail ends a stream early, telling the request intercepting it why.
+func (i *streamInterceptor) fail(streams map[string]*interceptedStream, index string, err error) {
+	stream := streams[index]
+	delete(streams, index)
+	if stream.events != nil {
+		stream.err = err
+		close(stream.events)
+	}
+}
+
+// end fails the streams being intercepted and stops serving the tunnel's streams.
+func (i *streamInterceptor) end() {
+	i.server.tunnels.remove(i.tunnelUUID, i)
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.ended = true
+	for _, streams := range []map[string]*interceptedStream{i.downloads, i.uploads} {
+		for index := range streams {
+			i.fail(streams, index, ErrSessionClosed.NewError("Session ended during transfer."))
+		}
+	}
+}
+
+// intercept starts passing a stream to a request.
+func (i *streamInterceptor) intercept(streams map[string]*interceptedStream, index string) (*interceptedStream, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.ended {
+		return nil, ErrSessionClosed.NewError("Session has ended.")
+	}
+	stream, ok := streams[index]
+	if !ok {
+		return nil, ErrResourceNotFound.NewError("No such stream.")
+	}
+	if stream.events != nil {
+		return nil, ErrResourceConflict.NewError("Stream is already being transferred.")
+	}
+	if !stream.ready {
+		return nil, ErrResourceConflict.NewError("Stream has not been acknowledged.")
+	}
+	stream.events = make(chan streamEvent, 1)
+	return stream, nil
+}
+
+// release stops passing a stream to a request which has finished with it.
+func (i *streamInterceptor) release(streams map[string]*interceptedStream, index string, stream *interceptedStream) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if streams[index] == stream {
+		delete(streams, index)
+	}
+}
+
+// download writes the stream from guacd to the response, acking each blob once it is written.
+func (i *streamInterceptor) download(w http.ResponseWriter, r *http.Request, index string) error {
+	stream, err := i.intercept(i.downloads, index)
+	if err != nil {
+		return err
+	}
+	defer i.release(i.downloads, index, stream)
+
+	// guacd sends nothing until the stream is acked
+	if err = i.session.sendToGuacd(successAck([]byte(index))); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", stream.mimetype)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment",
+		map[string]string{"filename": path.Base(stream.name)}))
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher, _ := w.(http.Flusher)
+
+	written := false
+	for {
+		var event streamEvent
+		var ok bool
+		select {
+		case event, ok = <-stream.events:
+		case <-r.Context().Done():
+			i.refuse(index, ClientTimeout, "Download cancelled.")
+			return ErrClientTimeout.Wrap(r.Context().Err(), "Download cancelled.")
+		}
+		if !ok {
+			if stream.err == nil {
+				if !written {
+					w.WriteHeader(http.StatusOK)
+				}
+				return nil
+			}
+			if !written {
+				return stream.err
+			}
+			i.logger.Warn("Download failed", "stream", index, "error", stream.err)
+			abort(w)
+			return nil
+		}
+
+		written = true
+		if _, err = w.Write(event.data); err != nil {
+			i.refuse(index, ClientTimeout, "Download failed.")
+			i.logger.Debug("Download failed", "stream", index, "error", err)
+			return nil
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if err = i.session.sendToGuacd(successAck([]byte(index))); err != nil {
+			i.logger.Debug("Download failed", "stream", index, "error", err)
+			abort(w)
+			return nil
+		}
+	}
+}
+
+// abort ends a download which failed after part of it was written, so the client can't mistake the part it
+// has for the whole file. The response has no Content-Length, so over HTTP/1.1 closing the connection before
+// the end of its chunked body leaves the client with an unexpected EOF, and over HTTP/2 the stream is reset
+// once its write deadline has passed.
+func abort(w http.ResponseWriter) {
+	rc := http.NewResponseController(w)
+	if conn, _, err := rc.Hijack(); err == nil {
+		_ = conn.Close()
+		return
+	}
+	_ = rc.SetWriteDeadline(time.Now())
+	_ = rc.Flush()
+}
+
+// refuse tells guacd the client won't take the rest of its stream.
+func (i *streamInterceptor) refuse(index string, status Status, message string) {
+	ack := NewInstruction("ack", index, message, strconv.Itoa(status.GetGuacamoleStatusCode()))
+	if err := i.session.sendToGuacd(ack.Byte()); err != nil {
+		i.logger.Debug("Unable to refuse stream", "stream", index, "error", err)
+	}
+}
+
+// upload sends the request body to guacd in blobs, waiting for each to be acked, then ends the stream.
+func (i *streamInterceptor) upload(w http.ResponseWriter, r *http.Request, index string) error {
+	stream, err := i.intercept(i.uploads, index)
+	if err != nil {
+		return err
+	}
+	defer i.release(i.uploads, index, stream)
+
+	buf := make([]byte, blobSize)
+	for {
+		n, readErr := io.ReadFull(r.Body, buf)
+		if n > 0 {
+			blob := NewInstruction("blob", index, base64.StdEncoding.EncodeToString(buf[:n]))
+			if err = i.session.sendToGuacd(blob.Byte()); err != nil {
+				return err
+			}
+			if err = i.acked(r, stream); err != nil {
+				if errors.Is(err, ErrClientTimeout) {
+					i.endUpload(index)
+				}
+				return err
+			}
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			// guacd has no way to tell an abandoned upload from a complete one but its size
+			i.endUpload(index)
+			return ErrClient.Wrap(readErr, "Unable to read upload.")
+		}
+	}
+	if err = i.session.sendToGuacd(NewInstruction("end", index).Byte()); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// acked waits for guacd to ack the last blob of an upload.
+func (i *streamInterceptor) acked(r *http.Request, stream *interceptedStream) error {
+	select {
+	case event, ok := <-stream.events:
+		switch {
+		case !ok && stream.err != nil:
+			return stream.err
+		case !ok:
+			return ErrResourceClosed.NewError("Stream closed.")
+		case event.status != Success:
+			return errKindFromStatus(event.status).NewError(event.message)
+		}
+		return nil
+	case <-r.Context().Done():
+		return ErrClientTimeout.Wrap(r.Context().Err(), "Upload cancelled.")
+	}
+}
+
+func (i *streamInterceptor) endUpload(index string) {
+	if err := i.session.sendToGuacd(NewInstruction("end", index).Byte()); err != nil {
+		i.logger.Debug("Unable to end upload", "stream", index, "error", err)
+	}
+}
+
+// parseAck returns the message and status of the arguments of an ack following its index.
+func parseAck(args []byte) (message string, status Status) {
+	m, args := nextElement(args)
+	c, _ := nextElement(args)
+	code, err := strconv.Atoi(string(c))
+	if err != nil {
+		return string(m), ServerError
+	}
+	return string(m), FromGuacamoleStatusCode(code)
+}
@@ -0,0 +1,337 @@
+package guac
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestParseStreamPath(t *testing.T) {
+	uuid := "0a7cf2d1-6a3b-4c55-9d43-5c8e0f1b2a3c"
+	tests := []struct {
+		path, uuid, index string
+		ok                bool
+	}{
+		{"/api/tunnels/" + uuid + "/streams/1", uuid, "1", true},
+		{"/" + uuid + "/streams/12/report%20final.pdf", uuid, "12", true},
+		{"/" + uuid + "/streams/0/", uuid, "0", true},
+		{"/" + uuid + "/streams/-1", "", "", false},
+		{"/" + uuid + "/streams/01", "", "", false},
+		{"/" + uuid + "/streams/x/a.txt", "", "", false},
+		{"/not-a-uuid/streams/1", "", "", false},
+		{"/" + uuid + "/files/1", "", "", false},
+		{"/streams/1", "", "", false},
+	}
+	for _, test := range tests {
+		uuid, index, ok := parseStreamPath(test.path)
+		if uuid != test.uuid || index != test.index || ok != test.ok {
+			t.Errorf("parseStreamPath(%q) = %q, %q, %v", test.path, uuid, index, ok)
+		}
+	}
+}
+
+func TestStreamServer_TunnelToken(t *testing.T) {
+	logger := slog.Default()
+	streams := NewStreamServer()
+	streams.register("http", "t0ken", nil, logger)
+	streams.register("websocket", "", nil, logger)
+	request := func(token string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if token != "" {
+			r.Header.Set(TunnelTokenHeader, token)
+		}
+		return r
+	}
+
+	tests := []struct {
+		tunnel, token string
+		allowMissing  bool
+		ok            bool
+	}{
+		{"http", "t0ken", false, true},
+		{"http", "wrong", false, false},
+		{"http", "", false, false},
+		{"http", "", true, true},
+		{"http", "wrong", true, false},
+		// a tunnel issued no token is found by its UUID
+		{"websocket", "", false, true},
+		{"websocket", "t0ken", false, false},
+	}
+	for _, test := range tests {
+		streams.AllowMissingTunnelToken = test.allowMissing
+		if _, ok := streams.get(request(test.token), test.tunnel); ok != test.ok {
+			t.Errorf("get(%q) of the %s tunnel allowing missing tokens %v = %v", test.token, test.tunnel, test.allowMissing, ok)
+		}
+	}
+}
+
+func TestStreamServer_Download(t *testing.T) {
+	s, guacd := newPipeServer(t)
+	streams := NewStreamServer()
+	s.Streams = streams
+	received := recordGuacd(guacd)
+	srv := httptest.NewServer(streams)
+	defer srv.Close()
+
+	rec := serve(s, http.MethodPost, "connect", "", "")
+	uuid, token := rec.Body.String(), rec.Header().Get(TunnelTokenHeader)
+
+	// the client sees guacd begin the stream, then downloads it over HTTP
+	read := make(chan string)
+	go func() { read <- serve(s, http.MethodGet, "read:"+uuid+":0", token, "").Body.String() }()
+	begin := NewInstruction("file", "1", "text/plain", "a.txt").String()
+	if _, err := guacd.Write([]byte(begin)); err != nil {
+		t.Fatal(err)
+	}
+	// which the tunnel has passed on once it reads more
+	if _, err := guacd.Write([]byte("4.sync,1.0;")); err != nil {
+		t.Fatal(err)
+	}
+
+	type response struct {
+		resp *http.Response
+		body string
+		err  error
+	}
+	downloaded := make(chan response)
+	go func() {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/tunnels/"+uuid+"/streams/1/a.txt", nil)
+		req.Header.Set(TunnelTokenHeader, token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			downloaded <- response{err: err}
+			return
+		}
+		defer func() { _ = resp.Body.Close() }()
+		body, err := io.ReadAll(resp.Body)
+		downloaded <- response{resp: resp, body: string(body), err: err}
+	}()
+
+	// each blob is acked once written to the response
+	var acks string
+	for _, blob := range []string{"hello ", "world"} {
+		acks += string(successAck([]byte("1")))
+		received.wait(t, acks)
+		if _, err := guacd.Write([]byte(NewInstruction("blob", "1", base64Of(blob)).String())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	received.wait(t, acks+string(successAck([]byte("1"))))
+	if _, err := guacd.Write([]byte("3.end,1.1;4.sync,1.1;")); err != nil {
+		t.Fatal(err)
+	}
+
+	got := <-downloaded
+	if got.err != nil {
+		t.Fatal(got.err)
+	}
+	if got.resp.StatusCode != http.StatusOK || got.body != "hello world" {
+		t.Errorf("Unexpected download %d %q", got.resp.StatusCode, got.body)
+	}
+	if ct, cd := got.resp.Header.Get("Content-Type"), got.resp.Header.Get("Content-Disposition"); ct != "text/plain" ||
+		cd != "attachment; filename=a.txt" {
+		t.Errorf("Unexpected download headers %q %q", ct, cd)
+	}
+
+	// the stream's data went to the download rather than the client
+	_ = guacd.Close()
+	if body := <-read; !strings.HasPrefix(body, begin+"4.sync,1.0;4.sync,1.1;") {
+		t.Errorf("Unexpected instructions read %q", body)
+	}
+
+	// the tunnel is gone with its session
+	resp, err := http.Get(srv.URL + "/tunnels/" + uuid + "/streams/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Error("Expected 404 once the session ended, got", resp.StatusCode)
+	}
+}
+
+func TestStreamServer_DownloadFailed(t *testing.T) {
+	s, guacd := newPipeServer(t)
+	streams := NewStreamServer()
+	s.Streams = streams
+	received := recordGuacd(guacd)
+	// like middleware which recovers handlers
+	recovered := make(chan any, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if v := recover(); v != nil {
+				recovered <- v
+			}
+		}()
+		streams.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	rec := serve(s, http.MethodPost, "connect", "", "")
+	uuid, token := rec.Body.String(), rec.Header().Get(TunnelTokenHeader)
+	read := make(chan string)
+	go func() { read <- serve(s, http.MethodGet, "read:"+uuid+":0", token, "").Body.String() }()
+	begin := NewInstruction("file", "1", "text/plain", "a.txt").String()
+	if _, err := guacd.Write([]byte(begin + "4.sync,1.0;")); err != nil {
+		t.Fatal(err)
+	}
+
+	downloaded := make(chan error)
+	go func() {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/tunnels/"+uuid+"/streams/1/a.txt", nil)
+		req.Header.Set(TunnelTokenHeader, token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			downloaded <- err
+			return
+		}
+		defer func() { _ = resp.Body.Close() }()
+		_, err = io.ReadAll(resp.Body)
+		downloaded <- err
+	}()
+
+	// guacd goes away part way through the file
+	received.wait(t, string(successAck([]byte("1"))))
+	if _, err := guacd.Write([]byte(NewInstruction("blob", "1", base64Of("hello ")).String())); err != nil {
+		t.Fatal(err)
+	}
+	received.wait(t, string(successAck([]byte("1")))+string(successAck([]byte("1"))))
+	_ = guacd.Close()
+	<-read
+
+	// the client can tell it has only part of the file, and the handler didn't panic
+	if err := <-downloaded; !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Error("Expected io.ErrUnexpectedEOF, got", err)
+	}
+	select {
+	case v := <-recovered:
+		t.Error("Unexpected panic", v)
+	default:
+	}
+}
+
+func TestStreamServer_Upload(t *testing.T) {
+	guacd, client := net.Pipe()
+	streams := NewStreamServer()
+	tunnels := make(chan Tunnel, 1)
+	server := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		tunnel := NewSimpleTunnel(NewStream(client, time.Minute))
+		tunnels <- tunnel
+		return tunnel, nil
+	})
+	server.Streams = streams
+	received := recordGuacd(guacd)
+
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+	streamSrv := httptest.NewServer(streams)
+	defer streamSrv.Close()
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ws.Close() }()
+	if _, _, err = ws.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+	uuid := (<-tunnels).GetUUID()
+
+	// the client begins two uploads over the tunnel, which guacd accepts
+	begin := NewInstruction("file", "2", "application/octet-stream", "b.bin").String() +
+		NewInstruction("file", "3", "application/octet-stream", "c.bin").String()
+	if err = ws.WriteMessage(websocket.TextMessage, []byte(begin)); err != nil {
+		t.Fatal(err)
+	}
+	received.wait(t, begin)
+
+	// which can't be sent over HTTP until guacd has acked it
+	resp, err := http.Post(streamSrv.URL+"/"+uuid+"/streams/2", "application/octet-stream", strings.NewReader("early"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Error("Expected 409 before guacd acked the stream, got", resp.StatusCode)
+	}
+
+	accepted := string(successAck([]byte("2"))) + string(successAck([]byte("3")))
+	if _, err = guacd.Write([]byte(accepted)); err != nil {
+		t.Fatal(err)
+	}
+	if got := readWebsocket(t, ws, len(accepted)); got != accepted {
+		t.Errorf("Unexpected instructions read %q", got)
+	}
+
+	// then sends the first over HTTP, one blob at a time
+	data := bytes.Repeat([]byte("0123456789"), 700)
+	status := make(chan int, 1)
+	go func() {
+		resp, err := http.Post(streamSrv.URL+"/"+uuid+"/streams/2", "application/octet-stream", bytes.NewReader(data))
+		if err != nil {
+			status <- 0
+			return
+		}
+		_ = resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	first := NewInstruction("blob", "2", base64Of(string(data[:blobSize]))).String()
+	received.wait(t, first)
+	if _, err = guacd.Write(successAck([]byte("2"))); err != nil {
+		t.Fatal(err)
+	}
+	second := NewInstruction("blob", "2", base64Of(string(data[blobSize:]))).String()
+	received.wait(t, first+second)
+	if _, err = guacd.Write(successAck([]byte("2"))); err != nil {
+		t.Fatal(err)
+	}
+	received.wait(t, first+second+"3.end,1.2;")
+	if got := <-status; got != http.StatusNoContent {
+		t.Error("Unexpected upload status", got)
+	}
+
+	// guacd refuses the second partway
+	go func() {
+		resp, err := http.Post(streamSrv.URL+"/"+uuid+"/streams/3/c.bin", "application/octet-stream", bytes.NewReader(data))
+		if err != nil {
+			status <- 0
+			return
+		}
+		_ = resp.Body.Close()
+		if resp.Header.Get("Guacamole-Status-Code") != "771" {
+			status <- -1
+			return
+		}
+		status <- resp.StatusCode
+	}()
+	received.wait(t, NewInstruction("blob", "3", base64Of(string(data[:blobSize]))).String())
+	if _, err = guacd.Write([]byte(forbiddenAck("3", "Disk full.") + "4.sync,1.0;")); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-status; got != http.StatusForbidden {
+		t.Error("Unexpected refused upload status", got)
+	}
+
+	// none of the acks of the uploads reach the client
+	if got := readWebsocket(t, ws, len("4.sync,1.0;")); got != "4.sync,1.0;" {
+		t.Errorf("Unexpected instructions read %q", got)
+	}
+
+	// nor can a stream the client never began be uploaded to
+	resp, err = http.Post(streamSrv.URL+"/"+uuid+"/streams/4", "text/plain", strings.NewReader("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Error("Expected 404 for an unknown stream, got", resp.StatusCode)
+	}
+}
@@ -80,20 +80,16 @@ func TestInstructionReader_ReadSome_Unicode(t *testing.T) {
 
 func TestInstructionReader_Flush(t *testing.T) {
 	s := NewStream(&fakeConn{}, time.Second)
-	s.buffer = s.buffer[:4]
-	s.buffer[0] = '1'
-	s.buffer[1] = '2'
-	s.buffer[2] = '3'
-	s.buffer[3] = '4'
-	s.buffer = s.buffer[2:]
+	s.buffer = []byte("1234")
+	s.start, s.parseStart = 2, 3
 
 	s.Flush()
 
-	if s.buffer[0] != '3' && s.buffer[1] != '4' {
-		t.Error("Unexpected buffer contents:", string(s.buffer[:2]))
+	if string(s.buffer) != "34" {
+		t.Errorf("Unexpected buffer contents: %q", s.buffer)
 	}
-	if len(s.buffer) != 2 {
-		t.Error("Unexpected length", len(s.buffer))
+	if s.start != 0 || s.parseStart != 1 {
+		t.Error("Unexpected offsets", s.start, s.parseStart)
 	}
 }
 
@@ -140,3 +136,78 @@ func (f *fakeConn) SetReadDeadline(t time.Time) error {
 func (f *fakeConn) SetWriteDeadline(t time.Time) error {
 	return nil
 }
+
+func TestStream_Handshake_Error(t *testing.T) {
+	stream := NewStream(&fakeConn{
+		ToRead: []byte("5.error,30.Aborted. See logs for details.,3.519;"),
+	}, time.Minute)
+
+	config := NewGuacamoleConfiguration()
+	config.Protocol = "rdp"
+	err := stream.Handshake(config)
+
+	guacErr, ok := err.(*ErrGuac)
+	if !ok {
+		t.Fatalf("Expected *ErrGuac, got %#v", err)
+	}
+	if guacErr.Kind != ErrUpstreamNotFound || guacErr.Status != UpstreamNotFound {
+		t.Error("Unexpected kind or status", guacErr.Kind, guacErr.Status)
+	}
+	if guacErr.Error() != "Aborted. See logs for details." {
+		t.Error("Unexpected message", guacErr.Error())
+	}
+}
+
+// repeatConn returns its data over and over.
+type repeatConn struct {
+	fakeConn
+	data []byte
+	pos  int
+}
+
+func (r *repeatConn) Read(b []byte) (int, error) {
+	n := copy(b, r.data[r.pos:])
+	r.pos = (r.pos + n) % len(r.data)
+	return n, nil
+}
+
+func TestStream_ReadSome_Copies(t *testing.T) {
+	stream := NewStream(&repeatConn{data: []byte("4.sync,1.0;3.nop;")}, time.Minute)
+
+	first, err := stream.ReadSome()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err = stream.ReadSome(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stream.Flush()
+	if string(first) != "4.sync,1.0;" {
+		t.Errorf("Expected the instruction to outlive later reads, got %q", first)
+	}
+}
+
+func TestStream_ReadSomeNoCopy_NoAllocs(t *testing.T) {
+	stream := NewStream(&repeatConn{data: []byte("4.sync,8.12345678;3.nop;")}, time.Minute)
+
+	allocs := testing.AllocsPerRun(1000, func() {
+		if _, err := stream.ReadSomeNoCopy(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Error("Expected ReadSomeNoCopy not to allocate, got", allocs)
+	}
+}
+
+func BenchmarkStream_ReadSomeNoCopy(b *testing.B) {
+	stream := NewStream(&repeatConn{data: []byte("4.blob,1.0,16.iVBORw0KGgoAAAAN;4.sync,8.12345678;")}, time.Minute)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := stream.ReadSomeNoCopy(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
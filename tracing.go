@@ -0,0 +1,103 @@
+package guac
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName identifies the spans of this package
+const tracerName = "github.com/wwt/guac"
+
+// Span attributes
+const (
+	attrTransport        = attribute.Key("guac.transport")
+	attrProtocol         = attribute.Key("guac.protocol")
+	attrConnectionID     = attribute.Key("guac.connection_id")
+	attrTunnelUUID       = attribute.Key("guac.tunnel_uuid")
+	attrDisconnectReason = attribute.Key("guac.disconnect_reason")
+	attrStatus           = attribute.Key("guac.status")
+)
+
+// Tracing configures the OpenTelemetry spans of a server. Each session is traced by a guac.session span
+// lasting until the tunnel is closed, with a guac.connect span around the connect callback. The request
+// passed to the callback carries the connect span in its context, so Dial and Stream.HandshakeContext called
+// with that context trace the dial and each phase of the handshake beneath it.
+type Tracing struct {
+	// TracerProvider creates the tracer, the global provider if nil.
+	TracerProvider trace.TracerProvider
+	// Propagator extracts the trace context from the headers of connect requests, the global propagator if
+	// nil.
+	Propagator propagation.TextMapPropagator
+}
+
+// startSession starts the span of a session as a child of any trace context in the request headers, returning
+// the request with the span in its context.
+func (t Tracing) startSession(r *http.Request, transport string) (*http.Request, trace.Span) {
+	provider := t.TracerProvider
+	if provider == nil {
+		provider = otel.GetTracerProvider()
+	}
+	propagator := t.Propagator
+	if propagator == nil {
+		propagator = otel.GetTextMapPropagator()
+	}
+
+	ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := provider.Tracer(tracerName).Start(ctx, "guac.session",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attrTransport.String(transport)))
+	return r.WithContext(ctx), span
+}
+
+// traceConnect calls the connect callback within a span, passing it the span in the request context.
+func traceConnect(r *http.Request, connect func(*http.Request) (Tunnel, error)) (Tunnel, error) {
+	ctx, span := startSpan(r.Context(), "guac.connect")
+	tunnel, err := connect(r.WithContext(ctx))
+	if err == nil {
+		span.SetAttributes(tunnelAttributes(tunnel)...)
+	}
+	endSpan(span, err)
+	return tunnel, err
+}
+
+// endSession ends the span of a session with the reason its tunnel was closed.
+func endSession(span trace.Span, reason CloseReason) {
+	span.SetAttributes(
+		attrDisconnectReason.String(reason.Cause.String()),
+		attrStatus.String(reason.Status.String()),
+	)
+	if reason.Cause != DisconnectClosed {
+		span.SetStatus(codes.Error, reason.Message)
+	}
+	span.End()
+}
+
+func tunnelAttributes(tunnel Tunnel) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attrProtocol.String(protocolOf(tunnel)),
+		attrConnectionID.String(tunnel.ConnectionID()),
+		attrTunnelUUID.String(tunnel.GetUUID()),
+	}
+}
+
+// startSpan starts a span as a child of the span in ctx, using the same provider. Without a span in ctx,
+// nothing is traced.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	tracer := trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName)
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends the span, recording the error if there is one.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,151 @@
+package guac
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// fakeGuacd answers a handshake on conn with args, then reply.
+func fakeGuacd(conn net.Conn, reply string) {
+	stream := NewStream(conn, time.Minute)
+	for {
+		ins, err := ReadOne(stream)
+		if err != nil {
+			return
+		}
+		switch ins.Opcode {
+		case "select":
+			_, _ = conn.Write([]byte("4.args,8.hostname;"))
+		case "connect":
+			_, _ = conn.Write([]byte(reply))
+		}
+	}
+}
+
+// spansByName indexes the recorded spans, failing if a name is missing.
+func spansByName(t *testing.T, exporter *tracetest.InMemoryExporter, names ...string) map[string]tracetest.SpanStub {
+	spans := map[string]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+	for _, name := range names {
+		if _, ok := spans[name]; !ok {
+			t.Fatalf("No %s span in %d spans", name, len(exporter.GetSpans()))
+		}
+	}
+	return spans
+}
+
+func hasAttribute(span tracetest.SpanStub, attr attribute.KeyValue) bool {
+	for _, a := range span.Attributes {
+		if a == attr {
+			return true
+		}
+	}
+	return false
+}
+
+func TestServer_Tracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	s := NewServer(func(r *http.Request) (Tunnel, error) {
+		guacd, client := net.Pipe()
+		go fakeGuacd(guacd, "5.ready,5.$abcd;")
+		stream := NewStream(client, time.Minute)
+		config := NewGuacamoleConfiguration()
+		config.Protocol = "rdp"
+		if err := stream.HandshakeContext(r.Context(), config); err != nil {
+			return nil, err
+		}
+		return NewSimpleTunnel(stream), nil
+	})
+	defer s.tunnels.Shutdown()
+	s.Tracing = Tracing{TracerProvider: provider, Propagator: propagation.TraceContext{}}
+
+	req := httptest.NewRequest(http.MethodPost, "/tunnel?connect", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatal("Unexpected connect status", rec.Code, rec.Body.String())
+	}
+	uuid := rec.Body.String()
+	tunnel, _ := s.tunnels.Get(uuid)
+	s.closeTunnel(tunnel, CloseReason{Cause: DisconnectClosed, Status: Success})
+
+	spans := spansByName(t, exporter,
+		"guac.session", "guac.connect", "guac.handshake", "guac.handshake.select", "guac.handshake.connect")
+
+	// each span is a child of the one before, the session continuing the trace from the request headers
+	parents := []struct{ child, parent string }{
+		{"guac.connect", "guac.session"},
+		{"guac.handshake", "guac.connect"},
+		{"guac.handshake.select", "guac.handshake"},
+		{"guac.handshake.connect", "guac.handshake"},
+	}
+	for _, p := range parents {
+		if spans[p.child].Parent.SpanID() != spans[p.parent].SpanContext.SpanID() {
+			t.Errorf("Expected %s to be a child of %s", p.child, p.parent)
+		}
+	}
+	session := spans["guac.session"]
+	if got := session.SpanContext.TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Error("Trace context not propagated, got trace", got)
+	}
+	if got := session.Parent.SpanID().String(); got != "00f067aa0ba902b7" {
+		t.Error("Expected the session to continue the remote span, got parent", got)
+	}
+
+	for _, attr := range []attribute.KeyValue{
+		attrTransport.String(transportHTTP),
+		attrProtocol.String("rdp"),
+		attrConnectionID.String("$abcd"),
+		attrTunnelUUID.String(uuid),
+		attrDisconnectReason.String(DisconnectClosed.String()),
+	} {
+		if !hasAttribute(session, attr) {
+			t.Error("Session span missing attribute", attr)
+		}
+	}
+	if !hasAttribute(spans["guac.handshake"], attrConnectionID.String("$abcd")) {
+		t.Error("Handshake span missing the connection ID")
+	}
+}
+
+func TestStream_HandshakeContext_Error(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	ctx, parent := provider.Tracer("test").Start(context.Background(), "test")
+
+	guacd, client := net.Pipe()
+	defer guacd.Close()
+	go fakeGuacd(guacd, "5.error,7.Failed.,3.519;")
+
+	config := NewGuacamoleConfiguration()
+	config.Protocol = "rdp"
+	if err := NewStream(client, time.Minute).HandshakeContext(ctx, config); err == nil {
+		t.Fatal("Expected the handshake to fail")
+	}
+	parent.End()
+
+	spans := spansByName(t, exporter, "guac.handshake", "guac.handshake.select", "guac.handshake.connect")
+	for _, name := range []string{"guac.handshake", "guac.handshake.connect"} {
+		if spans[name].Status.Code != codes.Error || spans[name].Status.Description != "Failed." {
+			t.Errorf("Expected %s to fail, got %+v", name, spans[name].Status)
+		}
+	}
+	if spans["guac.handshake.select"].Status.Code == codes.Error {
+		t.Error("Expected the select phase to succeed")
+	}
+}
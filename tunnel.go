@@ -1,9 +1,12 @@
 package guac
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"io"
+	"sync"
 )
 
 // The Guacamole protocol instruction Opcode reserved for arbitrary
@@ -16,6 +19,21 @@ const InternalDataOpcode = ""
 
 var internalOpcodeIns = []byte(fmt.Sprint(len(InternalDataOpcode), ".", InternalDataOpcode))
 
+// errorOpcodeIns prefixes error instructions, after which guacd ends the session
+var errorOpcodeIns = []byte("5.error,")
+
+// upstreamError returns the error reported by ins if it is a guacd error instruction, otherwise nil.
+func upstreamError(ins []byte) error {
+	if !bytes.HasPrefix(ins, errorOpcodeIns) {
+		return nil
+	}
+	instruction, err := Parse(ins)
+	if err != nil {
+		return ErrServer.Wrap(err, "Malformed error instruction from guacd.")
+	}
+	return errorFromInstruction(instruction)
+}
+
 // InstructionReader provides reading functionality to a Stream
 type InstructionReader interface {
 	// ReadSome returns the next complete guacd message from the stream
@@ -26,6 +44,31 @@ type InstructionReader interface {
 	Flush()
 }
 
+// NoCopyReader is implemented by InstructionReaders which can return instructions without copying them, as
+// Stream does.
+type NoCopyReader interface {
+	// ReadSomeNoCopy returns the next complete guacd message like ReadSome, as a slice of the reader's buffer
+	// which is only valid until the next read
+	ReadSomeNoCopy() ([]byte, error)
+}
+
+// readSomeNoCopy reads the next instruction without copying it if the reader allows, so it is only valid until
+// the next read.
+func readSomeNoCopy(r InstructionReader) ([]byte, error) {
+	if n, ok := r.(NoCopyReader); ok {
+		return n.ReadSomeNoCopy()
+	}
+	return r.ReadSome()
+}
+
+// copied returns a copy of an instruction read without copying, for ReadSome.
+func copied(ins []byte, err error) ([]byte, error) {
+	if ins != nil {
+		ins = append([]byte(nil), ins...)
+	}
+	return ins, err
+}
+
 // Tunnel provides a unique identifier and synchronized access to the InstructionReader and Writer
 // associated with a Stream.
 type Tunnel interface {
@@ -49,6 +92,197 @@ type Tunnel interface {
 	Close() error
 }
 
+// ProtocolTunnel is implemented by tunnels which know the protocol of their guacd connection, such as
+// SimpleTunnel.
+type ProtocolTunnel interface {
+	// Protocol returns the protocol of the guacd connection, or an empty string if it isn't known, e.g. when
+	// joining a connection
+	Protocol() string
+}
+
+// protocolOf returns the protocol of the tunnel's guacd connection, or an empty string if it isn't known.
+func protocolOf(tunnel Tunnel) string {
+	if known, ok := tunnel.(ProtocolTunnel); ok {
+		return known.Protocol()
+	}
+	return ""
+}
+
+// TunnelCloser is implemented by tunnels which record why they were closed, such as SimpleTunnel. The servers
+// track the lifecycle of a tunnel which isn't one themselves, closing it with Close.
+type TunnelCloser interface {
+	// CloseWithReason closes the tunnel, recording why. Only the reason given by the first close is kept.
+	CloseWithReason(reason CloseReason) error
+	// State returns whether the tunnel is open or closed
+	State() TunnelState
+	// Done returns a channel which is closed once the tunnel is closed
+	Done() <-chan struct{}
+	// CloseReason returns why the tunnel was closed, or the zero CloseReason if it is still open
+	CloseReason() CloseReason
+}
+
+// closedNormally is the reason a tunnel closed with Close was closed for
+var closedNormally = CloseReason{Cause: DisconnectClosed, Status: Success}
+
+// closerOf returns the tunnel if it is a TunnelCloser, otherwise a TunnelCloser tracking the tunnel's
+// lifecycle on its behalf.
+func closerOf(tunnel Tunnel) TunnelCloser {
+	if closer, ok := tunnel.(TunnelCloser); ok {
+		return closer
+	}
+	return &closeTracker{tunnel: tunnel, lifecycle: newLifecycle()}
+}
+
+// closeTracker records the lifecycle of a tunnel which doesn't record it itself
+type closeTracker struct {
+	tunnel Tunnel
+	*lifecycle
+}
+
+// CloseWithReason closes the tunnel the first time it is called, recording the reason
+func (t *closeTracker) CloseWithReason(reason CloseReason) error {
+	return t.close(reason, t.tunnel.Close)
+}
+
+// lifecycle records whether and why a tunnel was closed
+type lifecycle struct {
+	once   sync.Once
+	done   chan struct{}
+	reason CloseReason
+}
+
+func newLifecycle() *lifecycle {
+	return &lifecycle{done: make(chan struct{})}
+}
+
+// close calls closeFn the first time it is called, recording the reason
+func (l *lifecycle) close(reason CloseReason, closeFn func() error) (err error) {
+	l.once.Do(func() {
+		l.reason = reason
+		err = closeFn()
+		close(l.done)
+	})
+	return
+}
+
+// State returns whether the tunnel has been closed
+func (l *lifecycle) State() TunnelState {
+	select {
+	case <-l.done:
+		return TunnelClosed
+	default:
+		return TunnelOpen
+	}
+}
+
+// Done returns a channel which is closed once the tunnel is closed
+func (l *lifecycle) Done() <-chan struct{} {
+	return l.done
+}
+
+// CloseReason returns why the tunnel was closed
+func (l *lifecycle) CloseReason() CloseReason {
+	select {
+	case <-l.done:
+		return l.reason
+	default:
+		return CloseReason{}
+	}
+}
+
+// TunnelState is the lifecycle state of a Tunnel.
+type TunnelState int
+
+const (
+	// TunnelOpen indicates the tunnel may be read from and written to.
+	TunnelOpen TunnelState = iota
+	// TunnelClosed indicates the tunnel has been closed and its connection to guacd released.
+	TunnelClosed
+)
+
+// String returns the name of the state.
+func (s TunnelState) String() string {
+	switch s {
+	case TunnelOpen:
+		return "open"
+	case TunnelClosed:
+		return "closed"
+	}
+	return ""
+}
+
+// CloseReason describes why a tunnel was closed.
+type CloseReason struct {
+	// Cause is the kind of event which closed the tunnel.
+	Cause DisconnectReason
+	// Status is reported to the client, e.g. SessionClosed when an administrator kills a session.
+	Status Status
+	// Message optionally describes the closure, e.g. the message of a guacd error instruction.
+	Message string
+}
+
+// closeReasonOf determines the CloseReason for the error which ended a session.
+func closeReasonOf(err error) CloseReason {
+	reason := CloseReason{Cause: disconnectReasonOf(err), Status: Success}
+	if reason.Cause != DisconnectClosed {
+		guacErr := guacErrorOf(err, ErrServer)
+		reason.Status = guacErr.Status
+		reason.Message = guacErr.Error()
+	}
+	return reason
+}
+
+// DisconnectReason describes why a tunnel was disconnected. It is passed to the disconnect callbacks of both
+// Server and WebsocketServer so sessions are tracked the same way regardless of transport.
+type DisconnectReason int
+
+const (
+	// DisconnectClosed indicates the tunnel was closed normally by the client or by guacd.
+	DisconnectClosed DisconnectReason = iota
+	// DisconnectTimeout indicates the tunnel was closed because it was inactive for too long.
+	DisconnectTimeout
+	// DisconnectError indicates the tunnel was closed because reading from or writing to it failed.
+	DisconnectError
+	// DisconnectUpstream indicates guacd ended the session with an error instruction.
+	DisconnectUpstream
+	// DisconnectKilled indicates the application closed the tunnel, e.g. at an administrator's request.
+	DisconnectKilled
+)
+
+// String returns the name of the reason.
+func (r DisconnectReason) String() string {
+	switch r {
+	case DisconnectClosed:
+		return "closed"
+	case DisconnectTimeout:
+		return "timeout"
+	case DisconnectError:
+		return "error"
+	case DisconnectUpstream:
+		return "upstream"
+	case DisconnectKilled:
+		return "killed"
+	}
+	return ""
+}
+
+// disconnectReasonOf determines the DisconnectReason for the error which ended a tunnel.
+func disconnectReasonOf(err error) DisconnectReason {
+	if err == nil {
+		return DisconnectClosed
+	}
+	var guacErr *ErrGuac
+	switch {
+	case errors.As(err, &guacErr) && guacErr.upstream:
+		return DisconnectUpstream
+	case errors.Is(err, ErrConnectionClosed):
+		return DisconnectClosed
+	case errors.Is(err, ErrUpstreamTimeout), errors.Is(err, ErrClientTimeout), errors.Is(err, ErrSessionTimeout):
+		return DisconnectTimeout
+	}
+	return DisconnectError
+}
+
 // Base Tunnel implementation which synchronizes access to the underlying reader and writer with locks
 type SimpleTunnel struct {
 	stream *Stream
@@ -60,20 +294,30 @@ type SimpleTunnel struct {
 	uuid       uuid.UUID
 	readerLock CountedLock
 	writerLock CountedLock
+	*lifecycle
+
+	toClient trafficCounter
+	toGuacd  trafficCounter
+	reader   countingReader
+	writer   countingWriter
 }
 
 // NewSimpleTunnel creates a new tunnel
 func NewSimpleTunnel(stream *Stream) *SimpleTunnel {
-	return &SimpleTunnel{
-		stream: stream,
-		uuid:   uuid.New(),
+	t := &SimpleTunnel{
+		stream:    stream,
+		uuid:      uuid.New(),
+		lifecycle: newLifecycle(),
 	}
+	t.reader = countingReader{InstructionReader: stream, counter: &t.toClient}
+	t.writer = countingWriter{w: stream, counter: &t.toGuacd}
+	return t
 }
 
 // AcquireReader acquires the reader lock
 func (t *SimpleTunnel) AcquireReader() InstructionReader {
 	t.readerLock.Lock()
-	return t.stream
+	return &t.reader
 }
 
 // ReleaseReader releases the reader
@@ -89,7 +333,7 @@ func (t *SimpleTunnel) HasQueuedReaderThreads() bool {
 // AcquireWriter locks the writer lock
 func (t *SimpleTunnel) AcquireWriter() io.Writer {
 	t.writerLock.Lock()
-	return t.stream
+	return &t.writer
 }
 
 // ReleaseWriter releases the writer lock
@@ -102,6 +346,11 @@ func (t *SimpleTunnel) ConnectionID() string {
 	return t.stream.ConnectionID
 }
 
+// Protocol returns the protocol selected by the handshake
+func (t *SimpleTunnel) Protocol() string {
+	return t.stream.Protocol
+}
+
 // HasQueuedWriterThreads returns true if more than one goroutine is trying to write
 func (t *SimpleTunnel) HasQueuedWriterThreads() bool {
 	return t.writerLock.HasQueued()
@@ -109,7 +358,20 @@ func (t *SimpleTunnel) HasQueuedWriterThreads() bool {
 
 // Close closes the underlying stream
 func (t *SimpleTunnel) Close() (err error) {
-	return t.stream.Close()
+	return t.CloseWithReason(closedNormally)
+}
+
+// CloseWithReason closes the underlying stream the first time it is called, recording the reason
+func (t *SimpleTunnel) CloseWithReason(reason CloseReason) (err error) {
+	return t.close(reason, t.stream.Close)
+}
+
+// Stats returns the traffic through the tunnel so far
+func (t *SimpleTunnel) Stats() TunnelStats {
+	return TunnelStats{
+		ToClient: t.toClient.stats(),
+		ToGuacd:  t.toGuacd.stats(),
+	}
 }
 
 // GetUUID returns the tunnel's UUID
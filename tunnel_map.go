@@ -1,7 +1,10 @@
 package guac
 
 import (
-	"github.com/sirupsen/logrus"
+	"crypto/subtle"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"net/http"
 	"sync"
 	"time"
 )
@@ -19,15 +22,38 @@ independently of the HTTP requests.
 type LastAccessedTunnel struct {
 	sync.RWMutex
 	Tunnel
+	// TunnelCloser records why the tunnel was closed, whether or not the tunnel does so itself.
+	TunnelCloser
 	lastAccessedTime time.Time
+
+	// token is the HTTP tunnel session token issued to the client on connect, if any.
+	token string
+	// request is the connect request which created the tunnel, passed to disconnect callbacks.
+	request *http.Request
+	// closed counts the tunnel closed in the metrics once it is deregistered.
+	closed func()
+	// session is the span of the session, ended once the tunnel is deregistered.
+	session trace.Span
+	// logger carries the fields identifying the session.
+	logger *slog.Logger
+	// auditor audits the session, nil without an Auditor.
+	auditor *sessionAuditor
+	// filter applies the session's policies, nil without any.
+	filter *tunnelFilter
 }
 
 func NewLastAccessedTunnel(tunnel Tunnel) (ret LastAccessedTunnel) {
 	ret.Tunnel = tunnel
+	ret.TunnelCloser = closerOf(tunnel)
 	ret.Access()
 	return
 }
 
+// Close closes the tunnel as if it ended normally
+func (t *LastAccessedTunnel) Close() error {
+	return t.CloseWithReason(closedNormally)
+}
+
 func (t *LastAccessedTunnel) Access() {
 	t.Lock()
 	t.lastAccessedTime = time.Now()
@@ -40,6 +66,19 @@ func (t *LastAccessedTunnel) GetLastAccessedTime() time.Time {
 	return t.lastAccessedTime
 }
 
+// inject writes an instruction to guacd outside of a write request, waiting for any in progress.
+func (t *LastAccessedTunnel) inject(ins []byte) error {
+	w := t.auditor.writer(t.AcquireWriter())
+	defer t.ReleaseWriter()
+	_, err := w.Write(ins)
+	return err
+}
+
+// checkToken returns true if the given token matches the one issued for this tunnel.
+func (t *LastAccessedTunnel) checkToken(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(t.token), []byte(token)) == 1
+}
+
 /*
 TunnelTimeout is the number of seconds to wait between tunnel accesses before timing out.
 Note that this will be enforced only within a factor of 2. If a tunnel
@@ -63,14 +102,26 @@ type TunnelMap struct {
 
 	// Map of all tunnels that are using HTTP, indexed by tunnel UUID.
 	tunnelMap     map[string]*LastAccessedTunnel
+
+	// onExpire is called after a tunnel has been removed and closed because it timed out.
+	onExpire func(*LastAccessedTunnel)
+
+	// Logger receives logs about tunnels which weren't registered with their own logger, the default slog
+	// logger if nil. Set it before tunnels are added.
+	Logger *slog.Logger
 }
 
 // NewTunnelMap creates a new TunnelMap and starts the scheduled job with the default timeout.
 func NewTunnelMap() *TunnelMap {
+	return newTunnelMap(nil)
+}
+
+func newTunnelMap(onExpire func(*LastAccessedTunnel)) *TunnelMap {
 	tunnelMap := &TunnelMap{
 		ticker:        time.NewTicker(TunnelTimeout),
 		tunnelMap:     make(map[string]*LastAccessedTunnel),
 		tunnelTimeout: TunnelTimeout,
+		onExpire:      onExpire,
 	}
 	go tunnelMap.tunnelTimeoutTask()
 	return tunnelMap
@@ -105,20 +156,42 @@ func (m *TunnelMap) tunnelTimeoutTaskRun() {
 
 	m.Lock()
 	for _, double := range removeIDs {
-		logrus.Debugf("HTTP tunnel \"%v\" has timed out.", double.uuid)
+		logger := m.tunnelLogger(double.uuid, double.tunnel)
+		logger.Debug("HTTP tunnel has timed out")
 		delete(m.tunnelMap, double.uuid)
+		metrics.tunnelExpired.Inc()
 
 		if double.tunnel != nil {
-			err := double.tunnel.Close()
+			err := double.tunnel.CloseWithReason(CloseReason{
+				Cause:   DisconnectTimeout,
+				Status:  ClientTimeout,
+				Message: "HTTP tunnel timed out.",
+			})
 			if err != nil {
-				logrus.Debug("Unable to close expired HTTP tunnel.", err)
+				logger.Debug("Unable to close expired HTTP tunnel", "error", err)
 			}
 		}
 	}
 	m.Unlock()
+
+	if m.onExpire != nil {
+		for _, double := range removeIDs {
+			if double.tunnel != nil {
+				m.onExpire(double.tunnel)
+			}
+		}
+	}
 	return
 }
 
+// tunnelLogger returns the logger the tunnel was registered with, otherwise the map's logger.
+func (m *TunnelMap) tunnelLogger(uuid string, tunnel *LastAccessedTunnel) *slog.Logger {
+	if tunnel != nil && tunnel.logger != nil {
+		return tunnel.logger
+	}
+	return loggerOr(m.Logger).With(slog.String(logTunnelUUID, uuid))
+}
+
 // Get returns the Tunnel having the given UUID, wrapped within a LastAccessedTunnel.
 func (m *TunnelMap) Get(uuid string) (tunnel *LastAccessedTunnel, ok bool) {
 	m.RLock()
@@ -133,11 +206,16 @@ func (m *TunnelMap) Get(uuid string) (tunnel *LastAccessedTunnel, ok bool) {
 	return
 }
 
-// Add registers that a new connection has been established using HTTP via the given Tunnel.
+// Put registers that a new connection has been established using HTTP via the given Tunnel.
 func (m *TunnelMap) Put(uuid string, tunnel Tunnel) {
-	m.Lock()
 	one := NewLastAccessedTunnel(tunnel)
-	m.tunnelMap[uuid] = &one
+	m.put(uuid, &one)
+}
+
+// put registers an already wrapped tunnel, keeping any token or request the Server attached to it.
+func (m *TunnelMap) put(uuid string, tunnel *LastAccessedTunnel) {
+	m.Lock()
+	m.tunnelMap[uuid] = tunnel
 	m.Unlock()
 }
 
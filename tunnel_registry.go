@@ -0,0 +1,49 @@
+package guac
+
+import "sync"
+
+// tunnelRegistry holds a filter of each live tunnel by the tunnel's UUID, for features such as StreamServer
+// and Clipboards through which programs reach into sessions.
+type tunnelRegistry[F interface {
+	comparable
+	instructionFilter
+}] struct {
+	mu      sync.Mutex
+	tunnels map[string]F
+}
+
+// add adds the filter made by newFilter to the filter of a tunnel, creating that if the tunnel has none, and
+// finds it by the tunnel's UUID until it is removed.
+func (r *tunnelRegistry[F]) add(tunnelUUID string, session *tunnelFilter, newFilter func(session *tunnelFilter) F) *tunnelFilter {
+	if session == nil {
+		session = &tunnelFilter{}
+	}
+	filter := newFilter(session)
+	// after the other filters, so it only sees what they allow
+	session.filters = append(session.filters, filter)
+
+	r.mu.Lock()
+	if r.tunnels == nil {
+		r.tunnels = make(map[string]F)
+	}
+	r.tunnels[tunnelUUID] = filter
+	r.mu.Unlock()
+	return session
+}
+
+// get returns the filter of the live tunnel with the UUID.
+func (r *tunnelRegistry[F]) get(tunnelUUID string) (F, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	filter, ok := r.tunnels[tunnelUUID]
+	return filter, ok
+}
+
+// remove stops finding the filter by the tunnel's UUID, unless another has taken its place.
+func (r *tunnelRegistry[F]) remove(tunnelUUID string, filter F) {
+	r.mu.Lock()
+	if r.tunnels[tunnelUUID] == filter {
+		delete(r.tunnels, tunnelUUID)
+	}
+	r.mu.Unlock()
+}
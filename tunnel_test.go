@@ -0,0 +1,96 @@
+package guac
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSimpleTunnel_Close(t *testing.T) {
+	guacd, client := net.Pipe()
+	defer guacd.Close()
+	tunnel := NewSimpleTunnel(NewStream(client, time.Minute))
+
+	if got := tunnel.State(); got != TunnelOpen {
+		t.Error("Expected an open tunnel, got", got)
+	}
+	select {
+	case <-tunnel.Done():
+		t.Fatal("Done closed before the tunnel was closed")
+	default:
+	}
+
+	killed := CloseReason{Cause: DisconnectKilled, Status: SessionClosed, Message: "Killed by admin."}
+	if err := tunnel.CloseWithReason(killed); err != nil {
+		t.Fatal(err)
+	}
+	// Later closes do nothing and don't replace the reason
+	if err := tunnel.Close(); err != nil {
+		t.Error("Expected closing again to do nothing, got", err)
+	}
+
+	select {
+	case <-tunnel.Done():
+	default:
+		t.Fatal("Done not closed after the tunnel was closed")
+	}
+	if got := tunnel.State(); got != TunnelClosed {
+		t.Error("Expected a closed tunnel, got", got)
+	}
+	if got := tunnel.CloseReason(); got != killed {
+		t.Error("Unexpected close reason", got)
+	}
+}
+
+func TestCloserOf(t *testing.T) {
+	guacd, client := net.Pipe()
+	defer guacd.Close()
+	simple := NewSimpleTunnel(NewStream(client, time.Minute))
+	if closerOf(simple) != TunnelCloser(simple) {
+		t.Error("Expected a TunnelCloser to record its own lifecycle")
+	}
+
+	// a tunnel with only the methods of Tunnel has its lifecycle tracked for it
+	closer := closerOf(struct{ Tunnel }{simple})
+	killed := CloseReason{Cause: DisconnectKilled, Status: SessionClosed, Message: "Killed by admin."}
+	if err := closer.CloseWithReason(killed); err != nil {
+		t.Fatal(err)
+	}
+	if err := closer.CloseWithReason(closedNormally); err != nil {
+		t.Error("Expected closing again to do nothing, got", err)
+	}
+	<-closer.Done()
+	if got := closer.State(); got != TunnelClosed {
+		t.Error("Expected a closed tunnel, got", got)
+	}
+	if got := closer.CloseReason(); got != killed {
+		t.Error("Unexpected close reason", got)
+	}
+	if got := simple.CloseReason(); got != closedNormally {
+		t.Error("Expected the tunnel to be closed with Close, got", got)
+	}
+}
+
+func TestCloseReasonOf(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		cause  DisconnectReason
+		status Status
+	}{
+		{"Nil", nil, DisconnectClosed, Success},
+		{"Closed", ErrConnectionClosed.NewError("gone"), DisconnectClosed, Success},
+		{"Timeout", ErrUpstreamTimeout.NewError("slow"), DisconnectTimeout, UpstreamTimeout},
+		{"Upstream", errorFromInstruction(NewInstruction("error", "Host down.", "515")), DisconnectUpstream, UpstreamError},
+		{"Error", ErrServer.NewError("boom"), DisconnectError, ServerError},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := closeReasonOf(test.err)
+			if got.Cause != test.cause || got.Status != test.status {
+				t.Errorf("Got %v/%v, want %v/%v", got.Cause, got.Status, test.cause, test.status)
+			}
+		})
+	}
+}
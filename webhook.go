@@ -0,0 +1,296 @@
+package guac
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Webhook request headers
+const (
+	// WebhookSignatureHeader carries "sha256=" and the hex HMAC-SHA256 of the timestamp, ".", then the body,
+	// keyed with the webhook's secret
+	WebhookSignatureHeader = "X-Guac-Signature"
+	// WebhookTimestampHeader carries the Unix time in seconds the request was signed, which differs between
+	// attempts
+	WebhookTimestampHeader = "X-Guac-Timestamp"
+	// WebhookEventHeader carries the type of the event
+	WebhookEventHeader = "X-Guac-Event"
+	// WebhookDeliveryHeader carries an ID which is the same for each attempt to deliver an event
+	WebhookDeliveryHeader = "X-Guac-Delivery"
+)
+
+const (
+	// DefaultWebhookQueueSize is the number of events which may wait to be delivered to each webhook.
+	DefaultWebhookQueueSize = 256
+	// DefaultWebhookRetries is the number of times a failed delivery is retried.
+	DefaultWebhookRetries = 3
+	// DefaultWebhookRetryDelay is the wait before the first retry, which doubles with each retry.
+	DefaultWebhookRetryDelay = time.Second
+	// DefaultWebhookTimeout bounds each delivery attempt.
+	DefaultWebhookTimeout = 10 * time.Second
+	// WebhookTolerance is how far from their own clock receivers should accept the timestamp of a signed
+	// request, to allow for clock skew and the time the request took, while refusing old requests replayed.
+	WebhookTolerance = 5 * time.Minute
+)
+
+// DefaultWebhookEvents are the events a webhook is notified of unless it lists its own: sessions starting,
+// ending, failing to connect and joining.
+var DefaultWebhookEvents = []AuditEventType{
+	AuditSessionStart, AuditSessionEnd, AuditConnectFailed, AuditAuthFailed, AuditJoin,
+}
+
+// Webhook is a URL notified of session events.
+type Webhook struct {
+	URL string
+	// Secret keys the signature of each request, which isn't signed if Secret is empty.
+	Secret []byte
+	// Events lists the events to notify of, DefaultWebhookEvents if empty.
+	Events []AuditEventType
+}
+
+// WebhookDispatcher is an Auditor which POSTs events as JSON to webhooks. Events are queued for each webhook
+// and delivered in order from its own goroutine, so a slow receiver never blocks a session or the other
+// webhooks. An event which doesn't fit in a full queue is dropped. Failed deliveries are retried when the
+// receiver may yet accept them, i.e. after network errors, 5xx and 429 responses.
+//
+// Set the fields before the first event. Combine it with other auditors with MultiAuditor.
+type WebhookDispatcher struct {
+	// Client sends the requests, a client with DefaultWebhookTimeout if nil.
+	Client *http.Client
+	// QueueSize is the number of events which may wait for each webhook, DefaultWebhookQueueSize if zero.
+	QueueSize int
+	// Retries is the number of times a failed delivery is retried, DefaultWebhookRetries if zero. Negative
+	// disables retries.
+	Retries int
+	// RetryDelay is the wait before the first retry, DefaultWebhookRetryDelay if zero.
+	RetryDelay time.Duration
+	// Logger receives logs of failed deliveries, the default slog logger if nil.
+	Logger *slog.Logger
+
+	hooks []Webhook
+
+	startOnce sync.Once
+	queues    []chan webhookDelivery
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+// webhookDelivery is an event to deliver to one webhook
+type webhookDelivery struct {
+	id        string
+	eventType AuditEventType
+	body      []byte
+}
+
+// NewWebhookDispatcher returns a dispatcher notifying the webhooks.
+func NewWebhookDispatcher(hooks ...Webhook) *WebhookDispatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &WebhookDispatcher{
+		hooks:  hooks,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// start starts delivering to each webhook
+func (d *WebhookDispatcher) start() {
+	if d.Client == nil {
+		d.Client = &http.Client{Timeout: DefaultWebhookTimeout}
+	}
+	if d.QueueSize <= 0 {
+		d.QueueSize = DefaultWebhookQueueSize
+	}
+	if d.Retries == 0 {
+		d.Retries = DefaultWebhookRetries
+	}
+	if d.RetryDelay <= 0 {
+		d.RetryDelay = DefaultWebhookRetryDelay
+	}
+
+	d.queues = make([]chan webhookDelivery, len(d.hooks))
+	for i := range d.hooks {
+		d.queues[i] = make(chan webhookDelivery, d.QueueSize)
+		d.wg.Add(1)
+		go d.run(d.hooks[i], d.queues[i])
+	}
+}
+
+// Audit queues the event for the webhooks notified of it. It returns an error if a queue is full or the
+// dispatcher is closed.
+func (d *WebhookDispatcher) Audit(event AuditEvent) error {
+	d.startOnce.Do(d.start)
+	if d.ctx.Err() != nil {
+		return errors.New("webhook dispatcher is closed")
+	}
+
+	var delivery *webhookDelivery
+	var errs []error
+	for i, hook := range d.hooks {
+		if !hook.notifies(event.Type) {
+			continue
+		}
+		if delivery == nil {
+			body, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+			delivery = &webhookDelivery{id: uuid.NewString(), eventType: event.Type, body: body}
+		}
+		select {
+		case d.queues[i] <- *delivery:
+		default:
+			errs = append(errs, fmt.Errorf("webhook queue for %s is full, dropped %s event", hook.URL, event.Type))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close stops the dispatcher, abandoning events which haven't been delivered, and waits for its goroutines to
+// exit.
+func (d *WebhookDispatcher) Close() error {
+	d.startOnce.Do(d.start)
+	d.cancel()
+	d.wg.Wait()
+	return nil
+}
+
+func (hook Webhook) notifies(eventType AuditEventType) bool {
+	events := hook.Events
+	if len(events) == 0 {
+		events = DefaultWebhookEvents
+	}
+	for _, e := range events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// run delivers the events queued for the webhook until the dispatcher is closed.
+func (d *WebhookDispatcher) run(hook Webhook, queue chan webhookDelivery) {
+	defer d.wg.Done()
+	logger := loggerOr(d.Logger).With("webhook", hook.URL)
+
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case delivery := <-queue:
+			if err := d.deliver(hook, delivery); err != nil && d.ctx.Err() == nil {
+				logger.Error("Unable to deliver webhook", "event", string(delivery.eventType), "error", err)
+			}
+		}
+	}
+}
+
+// deliver sends the event, retrying with exponential backoff while the failure may be temporary.
+func (d *WebhookDispatcher) deliver(hook Webhook, delivery webhookDelivery) error {
+	delay := d.RetryDelay
+	for attempt := 0; ; attempt++ {
+		retry, err := d.post(hook, delivery)
+		if err == nil || !retry || attempt >= d.Retries {
+			return err
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-d.ctx.Done():
+			timer.Stop()
+			return d.ctx.Err()
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
+// post makes one attempt at delivery, returning whether a failure is worth retrying.
+func (d *WebhookDispatcher) post(hook Webhook, delivery webhookDelivery) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(d.ctx, http.MethodPost, hook.URL, bytes.NewReader(delivery.body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, string(delivery.eventType))
+	req.Header.Set(WebhookDeliveryHeader, delivery.id)
+	if len(hook.Secret) > 0 {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(WebhookTimestampHeader, timestamp)
+		req.Header.Set(WebhookSignatureHeader, SignWebhook(hook.Secret, timestamp, delivery.body))
+	}
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	// drain the body so the connection is reused
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	_ = resp.Body.Close()
+
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode >= 500, resp.StatusCode == http.StatusTooManyRequests:
+		return true, fmt.Errorf("webhook responded %s", resp.Status)
+	default:
+		return false, fmt.Errorf("webhook responded %s", resp.Status)
+	}
+}
+
+// SignWebhook returns the value of the signature header of a request with the timestamp header and body,
+// which receivers compare with hmac.Equal. The timestamp is signed so a request can't be replayed later than
+// WebhookTolerance; VerifyWebhook checks both.
+func SignWebhook(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook returns an error unless the request with the header and body was signed with the secret within
+// WebhookTolerance of now. Receivers should also ignore deliveries whose WebhookDeliveryHeader they've seen.
+func VerifyWebhook(secret []byte, header http.Header, body []byte, now time.Time) error {
+	timestamp := header.Get(WebhookTimestampHeader)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("webhook timestamp is missing or invalid")
+	}
+	if skew := now.Sub(time.Unix(seconds, 0)); skew > WebhookTolerance || skew < -WebhookTolerance {
+		return errors.New("webhook timestamp is outside the tolerance")
+	}
+	want := SignWebhook(secret, timestamp, body)
+	if !hmac.Equal([]byte(header.Get(WebhookSignatureHeader)), []byte(want)) {
+		return errors.New("webhook signature does not match")
+	}
+	return nil
+}
+
+// MultiAuditor passes each event to all of its auditors, returning their errors joined.
+type MultiAuditor []Auditor
+
+// Audit passes the event to each auditor.
+func (m MultiAuditor) Audit(event AuditEvent) error {
+	var errs []error
+	for _, auditor := range m {
+		if err := auditor.Audit(event); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
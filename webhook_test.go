@@ -0,0 +1,197 @@
+package guac
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver passes on the requests to an httptest server, responding with the statuses in turn and
+// then 200.
+type webhookReceiver struct {
+	mu       sync.Mutex
+	statuses []int
+	received chan receivedWebhook
+}
+
+type receivedWebhook struct {
+	header http.Header
+	body   []byte
+}
+
+func newWebhookReceiver(t *testing.T, statuses ...int) (*webhookReceiver, *httptest.Server) {
+	r := &webhookReceiver{statuses: statuses, received: make(chan receivedWebhook, 16)}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.mu.Lock()
+		status := http.StatusOK
+		if len(r.statuses) > 0 {
+			status, r.statuses = r.statuses[0], r.statuses[1:]
+		}
+		r.mu.Unlock()
+		w.WriteHeader(status)
+		r.received <- receivedWebhook{header: req.Header, body: body}
+	}))
+	t.Cleanup(srv.Close)
+	return r, srv
+}
+
+func (r *webhookReceiver) next(t *testing.T) receivedWebhook {
+	t.Helper()
+	select {
+	case req := <-r.received:
+		return req
+	case <-time.After(5 * time.Second):
+		t.Fatal("Webhook not delivered")
+		return receivedWebhook{}
+	}
+}
+
+func TestWebhookDispatcher(t *testing.T) {
+	receiver, srv := newWebhookReceiver(t)
+	secret := []byte("s3cret")
+	d := NewWebhookDispatcher(Webhook{URL: srv.URL, Secret: secret})
+	defer func() { _ = d.Close() }()
+
+	// only lifecycle events are sent by default
+	for _, eventType := range []AuditEventType{AuditClipboard, AuditSessionStart} {
+		if err := d.Audit(AuditEvent{Type: eventType, TunnelUUID: "1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req := receiver.next(t)
+	if got := req.header.Get(WebhookEventHeader); got != string(AuditSessionStart) {
+		t.Error("Unexpected event header", got)
+	}
+	if got := req.header.Get("Content-Type"); got != "application/json" {
+		t.Error("Unexpected content type", got)
+	}
+	timestamp := req.header.Get(WebhookTimestampHeader)
+	if got, want := req.header.Get(WebhookSignatureHeader), SignWebhook(secret, timestamp, req.body); !hmac.Equal([]byte(got), []byte(want)) {
+		t.Errorf("Unexpected signature %s, want %s", got, want)
+	}
+	if err := VerifyWebhook(secret, req.header, req.body, time.Now()); err != nil {
+		t.Error(err)
+	}
+	var event AuditEvent
+	if err := json.Unmarshal(req.body, &event); err != nil || event.Type != AuditSessionStart || event.TunnelUUID != "1" {
+		t.Errorf("Unexpected payload %s %v", req.body, err)
+	}
+
+	select {
+	case req = <-receiver.received:
+		t.Errorf("Unexpected webhook %s", req.body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestVerifyWebhook(t *testing.T) {
+	secret, body := []byte("s3cret"), []byte(`{"type":"session_start"}`)
+	signedAt := time.Unix(1700000000, 0)
+	header := http.Header{}
+	header.Set(WebhookTimestampHeader, "1700000000")
+	header.Set(WebhookSignatureHeader, SignWebhook(secret, "1700000000", body))
+
+	if err := VerifyWebhook(secret, header, body, signedAt.Add(WebhookTolerance)); err != nil {
+		t.Error("Expected a request within the tolerance to verify, got", err)
+	}
+	// the same request replayed later is refused
+	if err := VerifyWebhook(secret, header, body, signedAt.Add(WebhookTolerance+time.Second)); err == nil {
+		t.Error("Expected a replayed request to be refused")
+	}
+	// as is one whose timestamp was changed to make it current
+	header.Set(WebhookTimestampHeader, "1700001000")
+	if err := VerifyWebhook(secret, header, body, time.Unix(1700001000, 0)); err == nil {
+		t.Error("Expected a request with a changed timestamp to be refused")
+	}
+}
+
+func TestWebhookDispatcher_Retry(t *testing.T) {
+	receiver, srv := newWebhookReceiver(t, http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK, http.StatusBadRequest)
+	d := NewWebhookDispatcher(Webhook{URL: srv.URL})
+	d.RetryDelay = time.Millisecond
+	defer func() { _ = d.Close() }()
+
+	if err := d.Audit(AuditEvent{Type: AuditSessionEnd}); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for i := 0; i < 3; i++ {
+		ids = append(ids, receiver.next(t).header.Get(WebhookDeliveryHeader))
+	}
+	if ids[0] == "" || ids[0] != ids[1] || ids[1] != ids[2] {
+		t.Error("Expected retries to share a delivery ID", ids)
+	}
+
+	// a client error isn't retried
+	if err := d.Audit(AuditEvent{Type: AuditSessionEnd}); err != nil {
+		t.Fatal(err)
+	}
+	receiver.next(t)
+	select {
+	case req := <-receiver.received:
+		t.Errorf("Unexpected retry %s", req.body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWebhookDispatcher_QueueFull(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	defer srv.Close()
+	d := NewWebhookDispatcher(Webhook{URL: srv.URL})
+	d.QueueSize = 1
+
+	// the first event is stuck being delivered, the second is queued and the rest are dropped
+	if err := d.Audit(AuditEvent{Type: AuditSessionStart}); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	var dropped int
+	start := time.Now()
+	for i := 0; i < 9; i++ {
+		if err := d.Audit(AuditEvent{Type: AuditSessionStart}); err != nil {
+			dropped++
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Error("Audit blocked for", elapsed)
+	}
+	if dropped != 8 {
+		t.Error("Unexpected number of dropped events", dropped)
+	}
+
+	close(release)
+	_ = d.Close()
+	if err := d.Audit(AuditEvent{Type: AuditSessionStart}); err == nil {
+		t.Error("Expected an error auditing with a closed dispatcher")
+	}
+}
+
+func TestServer_Webhook(t *testing.T) {
+	receiver, srv := newWebhookReceiver(t)
+	d := NewWebhookDispatcher(Webhook{URL: srv.URL, Events: []AuditEventType{AuditJoin}})
+	defer func() { _ = d.Close() }()
+
+	s, _ := newPipeServer(t)
+	recorder := &auditRecorder{}
+	s.Auditor = MultiAuditor{recorder, d}
+
+	uuid := serve(s, http.MethodPost, "connect", "", "").Body.String()
+
+	var event AuditEvent
+	if err := json.Unmarshal(receiver.next(t).body, &event); err != nil || event.Type != AuditJoin || event.TunnelUUID != uuid {
+		t.Errorf("Unexpected event %+v %v", event, err)
+	}
+	checkAuditTypes(t, recorder.wait(t, 1), AuditJoin)
+}
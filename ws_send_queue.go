@@ -0,0 +1,355 @@
+package guac
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// DefaultSendQueueSize is the number of messages which may wait to be sent to a websocket client
+	DefaultSendQueueSize = 64
+	// DefaultWriteTimeout bounds each write to a websocket client, and how long to wait for room in its queue
+	DefaultWriteTimeout = SocketTimeout
+)
+
+// SlowConsumerPolicy decides what happens when a websocket client can't keep up with guacd.
+type SlowConsumerPolicy int
+
+const (
+	// SlowConsumerDisconnect ends the session with ClientTimeout.
+	SlowConsumerDisconnect SlowConsumerPolicy = iota
+	// SlowConsumerResync drops the drawing of the visible layers in the complete frames queued for the client,
+	// then asks guacd for a fresh copy of the display with the instruction returned by WebsocketServer.OnResync.
+	// Streams, layer changes, drawing into buffers and the last frame boundary queued still reach the client, so
+	// it stays in step with guacd. Without OnResync, or without a complete frame to drop, the client is disconnected instead.
+	SlowConsumerResync
+)
+
+// String returns the name of the policy.
+func (p SlowConsumerPolicy) String() string {
+	switch p {
+	case SlowConsumerDisconnect:
+		return "disconnect"
+	case SlowConsumerResync:
+		return "resync"
+	}
+	return ""
+}
+
+// SendQueueStats is a snapshot of the send queues of a WebsocketServer.
+type SendQueueStats struct {
+	// Depth is the number of messages currently queued across all clients.
+	Depth int64
+	// MaxDepth is the largest number of messages queued for a single client.
+	MaxDepth int64
+	// Resyncs counts the times frames queued for a client were dropped under SlowConsumerResync.
+	Resyncs int64
+	// SlowDisconnects counts the clients disconnected for not keeping up.
+	SlowDisconnects int64
+}
+
+// sendQueueMetrics accumulates SendQueueStats.
+type sendQueueMetrics struct {
+	depth           atomic.Int64
+	maxDepth        atomic.Int64
+	resyncs         atomic.Int64
+	slowDisconnects atomic.Int64
+}
+
+func (m *sendQueueMetrics) stats() SendQueueStats {
+	return SendQueueStats{
+		Depth:           m.depth.Load(),
+		MaxDepth:        m.maxDepth.Load(),
+		Resyncs:         m.resyncs.Load(),
+		SlowDisconnects: m.slowDisconnects.Load(),
+	}
+}
+
+func (m *sendQueueMetrics) observe(depth int) {
+	for {
+		max := m.maxDepth.Load()
+		if int64(depth) <= max || m.maxDepth.CompareAndSwap(max, int64(depth)) {
+			return
+		}
+	}
+}
+
+// deadlineWriter is implemented by *websocket.Conn
+type deadlineWriter interface {
+	SetWriteDeadline(time.Time) error
+}
+
+// sendQueue is a MessageWriter which queues messages for a websocket and sends them from its own goroutine,
+// so a slow client doesn't stall reading from guacd. Only one goroutine may call WriteMessage.
+type sendQueue struct {
+	ws      MessageWriter
+	queue   chan *[]byte
+	timeout time.Duration
+	policy  SlowConsumerPolicy
+	resync  func() error
+	metrics *sendQueueMetrics
+	logger  *slog.Logger
+
+	failOnce sync.Once
+	failed   chan struct{}
+	err      error
+	finished chan struct{}
+}
+
+func newSendQueue(ws MessageWriter, size int, timeout time.Duration, policy SlowConsumerPolicy, resync func() error, metrics *sendQueueMetrics, logger *slog.Logger) *sendQueue {
+	if size <= 0 {
+		size = DefaultSendQueueSize
+	}
+	if timeout <= 0 {
+		timeout = DefaultWriteTimeout
+	}
+	q := &sendQueue{
+		ws:       ws,
+		queue:    make(chan *[]byte, size),
+		timeout:  timeout,
+		policy:   policy,
+		resync:   resync,
+		metrics:  metrics,
+		logger:   logger,
+		failed:   make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// WriteMessage queues a copy of data. If the queue stays full for the write timeout the slow consumer policy
+// is applied.
+func (q *sendQueue) WriteMessage(messageType int, data []byte) error {
+	select {
+	case <-q.failed:
+		return q.err
+	default:
+	}
+
+	msg := getBuffer()
+	*msg = append(*msg, data...)
+	if err := q.enqueueOrApplyPolicy(msg); err != nil {
+		putBuffer(msg)
+		return err
+	}
+	return nil
+}
+
+func (q *sendQueue) enqueueOrApplyPolicy(msg *[]byte) error {
+	if q.enqueue(msg, 0) {
+		return nil
+	}
+	if q.enqueue(msg, q.timeout) {
+		return nil
+	}
+	select {
+	case <-q.failed:
+		return q.err
+	default:
+	}
+
+	if q.policy == SlowConsumerResync && q.resync != nil && q.dropFrames() {
+		q.logger.Debug("Client not keeping up, resyncing")
+		q.metrics.resyncs.Add(1)
+		if err := q.resync(); err != nil {
+			return guacErrorOf(err, ErrServer, "Failed to resync client.")
+		}
+		if q.enqueue(msg, q.timeout) {
+			return nil
+		}
+	}
+
+	q.logger.Debug("Client not keeping up, disconnecting")
+	q.metrics.slowDisconnects.Add(1)
+	return ErrClientTimeout.NewError("Client is not keeping up.")
+}
+
+// enqueue adds msg to the queue, waiting up to timeout for room. It returns false if there was no room or
+// sending has failed.
+func (q *sendQueue) enqueue(msg *[]byte, timeout time.Duration) bool {
+	if timeout == 0 {
+		select {
+		case q.queue <- msg:
+		default:
+			return false
+		}
+	} else {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case q.queue <- msg:
+		case <-timer.C:
+			return false
+		case <-q.failed:
+			return false
+		}
+	}
+	q.metrics.depth.Add(1)
+	q.metrics.observe(len(q.queue))
+	return true
+}
+
+// drawingOpcodes are the instructions which only paint a layer, mapped to the position of the layer they paint
+// among their arguments. Those painting a visible layer may be dropped from a complete frame when guacd is
+// about to redraw the display. Those painting a buffer (a negative layer) never are, as guacd keeps images
+// there to copy from in later frames. Neither are instructions which begin or carry streams, or which change
+// layers or drawing state.
+var drawingOpcodes = map[string]int{
+	"arc":      0,
+	"cfill":    1,
+	"close":    0,
+	"copy":     6,
+	"cstroke":  1,
+	"curve":    0,
+	"jpeg":     1,
+	"lfill":    1,
+	"line":     0,
+	"lstroke":  1,
+	"png":      1,
+	"rect":     0,
+	"start":    0,
+	"transfer": 6,
+	"webp":     1,
+}
+
+// paintsVisibleLayer returns true if the instruction only paints a visible layer.
+func paintsVisibleLayer(opcode, args []byte) bool {
+	position, ok := drawingOpcodes[string(opcode)]
+	if !ok {
+		return false
+	}
+	for ; position > 0; position-- {
+		_, args = nextElement(args)
+	}
+	layer, _ := nextElement(args)
+	index, err := strconv.Atoi(string(layer))
+	return err == nil && index >= 0
+}
+
+// dropFrames replaces the queued messages with one holding what the client still needs. The drawing of the
+// visible layers in the complete frames queued is dropped, and their syncs are replaced by the last, which the
+// client acknowledges as if it had drawn them all. Everything after the last sync is kept, as is everything
+// else before it. It returns false, leaving the queue as it was, if no complete frame is queued.
+func (q *sendQueue) dropFrames() bool {
+	var queued []*[]byte
+	for {
+		select {
+		case msg := <-q.queue:
+			q.metrics.depth.Add(-1)
+			queued = append(queued, msg)
+			continue
+		default:
+		}
+		break
+	}
+	defer func() {
+		for _, msg := range queued {
+			putBuffer(msg)
+		}
+	}()
+
+	lastSync := -1
+	var instructions [][]byte
+	var splitter instructionSplitter
+	for _, msg := range queued {
+		_ = splitter.split(*msg, func(ins []byte) error {
+			if opcode, _ := nextElement(ins); string(opcode) == "sync" {
+				lastSync = len(instructions)
+			}
+			instructions = append(instructions, ins)
+			return nil
+		})
+	}
+	partial := splitter.partial
+
+	kept := getBuffer()
+	for i, ins := range instructions {
+		if i < lastSync {
+			if opcode, args := nextElement(ins); string(opcode) == "sync" || paintsVisibleLayer(opcode, args) {
+				continue
+			}
+		}
+		*kept = append(*kept, ins...)
+	}
+	if partial != nil {
+		*kept = append(*kept, *partial...)
+	}
+	splitter.release()
+
+	if lastSync < 0 {
+		// put back what was taken, which run may have been waiting for
+		putBuffer(kept)
+		for i, msg := range queued {
+			q.enqueue(msg, 0)
+			queued[i] = nil
+		}
+		queued = nil
+		return false
+	}
+	q.enqueue(kept, 0)
+	return true
+}
+
+// Close stops accepting messages and waits until the queued ones are sent or sending fails, which is bounded
+// by the write timeout.
+func (q *sendQueue) Close() {
+	close(q.queue)
+	<-q.finished
+}
+
+func (q *sendQueue) run() {
+	defer close(q.finished)
+	dw, canDeadline := q.ws.(deadlineWriter)
+
+	for msg := range q.queue {
+		q.metrics.depth.Add(-1)
+
+		if canDeadline {
+			if err := dw.SetWriteDeadline(time.Now().Add(q.timeout)); err != nil {
+				q.fail(ErrConnectionClosed.Wrap(err, "Connection to client is closed."))
+				break
+			}
+		}
+		err := q.ws.WriteMessage(websocket.TextMessage, *msg)
+		putBuffer(msg)
+		if err != nil {
+			if err != websocket.ErrCloseSent {
+				q.logger.Debug("Failed sending message to ws", "error", err)
+			}
+			if isTimeout(err) {
+				q.metrics.slowDisconnects.Add(1)
+				q.fail(ErrClientTimeout.Wrap(err, "Client is not keeping up."))
+			} else {
+				q.fail(ErrConnectionClosed.Wrap(err, "Connection to client is closed."))
+			}
+			break
+		}
+	}
+
+	// anything left is never sent
+	for msg := range q.queue {
+		q.metrics.depth.Add(-1)
+		putBuffer(msg)
+	}
+}
+
+func (q *sendQueue) fail(err error) {
+	q.failOnce.Do(func() {
+		q.err = err
+		close(q.failed)
+	})
+}
+
+// isTimeout returns true if err is a network timeout, such as an expired write deadline
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
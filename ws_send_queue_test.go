@@ -0,0 +1,234 @@
+package guac
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingWriter is a MessageWriter whose writes wait until it is released.
+type blockingWriter struct {
+	release  chan struct{}
+	mu       sync.Mutex
+	messages []string
+}
+
+func (b *blockingWriter) WriteMessage(n int, buf []byte) error {
+	<-b.release
+	b.mu.Lock()
+	b.messages = append(b.messages, string(buf))
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *blockingWriter) get() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.messages...)
+}
+
+func TestSendQueue_Order(t *testing.T) {
+	w := &blockingWriter{release: make(chan struct{})}
+	close(w.release)
+	metrics := &sendQueueMetrics{}
+	q := newSendQueue(w, 4, time.Second, SlowConsumerDisconnect, nil, metrics, slog.Default())
+
+	buf := []byte("4.sync,1.0;")
+	if err := q.WriteMessage(1, buf); err != nil {
+		t.Fatal(err)
+	}
+	// the queue holds a copy, so the caller may reuse its buffer
+	copy(buf, "4.sync,1.1;")
+	if err := q.WriteMessage(1, buf); err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+
+	if got := w.get(); len(got) != 2 || got[0] != "4.sync,1.0;" || got[1] != "4.sync,1.1;" {
+		t.Error("Unexpected messages", got)
+	}
+	if got := metrics.stats().Depth; got != 0 {
+		t.Error("Expected an empty queue, got depth", got)
+	}
+}
+
+func TestSendQueue_SlowConsumerDisconnect(t *testing.T) {
+	w := &blockingWriter{release: make(chan struct{})}
+	metrics := &sendQueueMetrics{}
+	q := newSendQueue(w, 2, 20*time.Millisecond, SlowConsumerDisconnect, nil, metrics, slog.Default())
+
+	var err error
+	for i := 0; i < 10 && err == nil; i++ {
+		err = q.WriteMessage(1, []byte("3.nop;"))
+	}
+	if !errors.Is(err, ErrClientTimeout) {
+		t.Error("Expected ErrClientTimeout, got", err)
+	}
+
+	stats := metrics.stats()
+	if stats.SlowDisconnects != 1 || stats.MaxDepth != 2 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	close(w.release)
+	q.Close()
+}
+
+func TestSendQueue_SlowConsumerResync(t *testing.T) {
+	w := &blockingWriter{release: make(chan struct{})}
+	metrics := &sendQueueMetrics{}
+	resyncs := 0
+	resync := func() error {
+		resyncs++
+		return nil
+	}
+	q := newSendQueue(w, 2, 20*time.Millisecond, SlowConsumerResync, resync, metrics, slog.Default())
+
+	img := NewInstruction("img", "1", "14", "0", "image/png", "0", "0").String()
+	blob := NewInstruction("blob", "1", "AAAA").String()
+	size := NewInstruction("size", "0", "10", "10").String()
+	rect := NewInstruction("rect", "0", "0", "0", "10", "10").String()
+	cfill := NewInstruction("cfill", "14", "0", "0", "0", "0", "255").String()
+	// one message is taken by the blocked writer, two fill the queue, the last of which ends with part of a frame
+	messages := []string{
+		"4.sync,1.0;",
+		img + rect + blob + "4.sync,1.1;",
+		size + cfill + "4.sync,1.2;" + rect,
+		cfill + "4.sync,1.3;",
+	}
+	for _, message := range messages {
+		if err := q.WriteMessage(1, []byte(message)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if resyncs != 1 {
+		t.Error("Expected 1 resync, got", resyncs)
+	}
+	if stats := metrics.stats(); stats.Resyncs != 1 || stats.Depth != 2 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	close(w.release)
+	q.Close()
+
+	// the drawing of the complete frames is dropped, but not the stream, the layer change, the last sync or what
+	// follows it
+	want := []string{"4.sync,1.0;", img + blob + size + "4.sync,1.2;" + rect, cfill + "4.sync,1.3;"}
+	if got := w.get(); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("Unexpected messages %q, want %q", got, want)
+	}
+}
+
+func TestSendQueue_ResyncKeepsBuffers(t *testing.T) {
+	w := &blockingWriter{release: make(chan struct{})}
+	metrics := &sendQueueMetrics{}
+	resync := func() error { return nil }
+	q := newSendQueue(w, 2, 20*time.Millisecond, SlowConsumerResync, resync, metrics, slog.Default())
+
+	// one message is taken by the blocked writer and two fill the queue. guacd caches an image in a buffer, then copies it to the display
+	bufferRect := NewInstruction("rect", "-1", "0", "0", "10", "10").String()
+	bufferFill := NewInstruction("cfill", "14", "-1", "0", "0", "0", "255").String()
+	copyToDisplay := NewInstruction("copy", "-1", "0", "0", "10", "10", "14", "0", "0", "0").String()
+	copyToBuffer := NewInstruction("copy", "0", "0", "0", "10", "10", "14", "-2", "0", "0").String()
+	messages := []string{
+		"4.sync,1.0;",
+		bufferRect + bufferFill + copyToDisplay + copyToBuffer + "4.sync,1.1;",
+		copyToDisplay + "4.sync,1.2;",
+		"4.sync,1.3;",
+	}
+	for _, message := range messages {
+		if err := q.WriteMessage(1, []byte(message)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(w.release)
+	q.Close()
+
+	// only the drawing of the display is dropped, so later frames can still copy from the buffers
+	want := []string{"4.sync,1.0;", bufferRect + bufferFill + copyToBuffer + "4.sync,1.2;", "4.sync,1.3;"}
+	if got := w.get(); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("Unexpected messages %q, want %q", got, want)
+	}
+}
+
+func TestSendQueue_ResyncWithoutFrame(t *testing.T) {
+	w := &blockingWriter{release: make(chan struct{})}
+	metrics := &sendQueueMetrics{}
+	resync := func() error {
+		t.Error("Unexpected resync")
+		return nil
+	}
+	q := newSendQueue(w, 1, 20*time.Millisecond, SlowConsumerResync, resync, metrics, slog.Default())
+
+	// without a sync queued nothing can be dropped
+	var err error
+	for i := 0; i < 10 && err == nil; i++ {
+		err = q.WriteMessage(1, []byte("3.nop;"))
+	}
+	if !errors.Is(err, ErrClientTimeout) {
+		t.Error("Expected ErrClientTimeout, got", err)
+	}
+	if stats := metrics.stats(); stats.Resyncs != 0 || stats.SlowDisconnects != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	close(w.release)
+	q.Close()
+}
+
+func TestSendQueue_ResyncWithoutCallback(t *testing.T) {
+	w := &blockingWriter{release: make(chan struct{})}
+	q := newSendQueue(w, 1, 20*time.Millisecond, SlowConsumerResync, nil, &sendQueueMetrics{}, slog.Default())
+
+	var err error
+	for i := 0; i < 10 && err == nil; i++ {
+		err = q.WriteMessage(1, []byte("3.nop;"))
+	}
+	if !errors.Is(err, ErrClientTimeout) {
+		t.Error("Expected ErrClientTimeout, got", err)
+	}
+	close(w.release)
+	q.Close()
+}
+
+// deadlineMessageWriter fails writes as if its write deadline expired.
+type deadlineMessageWriter struct {
+	deadlines chan time.Time
+}
+
+func (d *deadlineMessageWriter) SetWriteDeadline(t time.Time) error {
+	d.deadlines <- t
+	return nil
+}
+
+func (d *deadlineMessageWriter) WriteMessage(n int, buf []byte) error {
+	return os.ErrDeadlineExceeded
+}
+
+func TestSendQueue_WriteDeadline(t *testing.T) {
+	w := &deadlineMessageWriter{deadlines: make(chan time.Time, 1)}
+	metrics := &sendQueueMetrics{}
+	q := newSendQueue(w, 4, time.Second, SlowConsumerDisconnect, nil, metrics, slog.Default())
+
+	if err := q.WriteMessage(1, []byte("3.nop;")); err != nil {
+		t.Fatal(err)
+	}
+	if deadline := <-w.deadlines; time.Until(deadline) <= 0 {
+		t.Error("Expected a write deadline in the future, got", deadline)
+	}
+	<-q.failed
+
+	err := q.WriteMessage(1, []byte("3.nop;"))
+	if !errors.Is(err, ErrClientTimeout) {
+		t.Error("Expected ErrClientTimeout, got", err)
+	}
+	if got := closeReasonOf(err); got.Cause != DisconnectTimeout || got.Status != ClientTimeout {
+		t.Error("Unexpected close reason", got)
+	}
+	q.Close()
+
+	if got := metrics.stats().SlowDisconnects; got != 1 {
+		t.Error("Expected 1 slow disconnect, got", got)
+	}
+}
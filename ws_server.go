@@ -2,11 +2,14 @@ package guac
 
 import (
 	"bytes"
+	"errors"
 	"io"
+	"log/slog"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/websocket"
-	"github.com/sirupsen/logrus"
 )
 
 // WebsocketServer implements a websocket-based connection to guacd.
@@ -23,8 +26,56 @@ type WebsocketServer struct {
 
 	// OnConnectWs is an optional callback called when a websocket connects.
 	OnConnectWs func(string, *websocket.Conn, *http.Request)
-	// OnDisconnectWs is an optional callback called when the websocket disconnects.
+	// OnDisconnectWs is an optional callback called when the websocket disconnects. If the tunnel is a
+	// StatsTunnel, its Stats are the traffic of the whole session.
 	OnDisconnectWs func(string, *websocket.Conn, *http.Request, Tunnel)
+	// OnDisconnectReason is an optional callback called when the websocket disconnects, with the reason.
+	OnDisconnectReason func(string, *http.Request, Tunnel, DisconnectReason)
+
+	// SendQueueSize is the number of messages which may wait to be sent to each client, DefaultSendQueueSize
+	// if zero.
+	SendQueueSize int
+	// WriteTimeout bounds each write to a client and how long to wait for room in its send queue before
+	// SlowConsumerPolicy applies, DefaultWriteTimeout if zero. A write which times out disconnects the client.
+	WriteTimeout time.Duration
+	// SlowConsumerPolicy decides what happens when a client's send queue stays full.
+	SlowConsumerPolicy SlowConsumerPolicy
+	// OnResync is called under SlowConsumerResync after the drawing queued for a client is dropped. It returns
+	// the instruction asking guacd to send the client a fresh copy of the display, which the server writes to
+	// guacd alongside the client's input. It must not write to the tunnel itself, as the session holds its
+	// writer.
+	OnResync func(Tunnel) (*Instruction, error)
+
+	// Batching configures how guacd output is grouped into websocket messages.
+	Batching OutputBatching
+
+	// Tracing configures the spans traced for each session.
+	Tracing Tracing
+
+	// Logger receives the server's logs, the default slog logger if nil. Logs about a session carry its tunnel
+	// UUID, connection ID and user.
+	Logger *slog.Logger
+	// User is an optional callback returning the user making a connection request, for logs and audit events.
+	User func(*http.Request) string
+
+	// Auditor records the security-relevant events of each session, if set.
+	Auditor Auditor
+	// ClipboardPolicy optionally returns the policy restricting the clipboard of the session a connection
+	// request creates. The session's clipboard is unrestricted if it returns nil.
+	ClipboardPolicy func(*http.Request) *ClipboardPolicy
+	// DownloadPolicy optionally returns the policy restricting the files downloaded in the session a connection
+	// request creates. The session's downloads are unrestricted if it returns nil.
+	DownloadPolicy func(*http.Request) *DownloadPolicy
+	// Streams optionally serves the streams of the server's tunnels over plain HTTP.
+	Streams *StreamServer
+	// Clipboards optionally gives programs access to the clipboards of the server's tunnels.
+	Clipboards *Clipboards
+
+	// StreamQueueSize is how many bytes of stream data from a client, such as an upload, may wait behind its
+	// input on the way to guacd, DefaultStreamQueueSize if zero.
+	StreamQueueSize int
+
+	sendQueueMetrics sendQueueMetrics
 }
 
 // NewWebsocketServer creates a new server with a simple connect method.
@@ -42,14 +93,28 @@ func NewWebsocketServerWs(connect func(*websocket.Conn, *http.Request) (Tunnel,
 }
 
 const (
-	websocketReadBufferSize  = MaxGuacMessage
+	// websocketReadBufferSize of zero reuses the buffer the HTTP server allocated for the connection
+	websocketReadBufferSize = 0
+	// websocketWriteBufferSize buffers are taken from websocketBufferPool only while a message is written
 	websocketWriteBufferSize = MaxGuacMessage * 2
+
+	// websocketCloseTimeout is how long to wait for the client to acknowledge a close frame
+	websocketCloseTimeout = time.Second
 )
 
+// SendQueueStats returns the current state of the send queues of all clients.
+func (s *WebsocketServer) SendQueueStats() SendQueueStats {
+	return s.sendQueueMetrics.stats()
+}
+
+// disconnectInstruction asks guacd to end the session when the client goes away
+var disconnectInstruction = NewInstruction("disconnect")
+
 func (s *WebsocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	upgrader := websocket.Upgrader{
 		ReadBufferSize:  websocketReadBufferSize,
 		WriteBufferSize: websocketWriteBufferSize,
+		WriteBufferPool: websocketBufferPool,
 		CheckOrigin: func(r *http.Request) bool {
 			return true // TODO
 		},
@@ -58,35 +123,62 @@ func (s *WebsocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ws, err := upgrader.Upgrade(w, r, http.Header{
 		"Sec-Websocket-Protocol": {protocol},
 	})
+	logger := loggerOr(s.Logger)
 	if err != nil {
-		logrus.Error("Failed to upgrade websocket", err)
+		logger.Error("Failed to upgrade websocket", "error", err)
 		return
 	}
 	defer func() {
 		if err = ws.Close(); err != nil {
-			logrus.Traceln("Error closing websocket", err)
+			logger.Debug("Error closing websocket", "error", err)
 		}
 	}()
 
-	logrus.Debug("Connecting to tunnel")
-	var tunnel Tunnel
-	var e error
-	if s.connect != nil {
-		tunnel, e = s.connect(r)
-	} else {
-		tunnel, e = s.connectWs(ws, r)
-	}
+	logger.Debug("Connecting to tunnel")
+	r, session := s.Tracing.startSession(r, transportWebsocket)
+	tunnel, e := traceConnect(r, func(r *http.Request) (Tunnel, error) {
+		if s.connect != nil {
+			return s.connect(r)
+		}
+		return s.connectWs(ws, r)
+	})
+	user := userOf(s.User, r)
 	if e != nil {
+		// Callbacks may return an *ErrGuac to report a more specific status to the client
+		guacErr := guacErrorOf(e, ErrResourceNotFound, "No tunnel created.")
+		logger.Error("Creation of WebSocket tunnel to guacd failed", "error", guacErr, "status", guacErr.Status.String())
+		auditConnectFailure(s.Auditor, logger, transportWebsocket, r, user, guacErr)
+		sendError(ws, guacErr, logger)
+		endSpan(session, guacErr)
 		return
 	}
+	session.SetAttributes(tunnelAttributes(tunnel)...)
+	logger = sessionLogger(logger, tunnel, user)
+	closer := closerOf(tunnel)
 	defer func() {
-		if err = tunnel.Close(); err != nil {
-			logrus.Traceln("Error closing tunnel", err)
+		if err = closer.CloseWithReason(closedNormally); err != nil {
+			logger.Debug("Error closing tunnel", "error", err)
 		}
 	}()
-	logrus.Debug("Connected to tunnel")
+	logger.Debug("Connected to tunnel")
+	defer metrics.tunnelOpened(transportWebsocket, tunnel)()
+
+	// The JavaScript client learns the tunnel UUID from this internal instruction before any guacd data
+	uuidIns := NewInstruction(InternalDataOpcode, tunnel.GetUUID())
+	if err = ws.WriteMessage(websocket.TextMessage, uuidIns.Byte()); err != nil {
+		logger.Debug("Failed sending tunnel UUID to ws", "error", err)
+		endSpan(session, err)
+		return
+	}
 
 	id := tunnel.ConnectionID()
+	auditor := newSessionAuditor(s.Auditor, logger, transportWebsocket, r, user, tunnel)
+	auditor.start()
+	filter := s.Streams.register(tunnel.GetUUID(), "", newTunnelFilter(
+		newClipboardFilter(policyOf(s.ClipboardPolicy, r), logger, auditor),
+		newDownloadFilter(policyOf(s.DownloadPolicy, r), logger, downloadOf(tunnel, user)),
+	), logger)
+	filter = s.Clipboards.register(tunnel.GetUUID(), filter, logger)
 
 	if s.OnConnect != nil {
 		s.OnConnect(id, r)
@@ -95,8 +187,8 @@ func (s *WebsocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		s.OnConnectWs(id, ws, r)
 	}
 
-	writer := tunnel.AcquireWriter()
-	reader := tunnel.AcquireReader()
+	writer := auditor.writer(tunnel.AcquireWriter())
+	reader := filter.reader(auditor.reader(tunnel.AcquireReader()))
 
 	if s.OnDisconnect != nil {
 		defer s.OnDisconnect(id, r, tunnel)
@@ -108,8 +200,100 @@ func (s *WebsocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	defer tunnel.ReleaseWriter()
 	defer tunnel.ReleaseReader()
 
-	go wsToGuacd(ws, writer)
-	guacdToWs(ws, reader)
+	reason := s.pump(ws, tunnel, closer, reader, writer, filter, logger)
+	logger.Debug("Disconnected", "reason", reason.Cause.String(), "status", reason.Status.String())
+	endSession(session, reason)
+	filter.end()
+	auditor.end(tunnel, reason)
+
+	if s.OnDisconnectReason != nil {
+		s.OnDisconnectReason(id, r, tunnel, reason.Cause)
+	}
+}
+
+// pump runs both directions of the session until one of them ends, then shuts the other down and waits for
+// it to exit. The tunnel is closed with closer with the reason the session ended, unless it was already
+// closed, e.g. by the application killing the session, in which case the earlier reason is returned. The client's
+// instructions pass through the filter, if any, which injects its own into the scheduler.
+func (s *WebsocketServer) pump(ws *websocket.Conn, tunnel Tunnel, closer TunnelCloser, reader InstructionReader, writer io.Writer, filter *tunnelFilter, logger *slog.Logger) CloseReason {
+	wsDone := make(chan error, 1)
+	guacdDone := make(chan error, 1)
+
+	// input from the client overtakes its uploads on the way to guacd
+	scheduler := newInputScheduler(writer, s.StreamQueueSize)
+	input := filter.writer(scheduler)
+	filter.setInject(scheduler.inject)
+	go func() { wsDone <- wsToGuacd(ws, input, logger) }()
+	go func() {
+		var resync func() error
+		if s.OnResync != nil {
+			resync = func() error {
+				ins, err := s.OnResync(tunnel)
+				if err != nil || ins == nil {
+					return err
+				}
+				return scheduler.inject(ins.Byte())
+			}
+		}
+		queue := newSendQueue(ws, s.SendQueueSize, s.WriteTimeout, s.SlowConsumerPolicy, resync, &s.sendQueueMetrics, logger)
+		err := guacdToWs(queue, reader, s.Batching, logger)
+		// deliver what guacd sent, e.g. an error instruction, before the close frame
+		queue.Close()
+		guacdDone <- err
+	}()
+
+	select {
+	case err := <-wsDone:
+		// The client went away: ask guacd to end the session, then close the tunnel so the guacd read unblocks
+		if _, e := disconnectInstruction.WriteTo(scheduler); e != nil {
+			logger.Debug("Failed sending disconnect to guacd", "error", e)
+		}
+		if e := input.Close(); e != nil {
+			logger.Debug("Failed writing to guacd", "error", e)
+		}
+		if e := closer.CloseWithReason(closeReasonOf(err)); e != nil {
+			logger.Debug("Error closing tunnel", "error", e)
+		}
+		<-guacdDone
+	case err := <-guacdDone:
+		// guacd went away: close the websocket, giving the client a moment to acknowledge before the read unblocks
+		if e := closer.CloseWithReason(closeReasonOf(err)); e != nil {
+			logger.Debug("Error closing tunnel", "error", e)
+		}
+		writeClose(ws, closer.CloseReason().Status, logger)
+		if e := ws.SetReadDeadline(time.Now().Add(websocketCloseTimeout)); e != nil {
+			logger.Debug("Error setting websocket read deadline", "error", e)
+		}
+		<-wsDone
+		_ = input.Close()
+	}
+	return closer.CloseReason()
+}
+
+// writeClose sends a close frame for the status. Like the Java tunnel endpoint, the close reason is the
+// Guacamole status code, which the JavaScript client reads when the socket closes.
+func writeClose(ws *websocket.Conn, status Status, logger *slog.Logger) {
+	code := strconv.Itoa(status.GetGuacamoleStatusCode())
+	closeMessage := websocket.FormatCloseMessage(status.GetWebSocketCode(), code)
+	metrics.websocketClosed(status.GetWebSocketCode(), "server")
+	if err := ws.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(websocketCloseTimeout)); err != nil {
+		logger.Debug("Failed sending close to ws", "error", err)
+	}
+}
+
+// sendError reports the error to the client with an error instruction followed by a close frame.
+func sendError(ws *websocket.Conn, guacErr *ErrGuac, logger *slog.Logger) {
+	message := "Internal server error."
+	if guacErr.Status.isClientError() {
+		message = guacErr.Error()
+	}
+	code := strconv.Itoa(guacErr.Status.GetGuacamoleStatusCode())
+
+	if err := ws.WriteMessage(websocket.TextMessage, NewInstruction("error", message, code).Byte()); err != nil {
+		logger.Debug("Failed sending error to ws", "error", err)
+		return
+	}
+	writeClose(ws, guacErr.Status, logger)
 }
 
 // MessageReader wraps a websocket connection and only permits Reading
@@ -118,12 +302,18 @@ type MessageReader interface {
 	ReadMessage() (int, []byte, error)
 }
 
-func wsToGuacd(ws MessageReader, guacd io.Writer) {
+// wsToGuacd pumps messages from the websocket to guacd until either side fails, returning the error which
+// ended the session. A failure to read from the websocket means the client went away.
+func wsToGuacd(ws MessageReader, guacd io.Writer, logger *slog.Logger) error {
 	for {
 		_, data, err := ws.ReadMessage()
 		if err != nil {
-			logrus.Traceln("Error reading message from ws", err)
-			return
+			logger.Debug("Error reading message from ws", "error", err)
+			var closeErr *websocket.CloseError
+			if errors.As(err, &closeErr) {
+				metrics.websocketClosed(closeErr.Code, "client")
+			}
+			return ErrConnectionClosed.Wrap(err, "Connection to client is closed.")
 		}
 
 		if bytes.HasPrefix(data, internalOpcodeIns) {
@@ -132,8 +322,8 @@ func wsToGuacd(ws MessageReader, guacd io.Writer) {
 		}
 
 		if _, err = guacd.Write(data); err != nil {
-			logrus.Traceln("Failed writing to guacd", err)
-			return
+			logger.Debug("Failed writing to guacd", "error", err)
+			return guacErrorOf(err, ErrUpstream, "Failed writing to guacd.")
 		}
 	}
 }
@@ -144,14 +334,27 @@ type MessageWriter interface {
 	WriteMessage(int, []byte) error
 }
 
-func guacdToWs(ws MessageWriter, guacd InstructionReader) {
-	buf := bytes.NewBuffer(make([]byte, 0, MaxGuacMessage*2))
+// guacdToWs pumps instructions from guacd to the websocket until either side fails, returning the error which
+// ended the session. A failure to write to the websocket means the client went away.
+func guacdToWs(ws MessageWriter, guacd InstructionReader, batching OutputBatching, logger *slog.Logger) error {
+	batch := newBatcher(batching, func(data []byte) error {
+		if err := ws.WriteMessage(websocket.TextMessage, data); err != nil {
+			if err != websocket.ErrCloseSent {
+				logger.Debug("Failed sending message to ws", "error", err)
+			}
+			return guacErrorOf(err, ErrConnectionClosed, "Connection to client is closed.")
+		}
+		return nil
+	})
+	defer batch.stop()
 
 	for {
-		ins, err := guacd.ReadSome()
+		ins, err := readSomeNoCopy(guacd)
 		if err != nil {
-			logrus.Traceln("Error reading from guacd", err)
-			return
+			logger.Debug("Error reading from guacd", "error", err)
+			// pass on what guacd sent before it went away
+			_ = batch.flush()
+			return err
 		}
 
 		if bytes.HasPrefix(ins, internalOpcodeIns) {
@@ -159,21 +362,16 @@ func guacdToWs(ws MessageWriter, guacd InstructionReader) {
 			continue
 		}
 
-		if _, err = buf.Write(ins); err != nil {
-			logrus.Traceln("Failed to buffer guacd to ws", err)
-			return
+		if err = batch.write(ins, guacd.Available()); err != nil {
+			return err
 		}
 
-		// if the buffer has more data in it or we've reached the max buffer size, send the data and reset
-		if !guacd.Available() || buf.Len() >= MaxGuacMessage {
-			if err = ws.WriteMessage(1, buf.Bytes()); err != nil {
-				if err == websocket.ErrCloseSent {
-					return
-				}
-				logrus.Traceln("Failed sending message to ws", err)
-				return
+		// guacd ends the session after an error instruction
+		if upstreamErr := upstreamError(ins); upstreamErr != nil {
+			if err = batch.flush(); err != nil {
+				return err
 			}
-			buf.Reset()
+			return upstreamErr
 		}
 	}
 }
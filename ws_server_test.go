@@ -3,9 +3,17 @@ package guac
 import (
 	"bytes"
 	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/gorilla/websocket"
 )
 
 func TestWebsocketServer_guacdToWs(t *testing.T) {
@@ -25,7 +33,7 @@ func TestWebsocketServer_guacdToWs(t *testing.T) {
 	}
 	guac := NewStream(conn, time.Minute)
 
-	guacdToWs(msgWriter, guac)
+	guacdToWs(msgWriter, guac, OutputBatching{}, slog.Default())
 
 	if len(msgWriter.Messages) != 1 {
 		t.Error("Expected 1 got", len(msgWriter.Messages))
@@ -41,7 +49,7 @@ type fakeMessageWriter struct {
 }
 
 func (f *fakeMessageWriter) WriteMessage(n int, buf []byte) error {
-	f.Messages = append(f.Messages, buf)
+	f.Messages = append(f.Messages, append([]byte(nil), buf...))
 	return nil
 }
 
@@ -85,3 +93,301 @@ func (f *fakeTunnel) GetUUID() string {
 func (f *fakeTunnel) Close() error {
 	return nil
 }
+
+func TestWebsocketServer_SendsTunnelUUID(t *testing.T) {
+	guacd, client := net.Pipe()
+	defer guacd.Close()
+
+	tunnel := NewSimpleTunnel(NewStream(client, time.Minute))
+	srv := httptest.NewServer(NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		return tunnel, nil
+	}))
+	defer srv.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	_, msg, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(msg), "0.,36."+tunnel.GetUUID()+";"; got != want {
+		t.Errorf("Unexpected first message %q, want %q", got, want)
+	}
+}
+
+func TestWebsocketServer_ConnectError(t *testing.T) {
+	srv := httptest.NewServer(NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		return nil, ErrUnauthorized.NewError("Access denied.")
+	}))
+	defer srv.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	_, msg, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(msg), "5.error,14.Access denied.,3.769;"; got != want {
+		t.Errorf("Unexpected error instruction %q, want %q", got, want)
+	}
+
+	_, _, err = ws.ReadMessage()
+	closeErr, ok := err.(*websocket.CloseError)
+	if !ok {
+		t.Fatal("Expected close error, got", err)
+	}
+	if closeErr.Code != websocket.ClosePolicyViolation || closeErr.Text != "769" {
+		t.Error("Unexpected close frame", closeErr.Code, closeErr.Text)
+	}
+}
+
+// wsSession is a WebsocketServer session whose guacd end is a pipe controlled by the test.
+type wsSession struct {
+	guacd      net.Conn
+	ws         *websocket.Conn
+	tunnels    chan *SimpleTunnel
+	reasons    chan DisconnectReason
+	goroutines int
+}
+
+func newWsSession(t *testing.T) *wsSession {
+	sess := &wsSession{tunnels: make(chan *SimpleTunnel, 1), reasons: make(chan DisconnectReason, 1)}
+
+	var client net.Conn
+	sess.guacd, client = net.Pipe()
+	server := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+		tunnel := NewSimpleTunnel(NewStream(client, time.Minute))
+		sess.tunnels <- tunnel
+		return tunnel, nil
+	})
+	server.OnDisconnectReason = func(id string, r *http.Request, tunnel Tunnel, reason DisconnectReason) {
+		sess.reasons <- reason
+	}
+
+	srv := httptest.NewServer(server)
+	t.Cleanup(srv.Close)
+	sess.goroutines = runtime.NumGoroutine()
+
+	var err error
+	sess.ws, _, err = websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = sess.ws.Close() })
+
+	// tunnel UUID
+	if _, _, err = sess.ws.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+	return sess
+}
+
+// checkGoroutines fails if the session left goroutines running once it ended.
+func (sess *wsSession) checkGoroutines(t *testing.T) {
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > sess.goroutines {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("Leaked goroutines, %d > %d\n%s", runtime.NumGoroutine(), sess.goroutines, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWebsocketServer_ClientClose(t *testing.T) {
+	sess := newWsSession(t)
+
+	received := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(sess.guacd)
+		received <- data
+	}()
+
+	closeMessage := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	if err := sess.ws.WriteMessage(websocket.CloseMessage, closeMessage); err != nil {
+		t.Fatal(err)
+	}
+	_ = sess.ws.Close()
+
+	select {
+	case data := <-received:
+		if got, want := string(data), "10.disconnect;"; got != want {
+			t.Errorf("guacd received %q, want %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Tunnel to guacd was not closed after the client went away")
+	}
+
+	if reason := <-sess.reasons; reason != DisconnectClosed {
+		t.Error("Unexpected disconnect reason", reason)
+	}
+	sess.checkGoroutines(t)
+}
+
+func TestWebsocketServer_GuacdClose(t *testing.T) {
+	sess := newWsSession(t)
+
+	if _, err := sess.guacd.Write([]byte("4.sync,1.0;")); err != nil {
+		t.Fatal(err)
+	}
+	if _, msg, err := sess.ws.ReadMessage(); err != nil || string(msg) != "4.sync,1.0;" {
+		t.Fatal("Unexpected message", string(msg), err)
+	}
+
+	_ = sess.guacd.Close()
+
+	_, _, err := sess.ws.ReadMessage()
+	closeErr, ok := err.(*websocket.CloseError)
+	if !ok {
+		t.Fatal("Expected a close frame, got", err)
+	}
+	if closeErr.Code != websocket.CloseNormalClosure || closeErr.Text != "0" {
+		t.Error("Unexpected close frame", closeErr.Code, closeErr.Text)
+	}
+
+	if reason := <-sess.reasons; reason != DisconnectClosed {
+		t.Error("Unexpected disconnect reason", reason)
+	}
+	_ = sess.ws.Close()
+	sess.checkGoroutines(t)
+}
+
+// expectClose reads from the websocket until the close frame and checks its code and reason.
+func (sess *wsSession) expectClose(t *testing.T, code int, text string) {
+	for {
+		_, _, err := sess.ws.ReadMessage()
+		if err == nil {
+			continue
+		}
+		closeErr, ok := err.(*websocket.CloseError)
+		if !ok {
+			t.Fatal("Expected a close frame, got", err)
+		}
+		if closeErr.Code != code || closeErr.Text != text {
+			t.Error("Unexpected close frame", closeErr.Code, closeErr.Text)
+		}
+		return
+	}
+}
+
+func TestWebsocketServer_GuacdError(t *testing.T) {
+	sess := newWsSession(t)
+	tunnel := <-sess.tunnels
+
+	const errorIns = "5.error,10.Host down.,3.515;"
+	if _, err := sess.guacd.Write([]byte(errorIns)); err != nil {
+		t.Fatal(err)
+	}
+	if _, msg, err := sess.ws.ReadMessage(); err != nil || string(msg) != errorIns {
+		t.Fatal("Unexpected message", string(msg), err)
+	}
+	sess.expectClose(t, websocket.CloseInternalServerErr, "515")
+
+	if reason := <-sess.reasons; reason != DisconnectUpstream {
+		t.Error("Unexpected disconnect reason", reason)
+	}
+	if got := tunnel.CloseReason(); got.Status != UpstreamError || got.Message != "Host down." {
+		t.Error("Unexpected close reason", got)
+	}
+	_ = sess.ws.Close()
+	sess.checkGoroutines(t)
+}
+
+func TestWebsocketServer_Kill(t *testing.T) {
+	sess := newWsSession(t)
+	tunnel := <-sess.tunnels
+
+	err := tunnel.CloseWithReason(CloseReason{Cause: DisconnectKilled, Status: SessionClosed, Message: "Killed by admin."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.expectClose(t, websocket.CloseProtocolError, "523")
+
+	if reason := <-sess.reasons; reason != DisconnectKilled {
+		t.Error("Unexpected disconnect reason", reason)
+	}
+	<-tunnel.Done()
+	_ = sess.ws.Close()
+	sess.checkGoroutines(t)
+}
+
+// BenchmarkWebsocketServer_IdleSession reports the memory, heap and goroutine stacks, held by each websocket
+// session waiting on guacd. Clients are bare TCP connections so the measurement is the server side.
+func BenchmarkWebsocketServer_IdleSession(b *testing.B) {
+	const sessions = 200
+	var total float64
+
+	for i := 0; i < b.N; i++ {
+		var pipes []net.Conn
+		var mu sync.Mutex
+		server := NewWebsocketServer(func(r *http.Request) (Tunnel, error) {
+			guacd, client := net.Pipe()
+			mu.Lock()
+			pipes = append(pipes, guacd, client)
+			mu.Unlock()
+			return NewSimpleTunnel(NewStream(client, time.Minute)), nil
+		})
+		srv := httptest.NewServer(server)
+		addr := strings.TrimPrefix(srv.URL, "http://")
+
+		before := idleMemory()
+		clients := make([]net.Conn, 0, sessions)
+		for n := 0; n < sessions; n++ {
+			clients = append(clients, dialIdleWebsocket(b, addr))
+		}
+		// let every session settle into waiting on both ends
+		time.Sleep(100 * time.Millisecond)
+		total += float64(idleMemory() - before)
+
+		for _, c := range clients {
+			_ = c.Close()
+		}
+		mu.Lock()
+		for _, p := range pipes {
+			_ = p.Close()
+		}
+		mu.Unlock()
+		srv.Close()
+	}
+	b.ReportMetric(total/float64(b.N*sessions), "B/session")
+}
+
+// idleMemory returns the heap and stack memory in use after a collection.
+func idleMemory() int64 {
+	var stats runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&stats)
+	return int64(stats.HeapInuse + stats.StackInuse)
+}
+
+// dialIdleWebsocket opens a websocket with a bare TCP connection and reads up to the tunnel UUID.
+func dialIdleWebsocket(b *testing.B, addr string) net.Conn {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: "+addr+"\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	if err != nil {
+		b.Fatal(err)
+	}
+	// the response headers, then the frame carrying the tunnel UUID instruction which ends with ';'
+	var got []byte
+	buf := make([]byte, 512)
+	for !bytes.Contains(got, []byte("\r\n\r\n")) || !bytes.HasSuffix(got, []byte(";")) {
+		n, err := conn.Read(buf)
+		if err != nil {
+			b.Fatal(err)
+		}
+		got = append(got, buf[:n]...)
+	}
+	return conn
+}